@@ -0,0 +1,106 @@
+package driver
+
+import (
+	"log"
+	"net"
+	"net/http"
+
+	docker "github.com/dcbw/go-dockerclient"
+	"github.com/gorilla/mux"
+)
+
+// The admin listener serves operator endpoints.  It is separate from the
+// socket Docker talks to, so it can be locked down independently.
+func (driver *driver) listenAdmin(socket string) error {
+	router := mux.NewRouter()
+	router.NotFoundHandler = http.HandlerFunc(notFound)
+
+	router.Methods("POST").Path("/debug/resync").HandlerFunc(driver.resync)
+	router.Methods("POST").Path("/debug/gc").HandlerFunc(driver.gcHandler)
+	router.Methods("POST").Path("/debug/reconcile").HandlerFunc(driver.reconcile)
+	router.Methods("POST").Path("/debug/check").HandlerFunc(driver.check)
+	router.Methods("GET").Path("/debug/network/{id}").HandlerFunc(driver.debugNetwork)
+	if driver.errors != nil {
+		router.Methods("GET").Path("/debug/errors").HandlerFunc(driver.debugErrors)
+	}
+
+	if err := prepareSocket(socket); err != nil {
+		return err
+	}
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		return err
+	}
+	log.Printf("Admin listener on %s", socket)
+	return driver.newServer(router).Serve(listener)
+}
+
+func (driver *driver) resync(w http.ResponseWriter, r *http.Request) {
+	summary, err := driver.watcher.Resync()
+	if err != nil {
+		sendError(w, "Resync failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	objectResponse(w, summary)
+}
+
+func (driver *driver) reconcile(w http.ResponseWriter, r *http.Request) {
+	objectResponse(w, driver.reconcileEndpoints())
+}
+
+func (driver *driver) check(w http.ResponseWriter, r *http.Request) {
+	objectResponse(w, driver.checkEndpoints())
+}
+
+// networkDebug is what we know of a network and the CNI config its Joins
+// would use, minus any conf rules matching on container labels
+type networkDebug struct {
+	ID      string
+	Docker  *docker.Network `json:",omitempty"`
+	Options map[string]string
+	Conf    *confDebug `json:",omitempty"`
+	Error   string     `json:",omitempty"`
+}
+
+type confDebug struct {
+	Path       string
+	Name       string
+	CNIVersion string
+	Types      []string
+	Binaries   []string
+	PluginPath string `json:",omitempty"`
+}
+
+func (driver *driver) debugNetwork(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	netInfo := driver.createdNetwork(id)
+	resp := &networkDebug{
+		ID:      id,
+		Docker:  driver.watcher.GetNetworkById(id),
+		Options: netInfo.Options,
+	}
+
+	confName, err := driver.networkConfName(id)
+	if err != nil {
+		resp.Error = err.Error()
+		objectResponse(w, resp)
+		return
+	}
+	nc, err := driver.resolveNetConf(confName, netInfo)
+	if err != nil {
+		resp.Error = err.Error()
+		objectResponse(w, resp)
+		return
+	}
+	resp.Conf = &confDebug{
+		Path:       nc.Path,
+		Name:       nc.Name,
+		CNIVersion: nc.CNIVersion,
+		Binaries:   nc.Binaries,
+		PluginPath: nc.PluginPath,
+	}
+	for i := range nc.Plugins {
+		resp.Conf.Types = append(resp.Conf.Types, nc.pluginType(i))
+	}
+	objectResponse(w, resp)
+}
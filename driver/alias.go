@@ -0,0 +1,53 @@
+package driver
+
+import (
+	"fmt"
+)
+
+// aliasOption is an endpoint option giving its interface a human-friendly
+// alias, such as its role in the container, which EndpointOperInfo reports
+// along with the interface's name, addresses and MAC
+const aliasOption = "cni.alias"
+
+// What EndpointOperInfo reports of a joined endpoint's interface
+const (
+	infoIfNameKey    = "cni.ifname"
+	infoAddressesKey = "cni.addresses"
+	infoMacKey       = "cni.mac"
+)
+
+// optionAlias returns the alias in CreateEndpoint or Join options, given
+// directly or among the generic options, or "" if there is none
+func optionAlias(options map[string]interface{}) (string, error) {
+	opt, ok := options[aliasOption]
+	if !ok {
+		generic, _ := options[genericOption].(map[string]interface{})
+		if opt, ok = generic[aliasOption]; !ok {
+			return "", nil
+		}
+	}
+	alias, ok := opt.(string)
+	if !ok {
+		return "", fmt.Errorf("endpoint option %s is not a string", aliasOption)
+	}
+	return alias, nil
+}
+
+// interfaceInfo describes a joined endpoint's interface for EndpointOperInfo
+func (ep *endpoint) interfaceInfo() map[string]interface{} {
+	info := map[string]interface{}{
+		infoIfNameKey: ep.Runtime.IfName,
+	}
+	if result, err := parseResult(ep.Result); err == nil {
+		if intf := result.containerIface(ep.Runtime.Netns); intf != nil {
+			info[infoIfNameKey] = intf.Name
+			if intf.Mac != "" {
+				info[infoMacKey] = intf.Mac
+			}
+		}
+		if addrs := result.addresses(); len(addrs) > 0 {
+			info[infoAddressesKey] = addrs
+		}
+	}
+	return info
+}
@@ -0,0 +1,246 @@
+package driver
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	docker "github.com/dcbw/go-dockerclient"
+)
+
+// A JSON object given in this network option or container label is merged
+// into the "args" object of the config passed to plugins
+const configArgsKey = "cni.args"
+
+// CNI_ARGS given in this network option, container label or endpoint
+// option, as KEY=VALUE pairs separated by semicolons, are passed to the
+// network's plugins; they can't override the Kubernetes arguments or the
+// container name argument, which we set ourselves
+const cniArgsKey = "cni.cniargs"
+
+// parseCNIArg parses one KEY=VALUE pair of CNI_ARGS, which is a
+// semicolon-separated list of them.  We keep them as ordered pairs so the
+// environment we hand to plugins is deterministic.
+func parseCNIArg(arg string) ([2]string, error) {
+	kv := strings.SplitN(arg, "=", 2)
+	if len(kv) != 2 || kv[0] == "" {
+		return [2]string{}, fmt.Errorf("invalid CNI argument %q, expected KEY=VALUE", arg)
+	}
+	if strings.ContainsAny(arg, ";") {
+		return [2]string{}, fmt.Errorf("invalid CNI argument %q, may not contain ';'", arg)
+	}
+	return [2]string{kv[0], kv[1]}, nil
+}
+
+// parseCNIArgs parses a semicolon-separated list of KEY=VALUE pairs
+func parseCNIArgs(value string) ([][2]string, error) {
+	var args [][2]string
+	for _, arg := range strings.Split(value, ";") {
+		if arg == "" {
+			continue
+		}
+		kv, err := parseCNIArg(arg)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", cniArgsKey, err)
+		}
+		args = append(args, kv)
+	}
+	return args, nil
+}
+
+// optionCNIArgs returns the CNI_ARGS in CreateEndpoint options, given
+// directly or among the generic options, or "" if there are none
+func optionCNIArgs(options map[string]interface{}) (string, error) {
+	opt, ok := options[cniArgsKey]
+	if !ok {
+		generic, _ := options[genericOption].(map[string]interface{})
+		if opt, ok = generic[cniArgsKey]; !ok {
+			return "", nil
+		}
+	}
+	value, ok := opt.(string)
+	if !ok {
+		return "", fmt.Errorf("endpoint option %s is not a string", cniArgsKey)
+	}
+	if _, err := parseCNIArgs(value); err != nil {
+		return "", err
+	}
+	return value, nil
+}
+
+// joinCNIArgs merges the CNI_ARGS of the network's options, the
+// container's labels and the endpoint's options, each overriding the keys
+// of the one before
+func joinCNIArgs(nw *network, labels map[string]string, endpointOptions map[string]interface{}) ([][2]string, error) {
+	endpointArgs, _ := endpointOptions[cniArgsKey].(string)
+	var layers [][][2]string
+	for _, value := range []string{nw.Options[cniArgsKey], labels[cniArgsKey], endpointArgs} {
+		args, err := parseCNIArgs(value)
+		if err != nil {
+			return nil, err
+		}
+		layers = append(layers, args)
+	}
+	return mergeCNIArgs(layers...), nil
+}
+
+// validateCNIArgKey checks an optional CNI_ARGS key
+func validateCNIArgKey(key string) error {
+	if strings.ContainsAny(key, "=;") {
+		return fmt.Errorf("invalid CNI argument key %q", key)
+	}
+	return nil
+}
+
+// parsePluginArgs parses "plugin=KEY=VALUE" strings into per-plugin lists
+// of CNI arguments
+func parsePluginArgs(specs []string) (map[string][][2]string, error) {
+	pluginArgs := make(map[string][][2]string)
+	for _, spec := range specs {
+		parts := strings.SplitN(spec, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid plugin argument %q, expected plugin=KEY=VALUE", spec)
+		}
+		kv, err := parseCNIArg(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		pluginArgs[parts[0]] = append(pluginArgs[parts[0]], kv)
+	}
+	return pluginArgs, nil
+}
+
+// mergeCNIArgs flattens layers of arguments, with keys in later layers
+// overriding the same keys in earlier ones
+func mergeCNIArgs(layers ...[][2]string) [][2]string {
+	merged := [][2]string{}
+	index := make(map[string]int)
+	for _, layer := range layers {
+		for _, kv := range layer {
+			if i, ok := index[kv[0]]; ok {
+				merged[i] = kv
+				continue
+			}
+			index[kv[0]] = len(merged)
+			merged = append(merged, kv)
+		}
+	}
+	return merged
+}
+
+func formatCNIArgs(args [][2]string) string {
+	pairs := make([]string, 0, len(args))
+	for _, kv := range args {
+		pairs = append(pairs, strings.Join(kv[:], "="))
+	}
+	return strings.Join(pairs, ";")
+}
+
+// parseConfigArgs parses a JSON object of structured plugin config args
+func parseConfigArgs(value string) (map[string]interface{}, error) {
+	var args map[string]interface{}
+	if err := json.Unmarshal([]byte(value), &args); err != nil || args == nil {
+		return nil, fmt.Errorf("%s must be a JSON object: %q", configArgsKey, value)
+	}
+	return args, nil
+}
+
+// configArgs merges the structured args from the network's options and
+// the container's labels, with the container's taking precedence
+func configArgs(nw *network, labels map[string]string) (map[string]interface{}, error) {
+	merged := make(map[string]interface{})
+	for _, value := range []string{nw.Options[configArgsKey], labels[configArgsKey]} {
+		if value == "" {
+			continue
+		}
+		args, err := parseConfigArgs(value)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range args {
+			merged[k] = v
+		}
+	}
+	return merged, nil
+}
+
+// joinConfigArgs returns the structured config args for a Join to the
+// network by a container with the given labels
+func (driver *driver) joinConfigArgs(nw *network, labels map[string]string) (map[string]interface{}, error) {
+	args, err := configArgs(nw, labels)
+	if err != nil {
+		return nil, err
+	}
+	if driver.networkArgs {
+		if err := driver.addNetworkArgs(args, nw.ID); err != nil {
+			return nil, err
+		}
+	}
+	return args, nil
+}
+
+// Key of the "args" object under which plugins are passed the Docker
+// network's ID and name, if -network-args is set
+const dockerNetworkArgsKey = "com.docker.network"
+
+// addNetworkArgs adds the Docker network's ID, and name if we know it, to
+// structured config args, which may not set them themselves
+func (driver *driver) addNetworkArgs(args map[string]interface{}, networkID string) error {
+	if _, ok := args[dockerNetworkArgsKey]; ok {
+		return fmt.Errorf("%s may not set %s, which is reserved for the Docker network", configArgsKey, dockerNetworkArgsKey)
+	}
+	nwArgs := map[string]interface{}{"id": networkID}
+	if nw := driver.watcher.GetNetworkById(networkID); nw != nil {
+		nwArgs["name"] = nw.Name
+	}
+	args[dockerNetworkArgsKey] = nwArgs
+	return nil
+}
+
+// Docker labels dockershim puts on pod containers, and the CNI_ARGS that
+// kubelet passes plugins for them
+var k8sLabelArgs = [][2]string{
+	{"io.kubernetes.pod.namespace", "K8S_POD_NAMESPACE"},
+	{"io.kubernetes.pod.name", "K8S_POD_NAME"},
+	{"io.kubernetes.pod.uid", "K8S_POD_UID"},
+}
+
+// the pod's sandbox (infra) container, set on all but the sandbox itself
+const k8sSandboxLabel = "io.kubernetes.sandbox.id"
+
+// k8sArgs returns the Kubernetes CNI_ARGS for a pod container, or nil if
+// the container isn't part of a pod
+func k8sArgs(containerID string, labels map[string]string) [][2]string {
+	if labels["io.kubernetes.pod.name"] == "" {
+		return nil
+	}
+	// Plugins that don't know these keys would otherwise reject them
+	args := [][2]string{{"IgnoreUnknown", "1"}}
+	for _, la := range k8sLabelArgs {
+		if value := labels[la[0]]; value != "" {
+			args = append(args, [2]string{la[1], value})
+		}
+	}
+	infraID := labels[k8sSandboxLabel]
+	if infraID == "" {
+		infraID = containerID
+	}
+	return append(args, [2]string{"K8S_POD_INFRA_CONTAINER_ID", infraID})
+}
+
+// containerName returns the container's name without the leading slash
+// Docker gives it
+func containerName(container *docker.Container) string {
+	return strings.TrimPrefix(container.Name, "/")
+}
+
+// describeContainer returns the container's ID for logs, with its current
+// name and such labels as may be logged, if we still know it
+func (driver *driver) describeContainer(id string) string {
+	if container := driver.watcher.GetContainer(id); container != nil {
+		if meta := describeContainerLabels(container); meta != "" {
+			return id + " " + meta
+		}
+	}
+	return id
+}
@@ -0,0 +1,172 @@
+package driver
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseCNIArgs(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    [][2]string
+		wantErr bool
+	}{
+		{value: "", want: nil},
+		{value: "A=1", want: [][2]string{{"A", "1"}}},
+		{value: "A=1;B=2", want: [][2]string{{"A", "1"}, {"B", "2"}}},
+		{value: ";A=1;;B=;", want: [][2]string{{"A", "1"}, {"B", ""}}},
+		{value: "A=x=y", want: [][2]string{{"A", "x=y"}}},
+		{value: "A", wantErr: true},
+		{value: "=1", wantErr: true},
+		{value: "A=1;B", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseCNIArgs(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseCNIArgs(%q) error = %v, want error %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseCNIArgs(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestMergeCNIArgs(t *testing.T) {
+	tests := []struct {
+		name   string
+		layers [][][2]string
+		want   [][2]string
+	}{
+		{
+			name: "none",
+			want: [][2]string{},
+		},
+		{
+			name:   "disjoint layers keep their order",
+			layers: [][][2]string{{{"A", "1"}, {"B", "2"}}, {{"C", "3"}}},
+			want:   [][2]string{{"A", "1"}, {"B", "2"}, {"C", "3"}},
+		},
+		{
+			name:   "later layers override in place",
+			layers: [][][2]string{{{"A", "1"}, {"B", "2"}}, {{"A", "3"}}},
+			want:   [][2]string{{"A", "3"}, {"B", "2"}},
+		},
+		{
+			name:   "last of three wins",
+			layers: [][][2]string{{{"A", "1"}}, {{"A", "2"}}, {{"A", "3"}, {"B", "4"}}},
+			want:   [][2]string{{"A", "3"}, {"B", "4"}},
+		},
+	}
+
+	for _, tt := range tests {
+		if got := mergeCNIArgs(tt.layers...); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: mergeCNIArgs() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestJoinCNIArgs(t *testing.T) {
+	tests := []struct {
+		name         string
+		networkArgs  string
+		labelArgs    string
+		endpointArgs string
+		want         [][2]string
+		wantErr      bool
+	}{
+		{
+			name: "none",
+			want: [][2]string{},
+		},
+		{
+			name:        "network only",
+			networkArgs: "A=1",
+			want:        [][2]string{{"A", "1"}},
+		},
+		{
+			name:         "label overrides network, endpoint overrides label",
+			networkArgs:  "A=1;B=1;C=1",
+			labelArgs:    "B=2;C=2",
+			endpointArgs: "C=3",
+			want:         [][2]string{{"A", "1"}, {"B", "2"}, {"C", "3"}},
+		},
+		{
+			name:      "invalid label",
+			labelArgs: "B",
+			wantErr:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		nw := &network{Options: map[string]string{}}
+		if tt.networkArgs != "" {
+			nw.Options[cniArgsKey] = tt.networkArgs
+		}
+		labels := map[string]string{}
+		if tt.labelArgs != "" {
+			labels[cniArgsKey] = tt.labelArgs
+		}
+		options := map[string]interface{}{}
+		if tt.endpointArgs != "" {
+			options[cniArgsKey] = tt.endpointArgs
+		}
+
+		got, err := joinCNIArgs(nw, labels, options)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: joinCNIArgs() error = %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: joinCNIArgs() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestK8sArgs(t *testing.T) {
+	tests := []struct {
+		name   string
+		labels map[string]string
+		want   [][2]string
+	}{
+		{
+			name:   "not a pod",
+			labels: map[string]string{"io.kubernetes.pod.namespace": "ns"},
+			want:   nil,
+		},
+		{
+			name: "sandbox",
+			labels: map[string]string{
+				"io.kubernetes.pod.namespace": "ns",
+				"io.kubernetes.pod.name":      "pod",
+				"io.kubernetes.pod.uid":       "uid",
+			},
+			want: [][2]string{
+				{"IgnoreUnknown", "1"},
+				{"K8S_POD_NAMESPACE", "ns"},
+				{"K8S_POD_NAME", "pod"},
+				{"K8S_POD_UID", "uid"},
+				{"K8S_POD_INFRA_CONTAINER_ID", "ctr"},
+			},
+		},
+		{
+			name: "pod container",
+			labels: map[string]string{
+				"io.kubernetes.pod.name":   "pod",
+				"io.kubernetes.sandbox.id": "infra",
+			},
+			want: [][2]string{
+				{"IgnoreUnknown", "1"},
+				{"K8S_POD_NAME", "pod"},
+				{"K8S_POD_INFRA_CONTAINER_ID", "infra"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		if got := k8sArgs("ctr", tt.labels); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: k8sArgs() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
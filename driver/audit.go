@@ -0,0 +1,75 @@
+package driver
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// auditLog records every plugin execution, one JSON object per line, to
+// its own append-only file.  Configs may hold secrets, so only their hash
+// is recorded.
+type auditLog struct {
+	sync.Mutex
+	file *os.File
+	enc  *json.Encoder
+}
+
+type auditRecord struct {
+	Time        time.Time
+	Command     string
+	Plugin      string
+	ContainerID string
+	Netns       string
+	ConfigHash  string
+	Result      string
+	Error       string `json:",omitempty"`
+}
+
+func openAuditLog(path string) (*auditLog, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLog{
+		file: file,
+		enc:  json.NewEncoder(file),
+	}, nil
+}
+
+func configHash(config []byte) string {
+	sum := sha256.Sum256(config)
+	return hex.EncodeToString(sum[:])
+}
+
+// record writes the audit record for one plugin execution; it is a no-op
+// when auditing is disabled
+func (a *auditLog) record(plugin string, cmd string, rt *cniRuntime, config []byte, err error) {
+	if a == nil {
+		return
+	}
+
+	rec := &auditRecord{
+		Time:        time.Now().UTC(),
+		Command:     cmd,
+		Plugin:      plugin,
+		ContainerID: rt.ContainerID,
+		Netns:       rt.Netns,
+		ConfigHash:  configHash(config),
+		Result:      "success",
+	}
+	if err != nil {
+		rec.Result = "error"
+		rec.Error = err.Error()
+	}
+
+	a.Lock()
+	defer a.Unlock()
+	if err := a.enc.Encode(rec); err != nil {
+		log.Printf("Failed to write audit record: %v", err)
+	}
+}
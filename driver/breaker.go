@@ -0,0 +1,110 @@
+package driver
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// breaker stops us from running ADD for a plugin that keeps failing.  After
+// threshold consecutive failures within window the circuit opens and ADDs
+// fail immediately; once cooldown has passed a single ADD is let through as
+// a probe, which closes the circuit if it succeeds and reopens it otherwise.
+type breaker struct {
+	sync.Mutex
+	threshold int
+	window    time.Duration
+	cooldown  time.Duration
+	plugins   map[string]*circuit
+}
+
+type circuit struct {
+	failures     int
+	firstFailure time.Time
+	// zero while the circuit is closed
+	openedAt time.Time
+	probing  bool
+}
+
+func newBreaker(threshold int, window time.Duration, cooldown time.Duration) *breaker {
+	return &breaker{
+		threshold: threshold,
+		window:    window,
+		cooldown:  cooldown,
+		plugins:   make(map[string]*circuit),
+	}
+}
+
+func (b *breaker) allow(plugin string) error {
+	if b.threshold <= 0 {
+		return nil
+	}
+
+	b.Lock()
+	defer b.Unlock()
+	c, ok := b.plugins[plugin]
+	if !ok || c.openedAt.IsZero() {
+		return nil
+	}
+	if c.probing || time.Since(c.openedAt) < b.cooldown {
+		return fmt.Errorf("plugin %s is failing, circuit open", plugin)
+	}
+	log.Printf("Probing plugin %s with open circuit", plugin)
+	c.probing = true
+	return nil
+}
+
+func (b *breaker) record(plugin string, err error) {
+	if b.threshold <= 0 {
+		return
+	}
+
+	b.Lock()
+	defer b.Unlock()
+	c, ok := b.plugins[plugin]
+	if !ok {
+		c = &circuit{}
+		b.plugins[plugin] = c
+	}
+
+	now := time.Now()
+	switch {
+	case err == nil:
+		if !c.openedAt.IsZero() {
+			log.Printf("Plugin %s recovered, closing circuit", plugin)
+		}
+		delete(b.plugins, plugin)
+	case c.probing:
+		log.Printf("Plugin %s probe failed, reopening circuit", plugin)
+		c.openedAt = now
+		c.probing = false
+	case c.failures == 0 || now.Sub(c.firstFailure) > b.window:
+		c.failures = 1
+		c.firstFailure = now
+	default:
+		c.failures++
+		if c.failures >= b.threshold && c.openedAt.IsZero() {
+			log.Printf("Plugin %s failed %d times, opening circuit", plugin, c.failures)
+			c.openedAt = now
+		}
+	}
+}
+
+// status describes each plugin that has recently failed
+func (b *breaker) status() []string {
+	b.Lock()
+	defer b.Unlock()
+
+	var lines []string
+	for plugin, c := range b.plugins {
+		state := "closed"
+		if !c.openedAt.IsZero() {
+			state = "open"
+		}
+		lines = append(lines, fmt.Sprintf("plugin %s: circuit %s, %d consecutive failures", plugin, state, c.failures))
+	}
+	sort.Strings(lines)
+	return lines
+}
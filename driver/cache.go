@@ -0,0 +1,354 @@
+package driver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// resultCache keeps each attachment's ADD result in libcni's cache format,
+// under <dir>/results/<network>-<container>-<ifname>, so that cnitool and
+// other libcni-based tools see our attachments, and so that we know them
+// again after a restart.  What we need beyond libcni's fields to DEL an
+// endpoint as it was ADDed is kept alongside them, which libcni ignores.
+// Our IPAM driver's pools are kept under <dir>/ipam, and addresses
+// preallocated for endpoints under <dir>/prealloc, out of libcni's way.
+type resultCache struct {
+	dir string
+}
+
+// libcni's cache entry kind
+const cacheKind = "cniCacheV1"
+
+type cacheEntry struct {
+	Kind           string                 `json:"kind"`
+	ContainerID    string                 `json:"containerId"`
+	Config         []byte                 `json:"config"`
+	IfName         string                 `json:"ifName"`
+	NetworkName    string                 `json:"networkName"`
+	NetNS          string                 `json:"netns,omitempty"`
+	CniArgs        [][2]string            `json:"cniArgs,omitempty"`
+	CapabilityArgs map[string]interface{} `json:"capabilityArgs,omitempty"`
+	RawResult      json.RawMessage        `json:"result,omitempty"`
+
+	Endpoint *cachedEndpoint `json:"cniDockerPlugin,omitempty"`
+}
+
+// cachedEndpoint is what we keep of an endpoint besides libcni's fields
+type cachedEndpoint struct {
+	ID         string
+	NetworkID  string
+	ConfPath   string
+	CNIVersion string
+	Plugins    []map[string]interface{}
+	Binaries   []string
+	PluginPath string
+	ConfigArgs map[string]interface{}
+	Configs    [][]byte
+	MTU        int
+}
+
+// newResultCache returns the cache in dir, or nil if dir is empty
+func newResultCache(dir string) *resultCache {
+	if dir == "" {
+		return nil
+	}
+	return &resultCache{dir: dir}
+}
+
+func (c *resultCache) path(netName string, containerID string, ifName string) string {
+	return filepath.Join(c.dir, "results", fmt.Sprintf("%s-%s-%s", netName, containerID, ifName))
+}
+
+// write records the endpoint's attachment, replacing any earlier record;
+// it is a no-op when there's no cache
+func (c *resultCache) write(ep *endpoint) error {
+	if c == nil {
+		return nil
+	}
+	config, err := json.Marshal(&confList{
+		Name:       ep.Conf.Name,
+		CNIVersion: ep.Conf.CNIVersion,
+		Plugins:    ep.Conf.Plugins,
+	})
+	if err != nil {
+		return err
+	}
+	rt := ep.Runtime
+	if len(ep.PortMappings) > 0 {
+		rt = rt.withCapabilityArg(portMappingsCapability, ep.PortMappings)
+	}
+	entry := &cacheEntry{
+		Kind:           cacheKind,
+		ContainerID:    rt.ContainerID,
+		Config:         config,
+		IfName:         rt.IfName,
+		NetworkName:    ep.Conf.Name,
+		NetNS:          rt.Netns,
+		CniArgs:        rt.Args,
+		CapabilityArgs: rt.CapabilityArgs,
+		Endpoint: &cachedEndpoint{
+			ID:         ep.ID,
+			NetworkID:  ep.NetworkID,
+			ConfPath:   ep.Conf.Path,
+			CNIVersion: ep.Conf.CNIVersion,
+			Plugins:    ep.Conf.Plugins,
+			Binaries:   ep.Conf.Binaries,
+			PluginPath: rt.PluginPath,
+			ConfigArgs: rt.ConfigArgs,
+			Configs:    ep.Configs,
+			MTU:        ep.MTU,
+		},
+	}
+	if json.Valid(ep.Result) {
+		entry.RawResult = ep.Result
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	return writeFile(c.path(ep.Conf.Name, rt.ContainerID, rt.IfName), data)
+}
+
+// remove forgets the endpoint's attachment; it is a no-op when there's no
+// cache
+func (c *resultCache) remove(ep *endpoint) error {
+	if c == nil {
+		return nil
+	}
+	err := os.Remove(c.path(ep.Conf.Name, ep.Runtime.ContainerID, ep.Runtime.IfName))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// load returns the endpoints recorded in the cache.  Entries written by
+// other libcni users, which lack our fields, are left alone.
+func (c *resultCache) load() ([]*endpoint, error) {
+	if c == nil {
+		return nil, nil
+	}
+	files, err := ioutil.ReadDir(filepath.Join(c.dir, "results"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var eps []*endpoint
+	for _, f := range files {
+		if f.IsDir() || strings.HasSuffix(f.Name(), ".tmp") {
+			continue
+		}
+		path := filepath.Join(c.dir, "results", f.Name())
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			log.Printf("Failed to read cached result %s: %v", path, err)
+			continue
+		}
+		var entry cacheEntry
+		if err := json.Unmarshal(data, &entry); err != nil || entry.Kind != cacheKind {
+			log.Printf("Ignoring invalid cached result %s: %v", path, err)
+			continue
+		}
+		if entry.Endpoint == nil {
+			continue
+		}
+		cached := entry.Endpoint
+		eps = append(eps, &endpoint{
+			ID:        cached.ID,
+			NetworkID: cached.NetworkID,
+			Conf: &netConf{
+				Path:       cached.ConfPath,
+				Name:       entry.NetworkName,
+				CNIVersion: cached.CNIVersion,
+				Plugins:    cached.Plugins,
+				Binaries:   cached.Binaries,
+				PluginPath: cached.PluginPath,
+			},
+			Runtime: &cniRuntime{
+				ContainerID:    entry.ContainerID,
+				EndpointID:     cached.ID,
+				Netns:          entry.NetNS,
+				IfName:         entry.IfName,
+				PluginPath:     cached.PluginPath,
+				Args:           entry.CniArgs,
+				CapabilityArgs: entry.CapabilityArgs,
+				ConfigArgs:     cached.ConfigArgs,
+			},
+			Result:  entry.RawResult,
+			Configs: cached.Configs,
+			MTU:     cached.MTU,
+		})
+	}
+	return eps, nil
+}
+
+func (c *resultCache) poolPath(id string) string {
+	return filepath.Join(c.dir, "ipam", poolName(id))
+}
+
+// writeFile replaces path with data, creating its directory
+func writeFile(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	// Written aside and renamed, so a crash can't leave half an entry
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// writePool records an IPAM pool and its allocations, replacing any
+// earlier record; it is a no-op when there's no cache
+func (c *resultCache) writePool(pl *pool) error {
+	if c == nil {
+		return nil
+	}
+	data, err := json.Marshal(pl)
+	if err != nil {
+		return err
+	}
+	return writeFile(c.poolPath(pl.ID), data)
+}
+
+// removePool forgets an IPAM pool; it is a no-op when there's no cache
+func (c *resultCache) removePool(id string) error {
+	if c == nil {
+		return nil
+	}
+	err := os.Remove(c.poolPath(id))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// loadPools returns the IPAM pools recorded in the cache
+func (c *resultCache) loadPools() ([]*pool, error) {
+	if c == nil {
+		return nil, nil
+	}
+	dir := filepath.Join(c.dir, "ipam")
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var pls []*pool
+	for _, f := range files {
+		if f.IsDir() || strings.HasSuffix(f.Name(), ".tmp") {
+			continue
+		}
+		path := filepath.Join(dir, f.Name())
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			log.Printf("Failed to read cached pool %s: %v", path, err)
+			continue
+		}
+		var pl pool
+		if err := json.Unmarshal(data, &pl); err != nil || pl.ID == "" || pl.Subnet == nil {
+			log.Printf("Ignoring invalid cached pool %s: %v", path, err)
+			continue
+		}
+		if pl.Allocations == nil {
+			pl.Allocations = make(map[string]string)
+		}
+		pls = append(pls, &pl)
+	}
+	return pls, nil
+}
+
+func (c *resultCache) preallocPath(endpointID string) string {
+	return filepath.Join(c.dir, "prealloc", endpointID)
+}
+
+// writePrealloc records the endpoint's preallocated address; it is a no-op
+// when there's no cache
+func (c *resultCache) writePrealloc(endpointID string, p *preallocation) error {
+	if c == nil {
+		return nil
+	}
+	data, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return writeFile(c.preallocPath(endpointID), data)
+}
+
+// removePrealloc forgets the endpoint's preallocated address; it is a
+// no-op when there's no cache
+func (c *resultCache) removePrealloc(endpointID string) error {
+	if c == nil {
+		return nil
+	}
+	err := os.Remove(c.preallocPath(endpointID))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// loadPreallocs returns the preallocated addresses recorded in the cache,
+// by endpoint ID
+func (c *resultCache) loadPreallocs() (map[string]*preallocation, error) {
+	if c == nil {
+		return nil, nil
+	}
+	dir := filepath.Join(c.dir, "prealloc")
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	preallocs := make(map[string]*preallocation)
+	for _, f := range files {
+		if f.IsDir() || strings.HasSuffix(f.Name(), ".tmp") {
+			continue
+		}
+		path := filepath.Join(dir, f.Name())
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			log.Printf("Failed to read cached preallocation %s: %v", path, err)
+			continue
+		}
+		var p preallocation
+		if err := json.Unmarshal(data, &p); err != nil || p.Runtime == nil || p.Result == nil {
+			log.Printf("Ignoring invalid cached preallocation %s: %v", path, err)
+			continue
+		}
+		preallocs[f.Name()] = &p
+	}
+	return preallocs, nil
+}
+
+// restore adds an endpoint loaded from the cache, reserving its interface
+// index so that the container's other Joins don't reuse it
+func (e *endpoints) restore(ep *endpoint, ifPrefix string) {
+	e.Lock()
+	defer e.Unlock()
+	e.byID[ep.ID] = ep
+	index, err := strconv.Atoi(strings.TrimPrefix(ep.Runtime.IfName, ifPrefix))
+	if err != nil || !strings.HasPrefix(ep.Runtime.IfName, ifPrefix) {
+		return
+	}
+	indexes, ok := e.ifIndexes[ep.Runtime.ContainerID]
+	if !ok {
+		indexes = make(map[string]int)
+		e.ifIndexes[ep.Runtime.ContainerID] = indexes
+	}
+	indexes[ep.ID] = index
+}
@@ -0,0 +1,73 @@
+package driver
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// -o cni.capability.<name>=<JSON> passes the value as the named capability
+// argument, in runtimeConfig, to plugins on the network declaring it
+const capabilityOptionPrefix = "cni.capability."
+
+// the JSON type of each well-known capability argument; others may be any
+var capabilityTypes = map[string]string{
+	"portMappings":   "array",
+	"ipRanges":       "array",
+	"ips":            "array",
+	"aliases":        "array",
+	"bandwidth":      "object",
+	"dns":            "object",
+	"mac":            "string",
+	"infinibandGUID": "string",
+	"deviceID":       "string",
+}
+
+func jsonType(v interface{}) string {
+	switch v.(type) {
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	case string:
+		return "string"
+	case float64:
+		return "number"
+	case bool:
+		return "boolean"
+	}
+	return "null"
+}
+
+// networkCapabilityArgs parses the capability arguments in a network's
+// options
+func networkCapabilityArgs(options map[string]string) (map[string]interface{}, error) {
+	args := make(map[string]interface{})
+	for k, v := range options {
+		if !strings.HasPrefix(k, capabilityOptionPrefix) {
+			continue
+		}
+		capability := strings.TrimPrefix(k, capabilityOptionPrefix)
+		var arg interface{}
+		if err := json.Unmarshal([]byte(v), &arg); err != nil {
+			return nil, fmt.Errorf("network option %s is not valid JSON: %v", k, err)
+		}
+		if want, ok := capabilityTypes[capability]; ok && jsonType(arg) != want {
+			return nil, fmt.Errorf("network option %s must be a JSON %s", k, want)
+		}
+		args[capability] = arg
+	}
+	return args, nil
+}
+
+// withCapabilityArg returns a copy of the runtime with the capability
+// argument added, replacing any it already had
+func (rt *cniRuntime) withCapabilityArg(capability string, arg interface{}) *cniRuntime {
+	cp := *rt
+	cp.CapabilityArgs = make(map[string]interface{})
+	for k, v := range rt.CapabilityArgs {
+		cp.CapabilityArgs[k] = v
+	}
+	cp.CapabilityArgs[capability] = arg
+	return &cp
+}
@@ -0,0 +1,48 @@
+package driver
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+)
+
+// pluginCgroup is a cgroup v2 that plugins are started in, so that limits
+// set on it bound what they can use.  Each plugin is cloned straight into
+// it, so neither it nor anything it forks ever runs outside.  We don't
+// create or configure the cgroup: it must already exist, and we must be
+// allowed to move processes into it, ie be able to write its cgroup.procs
+// and that of the cgroup we run in.
+type pluginCgroup struct {
+	dir *os.File
+}
+
+// openPluginCgroup opens the cgroup directory at path, eg
+// /sys/fs/cgroup/cni-plugins; it returns nil if path is empty
+func openPluginCgroup(path string) (*pluginCgroup, error) {
+	if path == "" {
+		return nil, nil
+	}
+	if _, err := os.Stat(filepath.Join(path, "cgroup.procs")); err != nil {
+		return nil, fmt.Errorf("plugin cgroup %s is not a cgroup v2: %v", path, err)
+	}
+	dir, err := os.OpenFile(path, os.O_RDONLY|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open plugin cgroup: %v", err)
+	}
+	return &pluginCgroup{dir: dir}, nil
+}
+
+// apply makes c start in the cgroup; it is a no-op when no cgroup is
+// configured
+func (cg *pluginCgroup) apply(c *exec.Cmd) {
+	if cg == nil {
+		return
+	}
+	if c.SysProcAttr == nil {
+		c.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	c.SysProcAttr.UseCgroupFD = true
+	c.SysProcAttr.CgroupFD = int(cg.dir.Fd())
+}
@@ -0,0 +1,115 @@
+package driver
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"time"
+)
+
+// CHECK first appeared in this version of the spec
+const checkMinVersion = "0.4.0"
+
+// What EndpointOperInfo reports of an endpoint's last CHECK
+const (
+	infoCheckKey     = "cni.check"
+	infoCheckTimeKey = "cni.check.time"
+)
+
+// checkResult is the outcome of an endpoint's last CHECK
+type checkResult struct {
+	Time time.Time
+	// empty if the CHECK passed
+	Err string
+}
+
+// CheckSummary lists what a CHECK of all endpoints found
+type CheckSummary struct {
+	Passed []string
+	// endpoints whose config is older than CHECK
+	Skipped []string
+	Failed  map[string]string
+}
+
+// checkEndpoint runs CHECK for the endpoint's chain with the context of
+// its ADD, so plugins can tell whether what they set up is still there
+func (driver *driver) checkEndpoint(ep *endpoint) error {
+	rt := *ep.Runtime
+	if len(ep.PortMappings) > 0 {
+		rt = *rt.withCapabilityArg(portMappingsCapability, ep.PortMappings)
+	}
+	nc := ep.Conf
+	for i := range nc.Plugins {
+		var config []byte
+		var err error
+		if i < len(ep.Configs) && ep.Configs[i] != nil {
+			config, err = nc.replayConfig(i, ep.Configs[i], ep.Result, &rt)
+		} else {
+			config, err = nc.pluginConfig(i, ep.Result, &rt)
+		}
+		if err != nil {
+			return err
+		}
+		plugin := nc.pluginBinary(i)
+		if _, err := driver.execPlugin(plugin, "CHECK", &rt, config); err != nil {
+			return fmt.Errorf("plugin %s failed the CHECK operation: %v", plugin, err)
+		}
+	}
+	return nil
+}
+
+// checkEndpoints runs CHECK for every joined endpoint, recording each
+// outcome for EndpointOperInfo and logging failures, which mean the
+// attachment has drifted from what its ADD set up
+func (driver *driver) checkEndpoints() *CheckSummary {
+	summary := &CheckSummary{Failed: make(map[string]string)}
+	for _, listed := range driver.endpoints.list() {
+		driver.checkListedEndpoint(listed.ID, summary)
+	}
+	log.Printf("CHECK: %d passed, %d skipped, %d failed", len(summary.Passed), len(summary.Skipped), len(summary.Failed))
+	return summary
+}
+
+func (driver *driver) checkListedEndpoint(id string, summary *CheckSummary) {
+	defer driver.endpoints.lock(id)()
+
+	// It may have been left since it was listed
+	ep := driver.endpoints.get(id)
+	if ep == nil {
+		return
+	}
+	if !versionAtLeast(ep.Conf.CNIVersion, checkMinVersion) {
+		summary.Skipped = append(summary.Skipped, id)
+		return
+	}
+	result := &checkResult{Time: time.Now()}
+	if err := driver.checkEndpoint(ep); err != nil {
+		log.Printf("CHECK of endpoint %s (container %s) failed: %v", id, ep.Runtime.ContainerID, err)
+		result.Err = err.Error()
+		summary.Failed[id] = result.Err
+	} else {
+		summary.Passed = append(summary.Passed, id)
+	}
+	driver.endpoints.setCheck(id, result)
+}
+
+// monitorChecks checks all endpoints roughly every interval
+func (driver *driver) monitorChecks(interval time.Duration) {
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	for {
+		time.Sleep(jitter(rng, interval))
+		driver.checkEndpoints()
+	}
+}
+
+// info describes the last CHECK for EndpointOperInfo
+func (r *checkResult) info() map[string]interface{} {
+	status := "ok"
+	if r.Err != "" {
+		status = r.Err
+	}
+	return map[string]interface{}{
+		infoCheckKey:     status,
+		infoCheckTimeKey: r.Time.Format(time.RFC3339),
+	}
+}
@@ -0,0 +1,131 @@
+package driver
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// pluginChecksums holds the sha256 each plugin binary must have to be run,
+// from the -plugin-checksums manifest.  Plugins missing from the manifest
+// aren't run either.
+//
+// Hashing every binary on every exec would add its read to each ADD and
+// DEL, so a binary that matched isn't rehashed until its fileStamp
+// changes.  Unlike the mtime alone, which anyone who can write the binary
+// can put back with touch -r, the stamp includes the ctime, which the
+// kernel sets on every write or utimes and which can't be set from
+// userspace, so replacing or rewriting the binary in place is caught.
+// Someone able to set the clock or write the block device underneath the
+// filesystem can still get past it; that is the trade-off for not reading
+// every plugin on every exec.
+type pluginChecksums struct {
+	sync.Mutex
+	// wanted checksum by plugin binary name
+	want map[string]string
+	// stamp of each binary when it last matched, by path
+	verified map[string]fileStamp
+}
+
+// fileStamp identifies a file's contents without reading them
+type fileStamp struct {
+	dev, ino     uint64
+	size         int64
+	mtime, ctime syscall.Timespec
+}
+
+func statFileStamp(path string) (fileStamp, error) {
+	var st syscall.Stat_t
+	if err := syscall.Stat(path, &st); err != nil {
+		return fileStamp{}, &os.PathError{Op: "stat", Path: path, Err: err}
+	}
+	return fileStamp{
+		dev:   uint64(st.Dev),
+		ino:   uint64(st.Ino),
+		size:  st.Size,
+		mtime: st.Mtim,
+		ctime: st.Ctim,
+	}, nil
+}
+
+// loadPluginChecksums reads a JSON object mapping plugin names to the hex
+// sha256 of their binaries; it returns nil if path is empty
+func loadPluginChecksums(path string) (*pluginChecksums, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	want := make(map[string]string)
+	if err := json.Unmarshal(data, &want); err != nil {
+		return nil, fmt.Errorf("failed to parse plugin checksums %s: %v", path, err)
+	}
+	for plugin, sum := range want {
+		if b, err := hex.DecodeString(sum); err != nil || len(b) != sha256.Size {
+			return nil, fmt.Errorf("plugin %s checksum %q is not a hex sha256", plugin, sum)
+		}
+		want[plugin] = strings.ToLower(sum)
+	}
+	return &pluginChecksums{
+		want:     want,
+		verified: make(map[string]fileStamp),
+	}, nil
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// verify checks the plugin's binary at fullname against the manifest,
+// unless its fileStamp hasn't changed since it last matched; it is a no-op
+// when no manifest is configured
+func (c *pluginChecksums) verify(plugin string, fullname string) error {
+	if c == nil {
+		return nil
+	}
+	want, ok := c.want[plugin]
+	if !ok {
+		return fmt.Errorf("plugin %s is not in the checksum manifest", plugin)
+	}
+	stamp, err := statFileStamp(fullname)
+	if err != nil {
+		return err
+	}
+
+	c.Lock()
+	last, ok := c.verified[fullname]
+	c.Unlock()
+	if ok && last == stamp {
+		return nil
+	}
+
+	sum, err := fileSHA256(fullname)
+	if err != nil {
+		return fmt.Errorf("failed to checksum plugin %s: %v", plugin, err)
+	}
+	if sum != want {
+		return fmt.Errorf("plugin %s binary %s has sha256 %s, expected %s", plugin, fullname, sum, want)
+	}
+	c.Lock()
+	c.verified[fullname] = stamp
+	c.Unlock()
+	return nil
+}
@@ -0,0 +1,415 @@
+package driver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// first delay before retrying a plugin; it doubles with each retry
+const pluginRetryBackoff = 100 * time.Millisecond
+
+// cniRuntime is the per-attachment context passed to every plugin
+// invocation for an endpoint
+type cniRuntime struct {
+	ContainerID string
+	Netns       string
+	IfName      string
+	// the endpoint it is for, if any, which plugin logs are tagged with
+	EndpointID string
+	// plugin search path, if not the driver's
+	PluginPath string
+	// per-invocation CNI_ARGS, which override any static arguments
+	// configured for the plugin
+	Args [][2]string
+	// capability arguments, passed as runtimeConfig to plugins that
+	// declare the capability
+	CapabilityArgs map[string]interface{}
+	// merged into the "args" object of each plugin's config
+	ConfigArgs map[string]interface{}
+}
+
+func envVars(vars [][2]string) []string {
+	env := os.Environ()
+
+	for _, kv := range vars {
+		env = append(env, strings.Join(kv[:], "="))
+	}
+
+	return env
+}
+
+// pluginPath returns the plugin search path for an invocation
+func (driver *driver) pluginPath(rt *cniRuntime) string {
+	if rt != nil && rt.PluginPath != "" {
+		return rt.PluginPath
+	}
+	return driver.plugpath
+}
+
+// parsePluginWrapper splits the plugin wrapper command into its path and
+// arguments
+func parsePluginWrapper(spec string) ([]string, error) {
+	wrapper := strings.Fields(spec)
+	if len(wrapper) == 0 {
+		return nil, nil
+	}
+	path, err := exec.LookPath(wrapper[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid plugin wrapper: %v", err)
+	}
+	wrapper[0] = path
+	return wrapper, nil
+}
+
+// findPlugin returns the full path of the named plugin binary, searching
+// each directory of the plugin path in order
+func findPlugin(plugin string, path string) (string, error) {
+	if plugin == "" || strings.ContainsRune(plugin, os.PathSeparator) {
+		return "", fmt.Errorf("invalid plugin name %q", plugin)
+	}
+	for _, dir := range filepath.SplitList(path) {
+		fullname := filepath.Join(dir, plugin)
+		if fi, err := os.Stat(fullname); err == nil && fi.Mode().IsRegular() {
+			return fullname, nil
+		}
+	}
+	return "", fmt.Errorf("Failed to find plugin %s in %s", plugin, path)
+}
+
+func validatePluginPath(path string) error {
+	for _, dir := range filepath.SplitList(path) {
+		fi, err := os.Stat(dir)
+		if err != nil {
+			return fmt.Errorf("invalid plugin path %s: %v", path, err)
+		}
+		if !fi.IsDir() {
+			return fmt.Errorf("invalid plugin path %s: %s is not a directory", path, dir)
+		}
+	}
+	return nil
+}
+
+// resolvePlugins picks the plugin search path and the binary for each
+// plugin in the chain, honoring the network's cni.path and
+// cni.plugin.<type> options and its network map entry, and checks that
+// they exist
+func (driver *driver) resolvePlugins(nc *netConf, nw *network) error {
+	nc.PluginPath = nw.Options[pluginPathOption]
+	if entry := driver.networkMapEntry(nw.ID); nc.PluginPath == "" && entry != nil {
+		nc.PluginPath = entry.Path
+	}
+	path := driver.plugpath
+	if nc.PluginPath != "" {
+		if err := validatePluginPath(nc.PluginPath); err != nil {
+			return err
+		}
+		log.Printf("Network %s searches for plugins in %s", nc.Name, nc.PluginPath)
+		path = nc.PluginPath
+	}
+
+	nc.Binaries = make([]string, len(nc.Plugins))
+	for i := range nc.Plugins {
+		binary := nc.pluginType(i)
+		if pinned, ok := nw.Options[pluginBinaryOptionPrefix+binary]; ok {
+			log.Printf("Network %s pins plugin %s to %s", nc.Name, binary, pinned)
+			binary = pinned
+		}
+		if _, err := findPlugin(binary, path); err != nil {
+			return err
+		}
+		nc.Binaries[i] = binary
+	}
+	return nil
+}
+
+// cniError is the error a plugin writes to stdout when it fails
+type cniError struct {
+	Code    int    `json:"code"`
+	Msg     string `json:"msg"`
+	Details string `json:"details,omitempty"`
+}
+
+// pluginError is a failed plugin invocation
+type pluginError struct {
+	err error
+	// the plugin's CNI error message, or else its stderr
+	msg string
+	// whether the plugin was killed for running too long
+	timedOut bool
+}
+
+func (e *pluginError) Error() string {
+	if e.msg == "" {
+		return e.err.Error()
+	}
+	return fmt.Sprintf("%v: %s", e.err, e.msg)
+}
+
+func newPluginError(err error, stdout []byte, stderr []byte) *pluginError {
+	var cniErr cniError
+	if json.Unmarshal(stdout, &cniErr) == nil && cniErr.Msg != "" {
+		msg := cniErr.Msg
+		if cniErr.Details != "" {
+			msg += "; " + cniErr.Details
+		}
+		return &pluginError{err: err, msg: msg}
+	}
+	return &pluginError{err: err, msg: strings.TrimSpace(string(stderr))}
+}
+
+// host-local serializes allocations with a lock on its store, so under load
+// an ADD can fail just because it couldn't get the lock; those are worth
+// retrying, unlike the range simply being full
+var (
+	lockContentionErrors = []string{
+		"resource temporarily unavailable",
+		"failed to lock",
+		"lock timeout",
+	}
+	allocationFullErrors = []string{
+		"no IP addresses available",
+		"no more addresses",
+	}
+)
+
+func (e *pluginError) matches(msgs []string) bool {
+	for _, s := range msgs {
+		if strings.Contains(e.msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func isRetryable(err error) bool {
+	perr, ok := err.(*pluginError)
+	if !ok {
+		return false
+	}
+	return !perr.matches(allocationFullErrors) && perr.matches(lockContentionErrors)
+}
+
+// execPlugin runs a plugin, retrying failures caused by IPAM lock contention
+func (driver *driver) execPlugin(plugin string, cmd string, rt *cniRuntime, config []byte) ([]byte, error) {
+	fullname, err := findPlugin(plugin, driver.pluginPath(rt))
+	if err != nil {
+		return nil, err
+	}
+	if err := driver.checksums.verify(plugin, fullname); err != nil {
+		driver.audit.record(plugin, cmd, rt, config, err)
+		driver.recordExecError(plugin, cmd, rt, err)
+		return nil, err
+	}
+
+	// Only ADD is short-circuited; cleanup must always be attempted
+	if cmd == "ADD" {
+		if err := driver.breaker.allow(plugin); err != nil {
+			return nil, &transientError{err: err}
+		}
+	}
+
+	debugf("Plugin %s %s config: %s", plugin, cmd, config)
+
+	var output []byte
+	backoff := pluginRetryBackoff
+	start := time.Now()
+	for attempt := 0; ; attempt++ {
+		output, err = driver.runPlugin(fullname, plugin, cmd, rt, config)
+		if err == nil || attempt >= driver.pluginRetries || !isRetryable(err) {
+			break
+		}
+		log.Printf("Plugin %s %s hit lock contention, retrying in %v: %v", plugin, cmd, backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+
+	driver.latency.observe(cmd, plugin, err, time.Since(start))
+	if cmd == "ADD" {
+		driver.breaker.record(plugin, err)
+	}
+	driver.audit.record(plugin, cmd, rt, config, err)
+	if err != nil {
+		driver.recordExecError(plugin, cmd, rt, err)
+	}
+	return output, err
+}
+
+func (driver *driver) runPlugin(fullname string, plugin string, cmd string, rt *cniRuntime, config []byte) ([]byte, error) {
+	vars := [][2]string{
+		{"CNI_COMMAND", cmd},
+		{"CNI_CONTAINERID", rt.ContainerID},
+		{"CNI_NETNS", rt.Netns},
+		{"CNI_PATH", driver.pluginPath(rt)},
+	}
+	if rt.IfName != "" {
+		vars = append(vars, [2]string{"CNI_IFNAME", rt.IfName})
+	}
+	if cniArgs := mergeCNIArgs(driver.pluginArgs[plugin], rt.Args); len(cniArgs) > 0 {
+		vars = append(vars, [2]string{"CNI_ARGS", formatCNIArgs(cniArgs)})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	timeout := driver.commandTimeout(cmd)
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	stdin := bytes.NewBuffer(config)
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	// A plugin flooding us with output is killed rather than allowed to
+	// run us out of memory
+	stdoutLimit := newLimitedWriter(stdout, driver.outputLimit, cancel)
+	stderrLog := newPluginLogger(plugin, rt)
+	defer stderrLog.flush()
+	stderrLimit := newLimitedWriter(io.MultiWriter(stderrLog, stderr), driver.outputLimit, cancel)
+
+	c := exec.CommandContext(ctx, fullname)
+	if len(driver.pluginWrapper) > 0 {
+		args := append(append([]string{}, driver.pluginWrapper[1:]...), fullname)
+		c = exec.CommandContext(ctx, driver.pluginWrapper[0], args...)
+	}
+	driver.cgroup.apply(c)
+	c.Env = envVars(vars)
+	c.Stdin = stdin
+	c.Stdout = stdoutLimit
+	c.Stderr = stderrLimit
+
+	if err := c.Run(); err != nil {
+		timedOut := false
+		switch {
+		case stdoutLimit.exceeded || stderrLimit.exceeded:
+			err = fmt.Errorf("plugin output exceeded limit of %d bytes", driver.outputLimit)
+		case ctx.Err() == context.DeadlineExceeded:
+			err = fmt.Errorf("%s timed out after %v", cmd, timeout)
+			timedOut = true
+		}
+		perr := newPluginError(err, stdout.Bytes(), stderr.Bytes())
+		perr.timedOut = timedOut
+		return stdout.Bytes(), perr
+	}
+	return stdout.Bytes(), nil
+}
+
+// limitedWriter passes on at most limit bytes, calling exceed once more are
+// written; a limit of 0 or less is no limit
+type limitedWriter struct {
+	w         io.Writer
+	remaining int64
+	exceeded  bool
+	exceed    func()
+}
+
+func newLimitedWriter(w io.Writer, limit int64, exceed func()) *limitedWriter {
+	if limit <= 0 {
+		limit = -1
+	}
+	return &limitedWriter{w: w, remaining: limit, exceed: exceed}
+}
+
+func (l *limitedWriter) Write(p []byte) (int, error) {
+	if l.remaining < 0 {
+		return l.w.Write(p)
+	}
+	if int64(len(p)) > l.remaining {
+		n, _ := l.w.Write(p[:l.remaining])
+		l.remaining = 0
+		if !l.exceeded {
+			l.exceeded = true
+			l.exceed()
+		}
+		return n, fmt.Errorf("output limit exceeded")
+	}
+	n, err := l.w.Write(p)
+	l.remaining -= int64(n)
+	return n, err
+}
+
+// commandTimeout returns how long a plugin may take to run the command
+func (driver *driver) commandTimeout(cmd string) time.Duration {
+	switch cmd {
+	case "ADD":
+		return driver.addTimeout
+	case "CHECK", "VERSION":
+		return driver.checkTimeout
+	default:
+		return driver.delTimeout
+	}
+}
+
+// addNetwork runs ADD for each plugin in the chain in order, handing each
+// the previous plugin's result, and returns the final result along with
+// the config each plugin was given.  If a plugin fails, the chain up to it
+// is DELed, as the spec asks of runtimes, so that what the plugins before
+// it set up isn't leaked.
+func (driver *driver) addNetwork(nc *netConf, rt *cniRuntime) ([]byte, [][]byte, error) {
+	var result []byte
+	configs := make([][]byte, len(nc.Plugins))
+	for i := range nc.Plugins {
+		config, err := nc.pluginConfig(i, result, rt)
+		if err != nil {
+			driver.undoAdd(nc, i, rt, result, configs)
+			return nil, nil, err
+		}
+		plugin := nc.pluginBinary(i)
+		output, err := driver.execPlugin(plugin, "ADD", rt, config)
+		if err != nil {
+			configs[i] = config
+			driver.undoAdd(nc, i+1, rt, result, configs)
+			return nil, nil, wrapf(err, "plugin %s failed the ADD operation", plugin)
+		}
+		configs[i] = config
+		result = output
+	}
+	return result, configs, nil
+}
+
+// undoAdd runs DEL for the first n plugins of a chain whose ADD failed,
+// with the configs they were given and the last result we got
+func (driver *driver) undoAdd(nc *netConf, n int, rt *cniRuntime, prevResult []byte, configs [][]byte) {
+	if n == 0 {
+		return
+	}
+	partial := *nc
+	partial.Plugins = nc.Plugins[:n]
+	if len(nc.Binaries) > n {
+		partial.Binaries = nc.Binaries[:n]
+	}
+	if err := driver.delNetwork(&partial, rt, prevResult, configs[:n]); err != nil {
+		log.Printf("Failed to undo the failed ADD of network %s: %v", nc.Name, err)
+	}
+}
+
+// delNetwork runs DEL for each plugin in the chain in reverse order.  Each
+// plugin is given the config it was given for ADD, if we have it, since the
+// network config on disk may have changed since.
+func (driver *driver) delNetwork(nc *netConf, rt *cniRuntime, prevResult []byte, addConfigs [][]byte) error {
+	for i := len(nc.Plugins) - 1; i >= 0; i-- {
+		var config []byte
+		var err error
+		if i < len(addConfigs) && addConfigs[i] != nil {
+			config, err = nc.replayConfig(i, addConfigs[i], prevResult, rt)
+		} else {
+			config, err = nc.pluginConfig(i, prevResult, rt)
+		}
+		if err != nil {
+			return err
+		}
+		plugin := nc.pluginBinary(i)
+		if _, err := driver.execPlugin(plugin, "DEL", rt, config); err != nil {
+			return fmt.Errorf("plugin %s failed the DEL operation: %v", plugin, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package driver
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writePlugin writes a shell script plugin to dir
+func writePlugin(t *testing.T, dir string, name string, script string) {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte("#!/bin/sh\n"+script), 0755); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLimitedWriter(t *testing.T) {
+	tests := []struct {
+		name     string
+		limit    int64
+		writes   []string
+		want     string
+		exceeded bool
+	}{
+		{name: "no limit", limit: 0, writes: []string{"abc", "def"}, want: "abcdef"},
+		{name: "under the limit", limit: 6, writes: []string{"abc", "def"}, want: "abcdef"},
+		{name: "over the limit", limit: 4, writes: []string{"abc", "def", "ghi"}, want: "abcd", exceeded: true},
+		{name: "one large write", limit: 2, writes: []string{"abcdef"}, want: "ab", exceeded: true},
+	}
+
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		exceeds := 0
+		l := newLimitedWriter(&buf, tt.limit, func() { exceeds++ })
+		var err error
+		for _, s := range tt.writes {
+			if _, werr := l.Write([]byte(s)); werr != nil {
+				err = werr
+			}
+		}
+		if buf.String() != tt.want {
+			t.Errorf("%s: wrote %q, want %q", tt.name, buf.String(), tt.want)
+		}
+		if l.exceeded != tt.exceeded || (err != nil) != tt.exceeded {
+			t.Errorf("%s: exceeded = %v, error %v, want exceeded %v", tt.name, l.exceeded, err, tt.exceeded)
+		}
+		if tt.exceeded && exceeds != 1 {
+			t.Errorf("%s: exceed called %d times, want once", tt.name, exceeds)
+		}
+	}
+}
+
+func TestRunPluginOutputLimit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "plugins")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writePlugin(t, dir, "flood", "exec yes\n")
+	writePlugin(t, dir, "quiet", "echo '{\"cniVersion\": \"0.4.0\"}'\n")
+
+	d := &driver{plugpath: dir, outputLimit: 1 << 16}
+	rt := &cniRuntime{ContainerID: "c1"}
+
+	output, err := d.runPlugin(filepath.Join(dir, "flood"), "flood", "ADD", rt, []byte("{}"))
+	if err == nil || !strings.Contains(err.Error(), "plugin output exceeded limit") {
+		t.Errorf("flooding plugin error = %v, want output limit", err)
+	}
+	if len(output) > 1<<16 {
+		t.Errorf("flooding plugin output is %d bytes, over the limit", len(output))
+	}
+
+	output, err = d.runPlugin(filepath.Join(dir, "quiet"), "quiet", "ADD", rt, []byte("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(string(output)) != `{"cniVersion": "0.4.0"}` {
+		t.Errorf("quiet plugin output = %q", output)
+	}
+}
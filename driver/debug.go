@@ -0,0 +1,15 @@
+package driver
+
+import (
+	"log"
+)
+
+// set from Options.Debug
+var debug bool
+
+// debugf logs only when debugging output is enabled
+func debugf(format string, v ...interface{}) {
+	if debug {
+		log.Printf(format, v...)
+	}
+}
@@ -0,0 +1,80 @@
+package driver
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// deleter runs CNI DEL for left endpoints in the background so Leave can
+// return immediately.  The queue is bounded, so Leave blocks once it fills
+// up rather than letting it grow without limit.
+type deleter struct {
+	driver  *driver
+	retries int
+	jobs    chan *endpoint
+	pending sync.WaitGroup
+
+	sync.Mutex
+	closed bool
+}
+
+func newDeleter(driver *driver, workers int, queueLen int, retries int) *deleter {
+	d := &deleter{
+		driver:  driver,
+		retries: retries,
+		jobs:    make(chan *endpoint, queueLen),
+	}
+	for i := 0; i < workers; i++ {
+		go d.work()
+	}
+	return d
+}
+
+func (d *deleter) work() {
+	for ep := range d.jobs {
+		d.del(ep)
+		d.pending.Done()
+	}
+}
+
+func (d *deleter) del(ep *endpoint) {
+	backoff := time.Second
+	for attempt := 0; ; attempt++ {
+		err := d.driver.delEndpoint(ep)
+		if err == nil {
+			log.Printf("Deleted endpoint %s", ep.ID)
+			return
+		}
+		if attempt >= d.retries {
+			log.Printf("Giving up deleting endpoint %s: %v", ep.ID, err)
+			return
+		}
+		log.Printf("Failed to delete endpoint %s, retrying in %v: %v", ep.ID, backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// enqueue queues a DEL for the endpoint, or runs it directly once the
+// deleter has been flushed for shutdown
+func (d *deleter) enqueue(ep *endpoint) {
+	d.Lock()
+	if d.closed {
+		d.Unlock()
+		d.del(ep)
+		return
+	}
+	d.pending.Add(1)
+	d.Unlock()
+	d.jobs <- ep
+}
+
+// flush waits for all queued DELs to finish
+func (d *deleter) flush() {
+	d.Lock()
+	d.closed = true
+	d.Unlock()
+	d.pending.Wait()
+	close(d.jobs)
+}
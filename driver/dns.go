@@ -0,0 +1,142 @@
+package driver
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Network options giving default DNS settings, as comma-separated lists,
+// for networks whose plugins return none
+const (
+	dnsNameserversOption = "cni.dns.nameservers"
+	dnsSearchOption      = "cni.dns.search"
+	dnsOptionsOption     = "cni.dns.options"
+)
+
+// cniDNS is the DNS section of a CNI result
+type cniDNS struct {
+	Nameservers []string `json:"nameservers,omitempty"`
+	Domain      string   `json:"domain,omitempty"`
+	Search      []string `json:"search,omitempty"`
+	Options     []string `json:"options,omitempty"`
+}
+
+func (dns *cniDNS) empty() bool {
+	return dns == nil || (len(dns.Nameservers) == 0 && dns.Domain == "" && len(dns.Search) == 0 && len(dns.Options) == 0)
+}
+
+func (dns *cniDNS) validate() error {
+	for _, ns := range dns.Nameservers {
+		if net.ParseIP(ns) == nil {
+			return fmt.Errorf("invalid nameserver %q", ns)
+		}
+	}
+	return nil
+}
+
+func splitOption(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// optionDNS returns the DNS defaults set by a network's options, if any
+func optionDNS(options map[string]string) (*cniDNS, error) {
+	dns := &cniDNS{
+		Nameservers: splitOption(options[dnsNameserversOption]),
+		Search:      splitOption(options[dnsSearchOption]),
+		Options:     splitOption(options[dnsOptionsOption]),
+	}
+	if dns.empty() {
+		return nil, nil
+	}
+	return dns, dns.validate()
+}
+
+// networkDNS returns a network's DNS defaults, from its options or else its
+// network map entry
+func (driver *driver) networkDNS(nw *network) (*cniDNS, error) {
+	dns, err := optionDNS(nw.Options)
+	if dns != nil || err != nil {
+		return dns, err
+	}
+	if entry := driver.networkMapEntry(nw.ID); entry != nil {
+		return entry.DNS, nil
+	}
+	return nil, nil
+}
+
+// mergeDNS fills in whatever the plugin's DNS settings leave out from the
+// network's defaults
+func mergeDNS(result *cniDNS, defaults *cniDNS) *cniDNS {
+	if defaults == nil {
+		return result
+	}
+	if result == nil {
+		return defaults
+	}
+	merged := *result
+	if len(merged.Nameservers) == 0 {
+		merged.Nameservers = defaults.Nameservers
+	}
+	if merged.Domain == "" {
+		merged.Domain = defaults.Domain
+	}
+	if len(merged.Search) == 0 {
+		merged.Search = defaults.Search
+	}
+	if len(merged.Options) == 0 {
+		merged.Options = defaults.Options
+	}
+	return &merged
+}
+
+func (dns *cniDNS) resolvConf() []byte {
+	var buf bytes.Buffer
+	for _, ns := range dns.Nameservers {
+		fmt.Fprintf(&buf, "nameserver %s\n", ns)
+	}
+	if dns.Domain != "" {
+		fmt.Fprintf(&buf, "domain %s\n", dns.Domain)
+	}
+	if len(dns.Search) > 0 {
+		fmt.Fprintf(&buf, "search %s\n", strings.Join(dns.Search, " "))
+	}
+	if len(dns.Options) > 0 {
+		fmt.Fprintf(&buf, "options %s\n", strings.Join(dns.Options, " "))
+	}
+	return buf.Bytes()
+}
+
+func (driver *driver) resolvConfPath(endpointID string) string {
+	return filepath.Join(driver.resolvConfDir, endpointID+".resolv.conf")
+}
+
+// writeResolvConf generates the endpoint's resolv.conf and returns its path
+func (driver *driver) writeResolvConf(endpointID string, dns *cniDNS) (string, error) {
+	if err := os.MkdirAll(driver.resolvConfDir, 0755); err != nil {
+		return "", err
+	}
+	path := driver.resolvConfPath(endpointID)
+	if err := ioutil.WriteFile(path, dns.resolvConf(), 0644); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// removeResolvConf removes the endpoint's generated resolv.conf, if any
+func (driver *driver) removeResolvConf(endpointID string) {
+	if err := os.Remove(driver.resolvConfPath(endpointID)); err != nil && !os.IsNotExist(err) {
+		log.Printf("Failed to remove endpoint %s resolv.conf: %v", endpointID, err)
+	}
+}
@@ -1,12 +1,167 @@
 package driver
 
 import (
+	"fmt"
+	"io/ioutil"
 	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
 	"github.com/dcbw/go-dockerclient"
 )
 
+// The Docker endpoint when DOCKER_HOST isn't set
+const defaultDockerEndpoint = "unix:///var/run/docker.sock"
+
+// dockerClient is the Docker client shared by the driver and its watcher.
+// Reloading replaces it; calls already made with the old one finish with
+// it, and later ones use the new one.
+type dockerClient struct {
+	sync.RWMutex
+	client   *docker.Client
+	endpoint string
+}
+
+// The environment variables that choose the Docker endpoint and its TLS
+// settings
+var dockerEnvVars = []string{"DOCKER_HOST", "DOCKER_TLS_VERIFY", "DOCKER_CERT_PATH"}
+
+// loadDockerEnv sets the Docker environment variables from a file of
+// KEY=VALUE lines, unsetting those it leaves out, so that a reload can
+// pick up changes we can't get from our own environment.  Blank lines and
+// lines starting with # are skipped.
+func loadDockerEnv(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var lines []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+			lines = append(lines, line)
+		}
+	}
+	env, err := parseKeyValues("Docker environment line", lines)
+	if err != nil {
+		return err
+	}
+	for _, key := range dockerEnvVars {
+		if value, ok := env[key]; ok {
+			os.Setenv(key, value)
+		} else {
+			os.Unsetenv(key)
+		}
+	}
+	return nil
+}
+
+// newDockerClient connects to DOCKER_HOST, with the TLS settings of
+// DOCKER_TLS_VERIFY and DOCKER_CERT_PATH, or to the local daemon's socket
+// if DOCKER_HOST isn't set.  With envFile, those are read from it first.
+func newDockerClient(envFile string) (*docker.Client, string, error) {
+	if envFile != "" {
+		if err := loadDockerEnv(envFile); err != nil {
+			return nil, "", fmt.Errorf("failed to read Docker environment: %v", err)
+		}
+	}
+	endpoint := os.Getenv("DOCKER_HOST")
+	if endpoint == "" {
+		client, err := docker.NewClient(defaultDockerEndpoint)
+		return client, defaultDockerEndpoint, err
+	}
+	client, err := docker.NewClientFromEnv()
+	return client, endpoint, err
+}
+
+func (c *dockerClient) get() *docker.Client {
+	c.RLock()
+	defer c.RUnlock()
+	return c.client
+}
+
+// set replaces the client, returning the endpoint of the old one
+func (c *dockerClient) set(client *docker.Client, endpoint string) string {
+	c.Lock()
+	defer c.Unlock()
+	old := c.endpoint
+	c.client = client
+	c.endpoint = endpoint
+	return old
+}
+
+// ReloadDocker replaces the Docker client with one for the DOCKER_HOST and
+// TLS settings in the Docker environment file, re-registers the event listener on it and
+// resyncs, without touching the plugin socket.  A daemon that can't be
+// reached isn't switched to.
+func (driver *driver) ReloadDocker() error {
+	client, endpoint, err := newDockerClient(driver.dockerEnvFile)
+	if err != nil {
+		return fmt.Errorf("could not connect to docker: %v", err)
+	}
+	probe := &dockerer{client: &dockerClient{client: client, endpoint: endpoint}, timeout: driver.timeout}
+	if err := probe.Ping(); err != nil {
+		return fmt.Errorf("Docker at %s is unreachable, keeping the current client: %v", endpoint, err)
+	}
+	if old := driver.client.set(client, endpoint); old != endpoint {
+		log.Printf("Docker endpoint changed from %s to %s", old, endpoint)
+	} else {
+		log.Printf("Reconnected to Docker at %s", endpoint)
+	}
+	return driver.watcher.Reconnect()
+}
+
 type dockerer struct {
-	client *docker.Client
+	client *dockerClient
+	// bounds each Docker API call; zero means wait forever
+	timeout time.Duration
+}
+
+// withTimeout runs a Docker API call, giving up once the timeout passes.  The
+// call itself cannot be cancelled and is left to finish in the background,
+// so callers must not look at anything it sets unless it succeeded.
+func (d *dockerer) withTimeout(op string, call func() error) error {
+	if d.timeout <= 0 {
+		return call()
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- call()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(d.timeout):
+		return fmt.Errorf("docker %s timed out after %v", op, d.timeout)
+	}
+}
+
+// first delay before retrying to reach Docker at startup, doubling up to
+// the maximum
+const (
+	dockerRetryBackoff    = 500 * time.Millisecond
+	dockerRetryMaxBackoff = 10 * time.Second
+)
+
+// retryDocker runs setup until it succeeds or wait has passed, so we can
+// start before Docker is up rather than exiting; a zero wait tries once
+func retryDocker(what string, wait time.Duration, setup func() error) error {
+	deadline := time.Now().Add(wait)
+	backoff := dockerRetryBackoff
+	for {
+		err := setup()
+		if err == nil || time.Now().Add(backoff).After(deadline) {
+			return err
+		}
+		log.Printf("Failed to %s, retrying in %v: %v", what, backoff, err)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > dockerRetryMaxBackoff {
+			backoff = dockerRetryMaxBackoff
+		}
+	}
 }
 
 func (d *dockerer) getContainerBridgeIP(nameOrID string) (string, error) {
@@ -18,15 +173,61 @@ func (d *dockerer) getContainerBridgeIP(nameOrID string) (string, error) {
 	return info.NetworkSettings.IPAddress, nil
 }
 
+func (d *dockerer) Ping() error {
+	return d.withTimeout("ping", d.client.get().Ping)
+}
+
 func (d *dockerer) InspectContainer(nameOrId string) (*docker.Container, error) {
-	return d.client.InspectContainer(nameOrId)
+	var container *docker.Container
+	err := d.withTimeout("inspect container "+nameOrId, func() (err error) {
+		container, err = d.client.get().InspectContainer(nameOrId)
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+	return container, nil
 }
 
 func (d *dockerer) NetworkInfo(id string) (*docker.Network, error) {
-	return d.client.NetworkInfo(id)
+	var nw *docker.Network
+	err := d.withTimeout("network info "+id, func() (err error) {
+		nw, err = d.client.get().NetworkInfo(id)
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+	return nw, nil
 }
 
 func (d *dockerer) ListNetworks() ([]docker.Network, error) {
-	return d.client.ListNetworks()
+	var networks []docker.Network
+	err := d.withTimeout("list networks", func() (err error) {
+		networks, err = d.client.get().ListNetworks()
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+	return networks, nil
+}
+
+// liveContainersOptions lists the containers that may be joining networks:
+// running ones, and created ones Docker is about to start
+var liveContainersOptions = docker.ListContainersOptions{
+	All:     true,
+	Filters: map[string][]string{"status": {"created", "running"}},
 }
 
+func (d *dockerer) ListContainers(opts docker.ListContainersOptions) ([]docker.APIContainers, error) {
+	var containers []docker.APIContainers
+	err := d.withTimeout("list containers", func() (err error) {
+		containers, err = d.client.get().ListContainers(opts)
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+	return containers, nil
+}
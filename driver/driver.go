@@ -7,22 +7,196 @@ import (
 	"net"
 	"net/http"
 	"log"
-	"os"
-	"os/exec"
-	"path/filepath"
-	"bytes"
-	"strings"
+	"time"
 
-	docker "github.com/dcbw/go-dockerclient"
 	"github.com/gorilla/mux"
 )
 
 const (
 	MethodReceiver = "NetworkDriver"
+
+	// How long a Join waits for its container's "create" event, and for it
+	// to start if its netns is found by its PID
+	containerStartTimeout = 5 * time.Second
 )
 
 type Driver interface {
 	Listen(string) error
+	// Shutdown finishes any outstanding background work
+	Shutdown()
+	// ReloadDocker reconnects to Docker, with the settings in the Docker
+	// environment file if there is one
+	ReloadDocker() error
+}
+
+// Options configures a new driver
+type Options struct {
+	Debug       bool
+	Version     string
+	PlugPath    string
+	NetConfPath string
+	// IfPrefix names container interfaces; the Nth network a container
+	// joins gets IfPrefix<N-1>, eg eth0, eth1
+	IfPrefix string
+	// DstPrefix is what libnetwork renames container interfaces to, with
+	// its own index appended, unless a network's cni.dstprefix option or
+	// network map entry says otherwise
+	DstPrefix string
+	// AuditLog, if set, is the file to which each plugin execution is
+	// recorded
+	AuditLog string
+	// IPAMPlugin, if set, is the CNI IPAM plugin backing our Docker IPAM
+	// driver; when unset we are only a network driver
+	IPAMPlugin string
+	// Scope is the scope we report to Docker, unless PluginScopes
+	// ("plugin=scope") give all configured networks some other scope
+	Scope        string
+	PluginScopes []string
+	// FallbackPlugins are "capability=plugin" pairs; a Join needing the
+	// capability of a chain with no plugin declaring it appends the plugin
+	FallbackPlugins []string
+	// SocketGroup and SocketMode (octal), if set, are applied to the
+	// plugin socket
+	SocketGroup string
+	SocketMode  string
+	// AdminSocket, if set, is where operator endpoints are served
+	AdminSocket string
+	// NetworkMap, if set, is a JSON file statically configuring networks
+	NetworkMap string
+	// ConfRules, if set, is a JSON file of rules choosing a different CNI
+	// network config at Join from network options and container labels
+	ConfRules string
+	// NoWatch stops us listening to Docker events and tracking networks;
+	// networks are then resolved only through their options and the
+	// network map, and containers are inspected on each Join.  Networks
+	// created before we started are looked up in Docker once to recover
+	// their options, but aren't resolved by name as watched ones are.
+	NoWatch bool
+	// ManagedNetworks, if set, are the only networks we watch and join,
+	// given by name or as "label:KEY[=VALUE]".  Creating others still
+	// succeeds, since CreateNetwork tells us neither, but joining them is
+	// refused.
+	ManagedNetworks []string
+	// EventTypes are the types of Docker event to listen for; all of them
+	// if empty
+	EventTypes []string
+	// EventWorkers is how many containers' events may be handled at once
+	EventWorkers int
+	// WaitForDocker is how long to keep trying to reach Docker at startup;
+	// zero gives up at once
+	WaitForDocker time.Duration
+	// DockerAPITimeout bounds each Docker API call; zero disables it
+	DockerAPITimeout time.Duration
+	// A plugin's ADDs are refused for BreakerCooldown after it fails
+	// BreakerThreshold times in a row within BreakerWindow; a zero
+	// threshold disables this
+	BreakerThreshold int
+	BreakerWindow    time.Duration
+	BreakerCooldown  time.Duration
+	// AddTimeout, DelTimeout and CheckTimeout bound how long a plugin may
+	// take to run ADD, DEL (and GC) and CHECK (and VERSION); zero means no
+	// limit
+	AddTimeout   time.Duration
+	DelTimeout   time.Duration
+	CheckTimeout time.Duration
+	// ContainerNameArg, if set, is the CNI_ARGS key under which plugins
+	// are passed the container's name
+	ContainerNameArg string
+	// CheckMaster checks before ADD that the host interfaces plugins like
+	// macvlan attach to (their "master") exist
+	CheckMaster bool
+	// PreallocIP allocates endpoints' addresses at CreateEndpoint, when
+	// Docker's IPAM didn't, with the network config's IPAM plugin
+	PreallocIP bool
+	// PluginWrapper, if set, is a command (with arguments, split on
+	// whitespace) that plugins are run through, with the plugin's path as
+	// its last argument.  It must run the plugin with its own environment,
+	// stdin, stdout and stderr, and exit with the plugin's status.
+	PluginWrapper string
+	// PluginOutputLimit is how many bytes a plugin may write to each of
+	// stdout and stderr before it is killed; zero means no limit
+	PluginOutputLimit int64
+	// PluginChecksums, if set, is a JSON file mapping plugin names to the
+	// sha256 of their binaries; plugins that don't match, or aren't
+	// listed, aren't run
+	PluginChecksums string
+	// DockerEnvFile, if set, is a file of DOCKER_HOST, DOCKER_TLS_VERIFY
+	// and DOCKER_CERT_PATH settings, read at startup and on each
+	// ReloadDocker; otherwise they come from our environment
+	DockerEnvFile string
+	// LogLabelAllow and LogLabelDeny are patterns of the container labels,
+	// and of "name" and "image", that may and may not appear in our logs;
+	// without LogLabelAllow, only the name and image are logged
+	LogLabelAllow []string
+	LogLabelDeny  []string
+	// CNICacheDir, if set, is where attachments' ADD results are kept in
+	// libcni's cache format, along with our IPAM pools and preallocated
+	// addresses, and where they are restored from at startup
+	CNICacheDir string
+	// ErrorHistory is how many of the last failed requests and plugin
+	// executions /debug/errors shows, with Debug; zero keeps none
+	ErrorHistory int
+	// PluginCgroup, if set, is the path of an existing cgroup v2 in which
+	// plugins are run, to bound their resource usage
+	PluginCgroup string
+	// PluginRetries is how many times to retry a plugin that failed
+	// because of IPAM lock contention
+	PluginRetries int
+	// AsyncDel makes Leave return before CNI DEL has run; DELs are queued
+	// (up to AsyncDelQueue of them) for AsyncDelWorkers to run, and are
+	// retried AsyncDelRetries times on failure
+	AsyncDel        bool
+	AsyncDelWorkers int
+	AsyncDelQueue   int
+	AsyncDelRetries int
+	// PluginArgs are "plugin=KEY=VALUE" CNI_ARGS passed on every
+	// invocation of the named plugin
+	PluginArgs []string
+	// K8sArgs passes the K8S_POD_* CNI_ARGS that Kubernetes plugins expect,
+	// taken from the labels dockershim puts on pod containers
+	K8sArgs bool
+	// NetworkArgs passes plugins the Docker network's ID and name in their
+	// config's "args", under "com.docker.network"
+	NetworkArgs bool
+	// HealthInterval is roughly how often Docker is pinged to check our
+	// connection to it; zero disables this
+	HealthInterval time.Duration
+	// CheckInterval is roughly how often CHECK is run for every joined
+	// endpoint; zero disables this, leaving only the admin listener's
+	// /debug/check
+	CheckInterval time.Duration
+	// RequireIP fails a Join when the plugins return no address although
+	// the network's config has IPAM; otherwise such endpoints are attached
+	// without addresses, as for policy-only networks
+	RequireIP bool
+	// DefaultMTU is given to the plugins of networks whose CNI config and
+	// options don't give an MTU; zero leaves them to the plugins
+	DefaultMTU int
+	// ResolvConfDir is where endpoints' resolv.conf files are generated
+	// from their plugins' DNS results and their networks' DNS defaults
+	ResolvConfDir string
+	// HostsDir is where endpoints' /etc/hosts files are generated, for
+	// networks with the cni.hosts option
+	HostsDir string
+	// ReadTimeout and IdleTimeout bound reading a request and an idle
+	// connection to our sockets.  WriteTimeout bounds handling a request,
+	// except for the methods that run plugins, which are bounded by
+	// AddTimeout, DelTimeout and CheckTimeout instead.  Zero disables each.
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	IdleTimeout  time.Duration
+	// ExecHook, if set, is a command (with arguments, split on whitespace)
+	// run in the background on network and endpoint lifecycle events
+	ExecHook string
+	// UsernsMode is how to treat containers in a remapped user namespace:
+	// "allow" configures their netns as any other, "deny" fails their Joins
+	UsernsMode string
+	// SharedNetnsMode is how to join containers sharing another's netns:
+	// "reuse" the other's interface, or "add" to run the plugins anyway
+	SharedNetnsMode string
+	// NetnsResolver is how to find containers' network namespaces: "proc",
+	// "sandbox", or "auto" to pick by each container's OCI runtime
+	NetnsResolver string
 }
 
 type driver struct {
@@ -30,42 +204,334 @@ type driver struct {
 	version     string
 	plugpath    string
 	netconfpath string
+	pluginArgs  map[string][][2]string
+	k8sArgs     bool
+	networkArgs bool
+	containerNameArg string
+	requireIP   bool
+	defaultMTU  int
+	resolvConfDir string
+	hostsDir    string
+	ifPrefix    string
+	dstPrefix   string
+	adminSocket string
+	ipamPlugin  string
+	scope       string
+	pluginScopes map[string]string
+	fallbackPlugins map[string]string
+	networkMap  map[string]*networkMapEntry
+	confRules   []*confRule
+	noWatch     bool
+	managed     *managedNetworks
+	socketPerms *socketPerms
+	readTimeout time.Duration
+	writeTimeout time.Duration
+	idleTimeout time.Duration
+	pools       *pools
+	pluginRetries int
+	addTimeout  time.Duration
+	delTimeout  time.Duration
+	checkTimeout time.Duration
+	outputLimit int64
+	pluginWrapper []string
+	// nil unless a checksum manifest is configured
+	checksums   *pluginChecksums
+	// nil unless plugins run in their own cgroup
+	cgroup      *pluginCgroup
+	preallocIP  bool
+	checkMaster bool
+	usernsMode  string
+	dockerEnvFile string
+	sharedNetnsMode string
 	watcher     Watcher
+	netnsResolver netnsResolver
+	networks    *networks
+	endpoints   *endpoints
+	breaker     *breaker
+	health      *dockerHealth
+	versions    *pluginVersions
+	latency     *pluginLatency
+	gcLocks     *gcLocks
+	// nil unless results are cached
+	cache       *resultCache
+	// whether the endpoints were restored from the cache at startup, so
+	// that we know every attachment, as GC must
+	restored    bool
+	// nil unless debugging, with an error history
+	errors      *recentErrors
+	// nil unless auditing is enabled
+	audit       *auditLog
+	// nil unless an exec hook is configured
+	hook        *execHook
+	// nil unless DELs are asynchronous
+	deleter     *deleter
 }
 
-func New(version string, plugpath string, netconfpath string) (Driver, error) {
-	client, err := docker.NewClient("unix:///var/run/docker.sock")
+func New(opts *Options) (Driver, error) {
+	debug = opts.Debug
+
+	pluginArgs, err := parsePluginArgs(opts.PluginArgs)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateIfPrefix(opts.IfPrefix); err != nil {
+		return nil, err
+	}
+	if err := validateIfPrefix(opts.DstPrefix); err != nil {
+		return nil, err
+	}
+	if err := validateScope(opts.Scope); err != nil {
+		return nil, err
+	}
+	if opts.DefaultMTU < 0 {
+		return nil, fmt.Errorf("invalid default MTU %d", opts.DefaultMTU)
+	}
+	if opts.AsyncDel {
+		if opts.AsyncDelWorkers < 1 {
+			return nil, fmt.Errorf("invalid async DEL workers %d, must be at least 1", opts.AsyncDelWorkers)
+		}
+		if opts.AsyncDelQueue < 1 {
+			return nil, fmt.Errorf("invalid async DEL queue size %d, must be at least 1", opts.AsyncDelQueue)
+		}
+	}
+	fallbackPlugins, err := parseFallbackPlugins(opts.FallbackPlugins)
+	if err != nil {
+		return nil, err
+	}
+	pluginScopes, err := parsePluginScopes(opts.PluginScopes)
+	if err != nil {
+		return nil, err
+	}
+	networkMap, err := loadNetworkMap(opts.NetworkMap)
+	if err != nil {
+		return nil, err
+	}
+	confRules, err := loadConfRules(opts.ConfRules)
+	if err != nil {
+		return nil, err
+	}
+	checksums, err := loadPluginChecksums(opts.PluginChecksums)
+	if err != nil {
+		return nil, err
+	}
+	socketPerms, err := parseSocketPerms(opts.SocketGroup, opts.SocketMode)
+	if err != nil {
+		return nil, err
+	}
+	managed, err := parseManagedNetworks(opts.ManagedNetworks)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateCNIArgKey(opts.ContainerNameArg); err != nil {
+		return nil, err
+	}
+	if logLabels, err = newLabelFilter(opts.LogLabelAllow, opts.LogLabelDeny); err != nil {
+		return nil, err
+	}
+	if opts.UsernsMode == "" {
+		opts.UsernsMode = usernsAllow
+	}
+	if err := validateUsernsMode(opts.UsernsMode); err != nil {
+		return nil, err
+	}
+	if opts.SharedNetnsMode == "" {
+		opts.SharedNetnsMode = sharedNetnsReuse
+	}
+	if err := validateSharedNetnsMode(opts.SharedNetnsMode); err != nil {
+		return nil, err
+	}
+	hook, err := newExecHook(opts.ExecHook)
+	if err != nil {
+		return nil, err
+	}
+	pluginWrapper, err := parsePluginWrapper(opts.PluginWrapper)
+	if err != nil {
+		return nil, err
+	}
+	cgroup, err := openPluginCgroup(opts.PluginCgroup)
+	if err != nil {
+		return nil, err
+	}
+
+	dc, endpoint, err := newDockerClient(opts.DockerEnvFile)
 	if err != nil {
 		return nil, fmt.Errorf("could not connect to docker: %s", err)
 	}
+	client := &dockerClient{client: dc, endpoint: endpoint}
+	if opts.WaitForDocker > 0 {
+		dockerer := &dockerer{client: client, timeout: opts.DockerAPITimeout}
+		if err := retryDocker("ping Docker", opts.WaitForDocker, dockerer.Ping); err != nil {
+			return nil, fmt.Errorf("Docker did not come up within %v: %v", opts.WaitForDocker, err)
+		}
+	}
 
-	watcher, err := NewWatcher(client)
+	var watcher Watcher
+	if opts.NoWatch {
+		watcher = NewDirectWatcher(client, opts.DockerAPITimeout)
+	} else {
+		err = retryDocker("watch Docker", opts.WaitForDocker, func() (err error) {
+			watcher, err = NewWatcher(client, opts.DockerAPITimeout, opts.EventTypes, opts.EventWorkers, managed)
+			return
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	resolver, err := newNetnsResolver(opts.NetnsResolver, watcher)
 	if err != nil {
 		return nil, err
 	}
 
-	return &driver{
+	d := &driver{
 		dockerer: dockerer{
 			client: client,
+			timeout: opts.DockerAPITimeout,
 		},
-		version: version,
-		plugpath: plugpath,
-		netconfpath: netconfpath,
+		version: opts.Version,
+		plugpath: opts.PlugPath,
+		netconfpath: opts.NetConfPath,
+		pluginArgs: pluginArgs,
+		k8sArgs: opts.K8sArgs,
+		networkArgs: opts.NetworkArgs,
+		containerNameArg: opts.ContainerNameArg,
+		requireIP: opts.RequireIP,
+		defaultMTU: opts.DefaultMTU,
+		resolvConfDir: opts.ResolvConfDir,
+		hostsDir: opts.HostsDir,
+		ifPrefix: opts.IfPrefix,
+		dstPrefix: opts.DstPrefix,
+		adminSocket: opts.AdminSocket,
+		ipamPlugin: opts.IPAMPlugin,
+		scope: opts.Scope,
+		pluginScopes: pluginScopes,
+		fallbackPlugins: fallbackPlugins,
+		networkMap: networkMap,
+		confRules: confRules,
+		noWatch: opts.NoWatch,
+		managed: managed,
+		socketPerms: socketPerms,
+		readTimeout: opts.ReadTimeout,
+		writeTimeout: opts.WriteTimeout,
+		idleTimeout: opts.IdleTimeout,
+		pools: newPools(),
+		pluginRetries: opts.PluginRetries,
+		addTimeout: opts.AddTimeout,
+		delTimeout: opts.DelTimeout,
+		checkTimeout: opts.CheckTimeout,
+		outputLimit: opts.PluginOutputLimit,
+		pluginWrapper: pluginWrapper,
+		checksums: checksums,
+		cgroup: cgroup,
+		preallocIP: opts.PreallocIP,
+		checkMaster: opts.CheckMaster,
+		usernsMode: opts.UsernsMode,
+		dockerEnvFile: opts.DockerEnvFile,
+		sharedNetnsMode: opts.SharedNetnsMode,
 		watcher: watcher,
-	}, nil
+		netnsResolver: resolver,
+		networks: newNetworks(),
+		endpoints: newEndpoints(),
+		breaker: newBreaker(opts.BreakerThreshold, opts.BreakerWindow, opts.BreakerCooldown),
+		health: newDockerHealth(),
+		hook: hook,
+		versions: newPluginVersions(),
+		latency: newPluginLatency(),
+		gcLocks: newGCLocks(),
+	}
+	if opts.AuditLog != "" {
+		if d.audit, err = openAuditLog(opts.AuditLog); err != nil {
+			return nil, fmt.Errorf("could not open audit log: %v", err)
+		}
+	}
+	if opts.Debug {
+		d.errors = newRecentErrors(opts.ErrorHistory)
+	}
+	if d.cache = newResultCache(opts.CNICacheDir); d.cache != nil {
+		eps, err := d.cache.load()
+		if err != nil {
+			return nil, fmt.Errorf("could not load cached results: %v", err)
+		}
+		for _, ep := range eps {
+			d.endpoints.restore(ep, d.ifPrefix)
+		}
+		d.restored = true
+		if len(eps) > 0 {
+			log.Printf("Restored %d endpoints from %s", len(eps), opts.CNICacheDir)
+		}
+		pls, err := d.cache.loadPools()
+		if err != nil {
+			return nil, fmt.Errorf("could not load cached pools: %v", err)
+		}
+		for _, pl := range pls {
+			d.pools.restore(pl)
+		}
+		if len(pls) > 0 {
+			log.Printf("Restored %d IPAM pools from %s", len(pls), opts.CNICacheDir)
+		}
+		d.pools.cache = d.cache
+		preallocs, err := d.cache.loadPreallocs()
+		if err != nil {
+			return nil, fmt.Errorf("could not load cached preallocations: %v", err)
+		}
+		for id, p := range preallocs {
+			d.endpoints.setPrealloc(id, p)
+		}
+		if len(preallocs) > 0 {
+			log.Printf("Restored %d preallocated addresses from %s", len(preallocs), opts.CNICacheDir)
+		}
+	}
+	if opts.AsyncDel {
+		d.deleter = newDeleter(d, opts.AsyncDelWorkers, opts.AsyncDelQueue, opts.AsyncDelRetries)
+	}
+	if opts.HealthInterval > 0 {
+		go d.monitorDocker(opts.HealthInterval)
+	}
+	if opts.CheckInterval > 0 {
+		go d.monitorChecks(opts.CheckInterval)
+	}
+	return d, nil
+}
+
+func (driver *driver) Shutdown() {
+	if driver.deleter != nil {
+		log.Printf("Flushing queued endpoint deletes")
+		driver.deleter.flush()
+	}
+}
+
+// handleMethod routes the receiver's method to h, recording its failures
+// and bounding how long it may take to respond
+func (driver *driver) handleMethod(router *mux.Router, receiver string, method string, h http.HandlerFunc) {
+	name := fmt.Sprintf("%s.%s", receiver, method)
+	router.Methods("POST").Path("/" + name).Handler(driver.recordFailures(name, driver.withWriteTimeout(name, h)))
 }
 
 func (driver *driver) Listen(socket string) error {
+	// Before serving, so Joins find the versions cached rather than each
+	// running the plugins again
+	driver.logVersions()
+	if driver.adminSocket != "" {
+		go func() {
+			log.Fatal(driver.listenAdmin(driver.adminSocket))
+		}()
+	}
+
 	router := mux.NewRouter()
 	router.NotFoundHandler = http.HandlerFunc(notFound)
 
 	router.Methods("GET").Path("/status").HandlerFunc(driver.status)
+	router.Methods("GET").Path("/health").HandlerFunc(driver.healthCheck)
+	router.Methods("GET").Path("/metrics").HandlerFunc(driver.metrics)
+	if driver.errors != nil {
+		router.Methods("GET").Path("/debug/errors").HandlerFunc(driver.debugErrors)
+	}
 	router.Methods("POST").Path("/Plugin.Activate").HandlerFunc(driver.handshake)
 
 	handleMethod := func(method string, h http.HandlerFunc) {
-		router.Methods("POST").Path(fmt.Sprintf("/%s.%s", MethodReceiver, method)).HandlerFunc(h)
+		driver.handleMethod(router, MethodReceiver, method, h)
 	}
 
+	handleMethod("GetCapabilities", driver.getCapabilities)
 	handleMethod("CreateNetwork", driver.createNetwork)
 	handleMethod("DeleteNetwork", driver.deleteNetwork)
 	handleMethod("CreateEndpoint", driver.createEndpoint)
@@ -73,27 +539,41 @@ func (driver *driver) Listen(socket string) error {
 	handleMethod("EndpointOperInfo", driver.infoEndpoint)
 	handleMethod("Join", driver.joinEndpoint)
 	handleMethod("Leave", driver.leaveEndpoint)
+	handleMethod("ProgramExternalConnectivity", driver.programExternalConnectivity)
+	handleMethod("RevokeExternalConnectivity", driver.revokeExternalConnectivity)
+
+	if driver.ipamPlugin != "" {
+		driver.handleIpam(router)
+	}
 
 	var (
 		listener net.Listener
 		err      error
 	)
 
+	if err := prepareSocket(socket); err != nil {
+		return err
+	}
 	listener, err = net.Listen("unix", socket)
 	if err != nil {
 		return err
 	}
-
-	s := &http.Server{
-		Handler: router,
+	if err := driver.socketPerms.apply(socket); err != nil {
+		listener.Close()
+		return err
 	}
+
+	s := driver.newServer(router)
 	s.SetKeepAlivesEnabled(false)
 	return s.Serve(listener)
 }
 
+// Docker probes for methods we don't implement, so don't log those loudly
 func notFound(w http.ResponseWriter, r *http.Request) {
-	log.Printf("[plugin] Not found: %+v", r)
-	http.NotFound(w, r)
+	debugf("[plugin] Not found: %s %s", r.Method, r.URL.Path)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusNotFound)
+	errorResponsef(w, "%s %s not found", r.Method, r.URL.Path)
 }
 
 func sendError(w http.ResponseWriter, msg string, code int) {
@@ -125,8 +605,12 @@ type handshakeResp struct {
 }
 
 func (driver *driver) handshake(w http.ResponseWriter, r *http.Request) {
+	implements := []string{MethodReceiver}
+	if driver.ipamPlugin != "" {
+		implements = append(implements, IpamMethodReceiver)
+	}
 	err := json.NewEncoder(w).Encode(&handshakeResp{
-		[]string{"NetworkDriver"},
+		implements,
 	})
 	if err != nil {
 		log.Fatal("handshake encode:", err)
@@ -138,11 +622,20 @@ func (driver *driver) handshake(w http.ResponseWriter, r *http.Request) {
 
 func (driver *driver) status(w http.ResponseWriter, r *http.Request) {
 	io.WriteString(w, fmt.Sprintln("CNI plugin", driver.version))
+	io.WriteString(w, fmt.Sprintln(driver.health.status()))
+	for _, line := range driver.breaker.status() {
+		io.WriteString(w, fmt.Sprintln(line))
+	}
+	for _, line := range driver.versionsStatus() {
+		io.WriteString(w, fmt.Sprintln(line))
+	}
 }
 
 type networkCreate struct {
 	NetworkID string
 	Options   map[string]interface{}
+	IPv4Data  []*ipamData
+	IPv6Data  []*ipamData
 }
 
 // CNM's CreateNetwork request has no analogue in CNI, so we simply
@@ -156,22 +649,71 @@ func (driver *driver) createNetwork(w http.ResponseWriter, r *http.Request) {
 	}
 	log.Printf("Create network request %+v", &create)
 
+	options, err := genericOptions(create.Options)
+	if err != nil {
+		errorResponsef(w, "%v", err)
+		return
+	}
+	nw, err := newNetwork(create.NetworkID, options, create.IPv4Data, create.IPv6Data, internal(create.Options))
+	if err != nil {
+		errorResponsef(w, "%v", err)
+		return
+	}
+	validate, err := boolOption(options, validateOption)
+	if err != nil {
+		errorResponsef(w, "%v", err)
+		return
+	}
+	if validate {
+		if err := driver.validateNetwork(nw); err != nil {
+			errorResponsef(w, "Invalid network %s: %v", create.NetworkID, err)
+			return
+		}
+		log.Printf("Network %s validated", create.NetworkID)
+	}
+	driver.networks.add(nw)
+
 	emptyResponse(w)
+	driver.hook.run(&hookEvent{Event: hookCreateNetwork, NetworkID: create.NetworkID})
+	if driver.noWatch {
+		return
+	}
+
+	go driver.watchCreatedNetwork(create.NetworkID)
+}
+
+// Docker only commits a network once our CreateNetwork response has
+// reached it, which neither the handler returning nor the request's
+// context being done tells us, so the lookup is retried until it does
+const (
+	createdNetworkRetries = 6
+	createdNetworkBackoff = 100 * time.Millisecond
+)
 
-	// Retrieve the network name from Docker after the response
-	// has been sent and the connection has closed (the network doesn't
-	// exist in docker until close)
-	notify := w.(http.CloseNotifier).CloseNotify()
-	go func() {
-		<-notify
-		nw, err := driver.NetworkInfo(create.NetworkID)
+// watchCreatedNetwork retrieves a network's name from Docker once Docker
+// has it, and watches the network
+func (driver *driver) watchCreatedNetwork(networkID string) {
+	backoff := createdNetworkBackoff
+	for attempt := 0; ; attempt++ {
+		time.Sleep(backoff)
+		nw, err := driver.NetworkInfo(networkID)
 		if err != nil {
-			log.Printf("NetworkInfo error %+v", err)
-		} else {
-			log.Printf("Watching network %+v", nw)
-			driver.watcher.WatchNetwork(nw)
+			if attempt >= createdNetworkRetries {
+				log.Printf("NetworkInfo error %+v", err)
+				return
+			}
+			debugf("Network %s not in Docker yet, retrying in %v: %v", networkID, backoff*2, err)
+			backoff *= 2
+			continue
 		}
-	}()
+		if !driver.managed.matches(nw) {
+			log.Printf("Skipping network %s (%s): not in the managed networks allowlist", nw.Name, nw.ID)
+			return
+		}
+		log.Printf("Watching network %+v", nw)
+		driver.watcher.WatchNetwork(nw)
+		return
+	}
 }
 
 type networkDelete struct {
@@ -187,7 +729,9 @@ func (driver *driver) deleteNetwork(w http.ResponseWriter, r *http.Request) {
 	log.Printf("Delete network request: %+v", &delete)
 
 	driver.watcher.UnwatchNetwork(delete.NetworkID)
+	driver.networks.remove(delete.NetworkID)
 	emptyResponse(w)
+	driver.hook.run(&hookEvent{Event: hookDeleteNetwork, NetworkID: delete.NetworkID})
 	log.Printf("Destroy network %s", delete.NetworkID)
 }
 
@@ -203,6 +747,7 @@ type iface struct {
 	SrcName    string
 	DstPrefix  string
 	Address    string
+	AddressIPv6 string
 	MacAddress string
 }
 
@@ -210,9 +755,19 @@ type endpointResponse struct {
 	Interfaces []*iface
 }
 
+func hasAddress(ifaces []*iface) bool {
+	for _, i := range ifaces {
+		if i.Address != "" || i.AddressIPv6 != "" {
+			return true
+		}
+	}
+	return false
+}
+
 // CNM's CreateEndpoint request loosely maps to CNI's IPAM ADD action, but CNI
 // rolls the IPAM stuff into the ADD process of the network plugin.  So we
-// can't do anything here.
+// can't do anything here, unless preallocating addresses Docker didn't
+// assign.
 func (driver *driver) createEndpoint(w http.ResponseWriter, r *http.Request) {
 	var create endpointCreate
 	if err := json.NewDecoder(r.Body).Decode(&create); err != nil {
@@ -221,12 +776,46 @@ func (driver *driver) createEndpoint(w http.ResponseWriter, r *http.Request) {
 	}
 	log.Printf("Create endpoint request %+v", &create)
 	endID := create.EndpointID
+	alias, err := optionAlias(create.Options)
+	if err != nil {
+		errorResponsef(w, "%v", err)
+		return
+	}
+	if _, err := optionCNIArgs(create.Options); err != nil {
+		errorResponsef(w, "%v", err)
+		return
+	}
+	driver.endpoints.setOptions(endID, create.Options)
+	if alias != "" {
+		driver.endpoints.setAlias(endID, alias)
+	}
 
 	resp := &endpointResponse{
 		Interfaces: []*iface{},
 	}
+	if driver.preallocIP && !hasAddress(create.Interfaces) {
+		p, err := driver.preallocate(create.NetworkID, endID)
+		if err != nil {
+			errorResponsef(w, "Failed to preallocate endpoint %s address: %v", endID, err)
+			return
+		}
+		resp.Interfaces = append(resp.Interfaces, p.iface())
+	} else if mac := endpointMac(create.Interfaces); mac != "" {
+		// So docker inspect has a MAC, which Join asks the plugins to use
+		resp.Interfaces = append(resp.Interfaces, &iface{MacAddress: mac})
+	}
+	driver.endpoints.setIface(endID, recordedIface(create.Interfaces, resp.Interfaces))
 
 	objectResponse(w, resp)
+	ev := &hookEvent{Event: hookCreateEndpoint, NetworkID: create.NetworkID, EndpointID: endID}
+	for _, i := range append(create.Interfaces, resp.Interfaces...) {
+		for _, addr := range []string{i.Address, i.AddressIPv6} {
+			if addr != "" {
+				ev.Addresses = append(ev.Addresses, addr)
+			}
+		}
+	}
+	driver.hook.run(ev)
 	log.Printf("Create endpoint %s %+v", endID, resp)
 }
 
@@ -242,7 +831,36 @@ func (driver *driver) deleteEndpoint(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	log.Printf("Delete endpoint request: %+v", &delete)
+	defer driver.endpoints.lock(delete.EndpointID)()
+
+	// Docker deletes endpoints whose Leave failed or never reached us, as
+	// when we were down; DEL them now rather than leak what ADD set up
+	driver.endpoints.removeShared(delete.EndpointID)
+	if ep := driver.endpoints.get(delete.EndpointID); ep != nil {
+		log.Printf("Endpoint %s deleted without leaving; deleting its attachment", delete.EndpointID)
+		if err := driver.delEndpoint(ep); err != nil {
+			errorResponsef(w, "Failed to delete endpoint %s: %v", delete.EndpointID, err)
+			return
+		}
+		driver.endpoints.remove(delete.EndpointID)
+		driver.removeResolvConf(delete.EndpointID)
+		driver.removeHosts(delete.EndpointID)
+	}
+	driver.endpoints.removeOptions(delete.EndpointID)
+	driver.endpoints.removeAlias(delete.EndpointID)
+	driver.endpoints.removeIface(delete.EndpointID)
+	if p := driver.endpoints.removePrealloc(delete.EndpointID); p != nil {
+		if err := driver.releasePreallocation(p); err != nil {
+			driver.endpoints.setPrealloc(delete.EndpointID, p)
+			errorResponsef(w, "Failed to release endpoint %s address: %v", delete.EndpointID, err)
+			return
+		}
+		if err := driver.cache.removePrealloc(delete.EndpointID); err != nil {
+			log.Printf("Failed to remove cached preallocation of endpoint %s: %v", delete.EndpointID, err)
+		}
+	}
 	emptyResponse(w)
+	driver.hook.run(&hookEvent{Event: hookDeleteEndpoint, NetworkID: delete.NetworkID, EndpointID: delete.EndpointID})
 
 	log.Printf("Delete endpoint %s", delete.EndpointID)
 }
@@ -256,6 +874,9 @@ type endpointInfo struct {
 	Value map[string]interface{}
 }
 
+// Docker may ask for an endpoint's info at any point of its life, even
+// before CreateEndpoint or after Leave, so whatever state we lack is simply
+// left out; with none at all the value is empty, never an error.
 func (driver *driver) infoEndpoint(w http.ResponseWriter, r *http.Request) {
 	var info endpointInfoReq
 	if err := json.NewDecoder(r.Body).Decode(&info); err != nil {
@@ -263,7 +884,33 @@ func (driver *driver) infoEndpoint(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	log.Printf("Endpoint info request: %+v", &info)
-	objectResponse(w, &endpointInfo{Value: map[string]interface{}{}})
+
+	value := map[string]interface{}{}
+	for k, v := range driver.endpoints.getOptions(info.EndpointID) {
+		value[k] = v
+	}
+	if ep := driver.endpoints.get(info.EndpointID); ep != nil {
+		if mtu := driver.endpointMTU(ep); mtu > 0 {
+			value[mtuOption] = mtu
+		}
+		for k, v := range ep.interfaceInfo() {
+			value[k] = v
+		}
+		if check := driver.endpoints.getCheck(info.EndpointID); check != nil {
+			for k, v := range check.info() {
+				value[k] = v
+			}
+		}
+	} else if p := driver.endpoints.getPrealloc(info.EndpointID); p != nil {
+		// Not joined yet, but its addresses are already allocated
+		if addrs := p.Result.addresses(); len(addrs) > 0 {
+			value[infoAddressesKey] = addrs
+		}
+	}
+	if alias := driver.endpoints.getAlias(info.EndpointID); alias != "" {
+		value[aliasOption] = alias
+	}
+	objectResponse(w, &endpointInfo{Value: value})
 	log.Printf("Endpoint info %s", info.EndpointID)
 }
 
@@ -293,47 +940,38 @@ type joinResponse struct {
 	HostsPath      string
 	ResolvConfPath string
 	Gateway        string
+	GatewayIPv6    string
 	InterfaceNames []*iface
 	StaticRoutes   []*staticRoute
+	DisableGatewayService bool
 }
 
-func envVars(vars [][2]string) []string {
-	env := os.Environ()
-
-	for _, kv := range vars {
-		env = append(env, strings.Join(kv[:], "="))
-	}
-
-	return env
-}
-
-func (driver *driver) execPlugin(plugin string, cmd string, containerid string, netns string, config string) ([]byte, error) {
-	fullname := filepath.Join(driver.plugpath, plugin)
-	if fi, err := os.Stat(fullname); err != nil || !fi.Mode().IsRegular() {
-		return nil, fmt.Errorf("Failed to find plugin name %s/%s", driver.plugpath, plugin)
-	}
-
-	vars := [][2]string{
-		{"CNI_COMMAND", cmd},
-		{"CNI_CONTAINERID", containerid},
-		{"CNI_NETNS", netns},
-		{"CNI_PATH", driver.plugpath},
+// resultJoinResponse builds the part of a Join response that comes from the
+// ADD result: its gateways and static routes.  A result without addresses
+// only fails the Join with -require-ip on a network with IPAM; IPv6
+// networks relying on SLAAC return at most routes, and the router
+// advertisements give the container its gateway.
+func (driver *driver) resultJoinResponse(nc *netConf, result *cniResult, endpointID string) (*joinResponse, error) {
+	if !result.hasIP() {
+		if driver.requireIP && nc.hasIPAM() {
+			return nil, fmt.Errorf("Network %s has IPAM but returned no addresses", nc.Name)
+		}
+		if result.IP6 != nil {
+			log.Printf("Network %s returned only IPv6 routes, leaving endpoint %s addresses to SLAAC", nc.Name, endpointID)
+		} else {
+			log.Printf("Network %s returned no addresses, attaching endpoint %s without any", nc.Name, endpointID)
+		}
 	}
 
-	stdin := bytes.NewBuffer([]byte(config))
-	stdout := &bytes.Buffer{}
-
-	c := exec.Cmd{
-		Path:   fullname,
-		Args:   []string{fullname},
-		Env:    envVars(vars),
-		Stdin:  stdin,
-		Stdout: stdout,
-		Stderr: os.Stderr,
+	routes, err := result.staticRoutes()
+	if err != nil {
+		return nil, fmt.Errorf("Network %s returned invalid routes: %v", nc.Name, err)
 	}
-
-	err := c.Run()
-	return stdout.Bytes(), err
+	return &joinResponse{
+		Gateway:      result.IP4.gateway(),
+		GatewayIPv6:  result.IP6.gateway(),
+		StaticRoutes: routes,
+	}, nil
 }
 
 // Here's where everything happens for CNI.  We call the CNI plugins
@@ -349,50 +987,258 @@ func (driver *driver) execPlugin(plugin string, cmd string, containerid string,
 func (driver *driver) joinEndpoint(w http.ResponseWriter, r *http.Request) {
 	var j join
 	if err := json.NewDecoder(r.Body).Decode(&j); err != nil {
-		sendError(w, "Could not decode JSON encode payload", http.StatusBadRequest)
+		sendJoinError(w, statusErrorf(http.StatusBadRequest, "Could not decode JSON encode payload"))
 		return
 	}
 	log.Printf("Join request: %+v", &j)
+	defer driver.endpoints.lock(j.EndpointID)()
+	if options := driver.endpoints.getOptions(j.EndpointID); len(options) > 0 {
+		log.Printf("Join endpoint %s options: %+v", j.EndpointID, options)
+	}
+	alias, err := optionAlias(j.Options)
+	if err != nil {
+		sendJoinError(w, &statusError{status: http.StatusBadRequest, err: err})
+		return
+	}
+
+	managed, err := driver.isManaged(j.NetworkID)
+	if err != nil {
+		sendJoinError(w, err)
+		return
+	}
+	if !managed {
+		sendJoinError(w, statusErrorf(http.StatusForbidden, "Network %s is not managed by this driver", j.NetworkID))
+		return
+	}
 
-	// Get network name here
-	nw := driver.watcher.GetNetworkById(j.NetworkID)
-	if nw == nil {
-		sendError(w, "Could not find requested network to join", http.StatusInternalServerError)
+	confName, err := driver.networkConfName(j.NetworkID)
+	if err != nil {
+		sendJoinError(w, err)
 		return
 	}
 
-	container := driver.watcher.GetContainerBySandboxKey(j.SandboxKey)
+	container := driver.watcher.WaitContainerBySandboxKey(j.SandboxKey, containerStartTimeout)
 	if container == nil {
-		sendError(w, fmt.Sprintf("Failed to find container with sandbox %s", j.SandboxKey), http.StatusInternalServerError)
+		sendJoinError(w, transientf("Failed to find container with sandbox %s", j.SandboxKey))
+		return
+	}
+
+	if owner := netnsOwner(container); owner != "" && driver.sharedNetnsMode == sharedNetnsReuse {
+		ownerEp := driver.ownerEndpoint(owner, j.NetworkID)
+		if ownerEp == nil {
+			sendJoinError(w, transientf("Container %s shares the netns of %s, which hasn't joined network %s", container.ID, owner, j.NetworkID))
+			return
+		}
+		res, err := driver.sharedJoinResponse(ownerEp, driver.createdNetwork(j.NetworkID))
+		if err != nil {
+			sendJoinError(w, fmt.Errorf("Endpoint %s has an invalid result: %v", ownerEp.ID, err))
+			return
+		}
+		driver.endpoints.setShared(j.EndpointID, ownerEp.ID)
+		objectResponse(w, res)
+		log.Printf("Join %s:%s (container %s) sharing endpoint %s of %s", j.NetworkID, j.EndpointID, container.ID, ownerEp.ID, owner)
 		return
 	}
 
-	// Get the network namespace path
-	netns, err := driver.watcher.GetContainerNetns(container.ID)
+	// Get the network namespace path; the sandbox's netns is what Docker
+	// will hand the container
+	netns, err := driver.netnsResolver.netns(j.SandboxKey, container)
 	if err != nil {
-		sendError(w, fmt.Sprintf("Failed to find container %s netns", container.ID), http.StatusInternalServerError)
+		sendJoinError(w, transientf("Failed to find container %s netns: %v", container.ID, err))
+		return
+	}
+
+	if err := checkNetns(netns); err != nil {
+		sendJoinError(w, &transientError{err: err})
+		return
+	}
+	if err := driver.checkUserns(container); err != nil {
+		sendJoinError(w, err)
 		return
 	}
 
-	output, err := driver.execPlugin(nw.Type, "ADD", j.SandboxKey, netns, "")
+	netInfo := driver.createdNetwork(j.NetworkID)
+	var labels map[string]string
+	if container.Config != nil {
+		labels = container.Config.Labels
+	}
+	nc, err := driver.joinNetConf(confName, netInfo, labels, driver.endpoints.getOptions(j.EndpointID))
 	if err != nil {
-		sendError(w, fmt.Sprintf("Plugin %s failed the ADD operation: %v", nw.Type, err), http.StatusInternalServerError)
+		sendJoinError(w, err)
+		return
+	}
+	if driver.checkMaster {
+		if err := checkMasterInterfaces(nc); err != nil {
+			sendJoinError(w, err)
+			return
+		}
+	}
+	prealloc := driver.endpoints.getPrealloc(j.EndpointID)
+	if prealloc != nil {
+		nc.setStaticIPAM(prealloc.staticAddresses())
+	}
+
+	cfgArgs, err := driver.joinConfigArgs(netInfo, labels)
+	if err != nil {
+		sendJoinError(w, &statusError{status: http.StatusBadRequest, err: err})
+		return
+	}
+	cniArgs, err := joinCNIArgs(netInfo, labels, driver.endpoints.getOptions(j.EndpointID))
+	if err != nil {
+		sendJoinError(w, &statusError{status: http.StatusBadRequest, err: err})
+		return
+	}
+
+	// A re-join of an endpoint we already attached to this sandbox
+	// reconciles against what the previous ADD set up
+	prev := driver.endpoints.get(j.EndpointID)
+	if prev != nil && prev.Runtime.Netns != netns {
+		prev = nil
+	}
+
+	// The network may be deleted while the plugins run
+	networkKnown := driver.networkKnown(j.NetworkID)
+
+	// Each network the container joins gets its own interface
+	ifIndex := driver.endpoints.reserveIfIndex(container.ID, j.EndpointID)
+	rt := &cniRuntime{
+		ContainerID: container.ID,
+		EndpointID:  j.EndpointID,
+		Netns:       netns,
+		IfName:      fmt.Sprintf("%s%d", driver.ifPrefix, ifIndex),
+		PluginPath:  nc.PluginPath,
+		CapabilityArgs: netInfo.CapabilityArgs,
+		ConfigArgs:  cfgArgs,
+	}
+	nc.expandSysctlIfName(rt.IfName)
+	// The keys we set ourselves go last, so users' cni.cniargs can't
+	// override them
+	rt.Args = cniArgs
+	if driver.k8sArgs {
+		rt.Args = mergeCNIArgs(rt.Args, k8sArgs(container.ID, labels))
+	}
+	if driver.containerNameArg != "" {
+		rt.Args = mergeCNIArgs(rt.Args, [][2]string{{driver.containerNameArg, containerName(container)}})
+	}
+	recorded := driver.endpoints.getIface(j.EndpointID)
+	if recorded != nil && recorded.MacAddress != "" {
+		rt = rt.withCapabilityArg("mac", recorded.MacAddress)
+	}
+	// Until the endpoint is recorded, GC wouldn't know to keep it
+	defer driver.gcLocks.adding(nc.Name)()
+	output, addConfigs, err := driver.addNetwork(nc, rt)
+	if err != nil {
+		driver.endpoints.releaseIfIndex(container.ID, j.EndpointID)
+		sendJoinError(w, wrapf(err, "Network %s", nc.Name))
+		return
+	}
+	log.Printf("Join network %s output: %s", nc.Name, output)
+
+	// Don't leave the plugins holding addresses on a network that is gone
+	if networkKnown && !driver.networkKnown(j.NetworkID) {
+		log.Printf("Network %s was deleted during Join of endpoint %s, undoing ADD", j.NetworkID, j.EndpointID)
+		if err := driver.delNetwork(nc, rt, output, addConfigs); err != nil {
+			log.Printf("Failed to undo ADD of endpoint %s: %v", j.EndpointID, err)
+		}
+		driver.endpoints.releaseIfIndex(container.ID, j.EndpointID)
+		sendJoinError(w, &networkNotFoundError{id: j.NetworkID})
+		return
+	}
+
+	// The attachment exists now, so record it even if we fail below
+	if alias != "" {
+		driver.endpoints.setAlias(j.EndpointID, alias)
+	}
+	ep := &endpoint{
+		ID:        j.EndpointID,
+		NetworkID: j.NetworkID,
+		Conf:      nc,
+		Runtime:   rt,
+		Result:    output,
+		Configs:   addConfigs,
+		MTU:       nc.mtu(),
+	}
+	driver.endpoints.add(ep)
+	if err := driver.cache.write(ep); err != nil {
+		log.Printf("Failed to cache endpoint %s result: %v", j.EndpointID, err)
+	}
+
+	result, err := parseResult(output)
+	if err != nil {
+		sendJoinError(w, fmt.Errorf("Network %s plugin %s returned an invalid result: %v", nc.Name, nc.pluginBinary(len(nc.Plugins)-1), err))
 		return
 	}
-	log.Printf("Join plugin %s output: %s", nw.Type, output)
+
+	res, err := driver.resultJoinResponse(nc, result, j.EndpointID)
+	if err != nil {
+		sendJoinError(w, err)
+		return
+	}
+	checkRecorded(j.EndpointID, nc.Name, recorded, result, netns)
+	if prev != nil {
+		if prevResult, err := parseResult(prev.Result); err == nil {
+			if prevRoutes, err := prevResult.staticRoutes(); err == nil {
+				res.StaticRoutes = routesDelta(res.StaticRoutes, prevRoutes)
+			}
+		}
+		log.Printf("Re-join of endpoint %s returning %d new routes", j.EndpointID, len(res.StaticRoutes))
+	}
+
+	// Host-side interfaces in the result, like veth peers, aren't the
+	// endpoint's; report the one the plugin put in the container
+	srcName := result.containerInterface(netns)
+	if srcName == "" {
+		srcName = rt.IfName
+	}
 
 	ifname := &iface{
-		SrcName:   "blahblah",
-		DstPrefix: "ethwe",
+		SrcName:   srcName,
+		DstPrefix: driver.networkDstPrefix(netInfo),
 		ID:        0,
 	}
 
-	res := &joinResponse{
-		InterfaceNames: []*iface{ifname},
+	// Plugins' DNS settings take precedence over the network's defaults
+	defaultDNS, err := driver.networkDNS(netInfo)
+	if err != nil {
+		sendJoinError(w, wrapf(err, "Network %s", nc.Name))
+		return
+	}
+	var resolvConfPath string
+	if dns := mergeDNS(result.DNS, defaultDNS); !dns.empty() {
+		resolvConfPath, err = driver.writeResolvConf(j.EndpointID, dns)
+		if err != nil {
+			sendJoinError(w, wrapf(err, "Failed to write endpoint %s resolv.conf", j.EndpointID))
+			return
+		}
 	}
 
+	var hostsPath string
+	if withHosts, _ := boolOption(netInfo.Options, hostsOption); withHosts && container.Config != nil && container.Config.Hostname != "" {
+		hostsPath, err = driver.writeHosts(j.EndpointID, container, result.addresses())
+		if err != nil {
+			sendJoinError(w, wrapf(err, "Failed to write endpoint %s hosts", j.EndpointID))
+			return
+		}
+	}
+
+	res.HostsPath = hostsPath
+	res.ResolvConfPath = resolvConfPath
+	res.InterfaceNames = []*iface{ifname}
+	// Keep Docker from giving the container a way out either
+	res.DisableGatewayService = netInfo.Internal
+	applyNetworkGateways(res, nc.Name, netInfo)
+
 	objectResponse(w, res)
-	log.Printf("Join endpoint %s:%s to %s", j.NetworkID, j.EndpointID, j.SandboxKey)
+	driver.hook.run(&hookEvent{
+		Event:       hookJoin,
+		NetworkID:   j.NetworkID,
+		EndpointID:  j.EndpointID,
+		ContainerID: container.ID,
+		Netns:       netns,
+		IfName:      srcName,
+		Addresses:   result.addresses(),
+	})
+	log.Printf("Join endpoint %s:%s to %s (container %s %s)", j.NetworkID, j.EndpointID, j.SandboxKey, container.ID, describeContainerLabels(container))
 }
 
 type leave struct {
@@ -408,9 +1254,51 @@ func (driver *driver) leaveEndpoint(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	log.Printf("Leave request: %+v", &l)
+	defer driver.endpoints.lock(l.EndpointID)()
+
+	if ownerID := driver.endpoints.removeShared(l.EndpointID); ownerID != "" {
+		log.Printf("Leave %s:%s, which shared endpoint %s; leaving it in place", l.NetworkID, l.EndpointID, ownerID)
+		emptyResponse(w)
+		return
+	}
+
+	ep := driver.endpoints.get(l.EndpointID)
+	if ep == nil {
+		log.Printf("Leave for unknown endpoint %s", l.EndpointID)
+		emptyResponse(w)
+		return
+	}
+
+	if driver.deleter != nil {
+		driver.endpoints.remove(l.EndpointID)
+		driver.deleter.enqueue(ep)
+	} else {
+		if err := driver.delEndpoint(ep); err != nil {
+			sendError(w, fmt.Sprintf("Failed to delete endpoint %s: %v", l.EndpointID, err), http.StatusInternalServerError)
+			return
+		}
+		driver.endpoints.remove(l.EndpointID)
+	}
+	driver.removeResolvConf(l.EndpointID)
+	driver.removeHosts(l.EndpointID)
 
 	emptyResponse(w)
-	log.Printf("Leave %s:%s", l.NetworkID, l.EndpointID)
+	ev := &hookEvent{
+		Event:       hookLeave,
+		NetworkID:   l.NetworkID,
+		EndpointID:  l.EndpointID,
+		ContainerID: ep.Runtime.ContainerID,
+		Netns:       ep.Runtime.Netns,
+		IfName:      ep.Runtime.IfName,
+	}
+	if result, err := parseResult(ep.Result); err == nil {
+		ev.Addresses = result.addresses()
+		if name := result.containerInterface(ep.Runtime.Netns); name != "" {
+			ev.IfName = name
+		}
+	}
+	driver.hook.run(ev)
+	log.Printf("Leave %s:%s (container %s)", l.NetworkID, l.EndpointID, driver.describeContainer(ep.Runtime.ContainerID))
 }
 
 // ===
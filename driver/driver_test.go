@@ -0,0 +1,106 @@
+package driver
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// endpointOperInfo asks the driver for an endpoint's info as Docker does
+func endpointOperInfo(t *testing.T, d *driver, endpointID string) map[string]interface{} {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/NetworkDriver.EndpointOperInfo", strings.NewReader(`{"NetworkID": "n1", "EndpointID": "`+endpointID+`"}`))
+	d.infoEndpoint(w, r)
+	if w.Code != 200 {
+		t.Fatalf("EndpointOperInfo status %d: %s", w.Code, w.Body)
+	}
+	var info endpointInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &info); err != nil {
+		t.Fatalf("EndpointOperInfo returned invalid JSON %q: %v", w.Body, err)
+	}
+	if info.Value == nil {
+		t.Fatalf("EndpointOperInfo returned no Value: %s", w.Body)
+	}
+	return info.Value
+}
+
+func TestInfoEndpointLifecycle(t *testing.T) {
+	prealloc, err := parseResult([]byte(`{"cniVersion": "0.4.0", "ips": [{"version": "4", "address": "10.0.0.2/24"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	joined := &endpoint{
+		ID:      "ep1",
+		Runtime: &cniRuntime{ContainerID: "c1", IfName: "eth1", Netns: "/var/run/docker/netns/abc"},
+		Result: []byte(`{"cniVersion": "0.4.0",
+			"interfaces": [{"name": "eth1", "mac": "0a:58:0a:00:00:02", "sandbox": "/var/run/docker/netns/abc"}],
+			"ips": [{"version": "4", "interface": 0, "address": "10.0.0.2/24"}]}`),
+		MTU: 1400,
+	}
+
+	tests := []struct {
+		name   string
+		update func(e *endpoints)
+		want   map[string]interface{}
+	}{
+		{
+			name:   "before CreateEndpoint",
+			update: func(e *endpoints) {},
+			want:   map[string]interface{}{},
+		},
+		{
+			name: "after CreateEndpoint",
+			update: func(e *endpoints) {
+				e.setAlias("ep1", "data")
+				e.setPrealloc("ep1", &preallocation{Result: prealloc})
+			},
+			want: map[string]interface{}{
+				aliasOption:      "data",
+				infoAddressesKey: []interface{}{"10.0.0.2/24"},
+			},
+		},
+		{
+			name:   "after Join",
+			update: func(e *endpoints) { e.add(joined) },
+			want: map[string]interface{}{
+				aliasOption:      "data",
+				mtuOption:        float64(1400),
+				infoIfNameKey:    "eth1",
+				infoMacKey:       "0a:58:0a:00:00:02",
+				infoAddressesKey: []interface{}{"10.0.0.2/24"},
+			},
+		},
+		{
+			name: "after Leave and DeleteEndpoint",
+			update: func(e *endpoints) {
+				e.remove("ep1")
+				e.removePrealloc("ep1")
+				e.removeAlias("ep1")
+			},
+			want: map[string]interface{}{},
+		},
+	}
+
+	d := &driver{endpoints: newEndpoints()}
+	for _, tt := range tests {
+		tt.update(d.endpoints)
+		if got := endpointOperInfo(t, d, "ep1"); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: EndpointOperInfo = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	// Joining without CreateEndpoint's preallocation reports the same
+	d = &driver{endpoints: newEndpoints()}
+	d.endpoints.add(joined)
+	want := map[string]interface{}{
+		mtuOption:        float64(1400),
+		infoIfNameKey:    "eth1",
+		infoMacKey:       "0a:58:0a:00:00:02",
+		infoAddressesKey: []interface{}{"10.0.0.2/24"},
+	}
+	if got := endpointOperInfo(t, d, "ep1"); !reflect.DeepEqual(got, want) {
+		t.Errorf("joined without preallocation: EndpointOperInfo = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,107 @@
+package driver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// parseKeyValues parses "key=value" strings into a map
+func parseKeyValues(what string, specs []string) (map[string]string, error) {
+	kvs := make(map[string]string)
+	for _, spec := range specs {
+		parts := strings.SplitN(spec, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid %s %q, expected key=value", what, spec)
+		}
+		kvs[parts[0]] = parts[1]
+	}
+	return kvs, nil
+}
+
+// DumpConfig writes the config each plugin would be given on stdin for ADD
+// when a container with the given labels joins the named network, created
+// with the given driver options, without running any plugin or talking to
+// Docker.  It builds them as Join does, except that the network's IPAM
+// pools, the container's runtime details and each plugin's prevResult are
+// only known at Join, so are left out.
+func DumpConfig(opts *Options, name string, options []string, labels []string, w io.Writer) error {
+	offline := *opts
+	offline.NoWatch = true
+	offline.WaitForDocker = 0
+	offline.HealthInterval = 0
+	offline.AuditLog = ""
+	offline.ExecHook = ""
+	offline.AsyncDel = false
+	offline.CNICacheDir = ""
+	d, err := New(&offline)
+	if err != nil {
+		return err
+	}
+	driver := d.(*driver)
+
+	nwOptions, err := parseKeyValues("network option", options)
+	if err != nil {
+		return err
+	}
+	containerLabels, err := parseKeyValues("container label", labels)
+	if err != nil {
+		return err
+	}
+	capabilityArgs, err := networkCapabilityArgs(nwOptions)
+	if err != nil {
+		return err
+	}
+	rawFields, err := networkRawFields(nwOptions)
+	if err != nil {
+		return err
+	}
+	sysctls, err := networkSysctls(nwOptions)
+	if err != nil {
+		return err
+	}
+	nw := &network{
+		ID:             name,
+		Options:        nwOptions,
+		CapabilityArgs: capabilityArgs,
+		RawFields:      rawFields,
+		Sysctls:        sysctls,
+	}
+
+	confName := nwOptions[confNameOption]
+	if entry, ok := driver.networkMap[name]; confName == "" && ok {
+		confName = entry.Conf
+	}
+	if confName == "" {
+		confName = name
+	}
+	nc, err := driver.joinNetConf(confName, nw, containerLabels, nil)
+	if err != nil {
+		return err
+	}
+	cfgArgs, err := driver.joinConfigArgs(nw, containerLabels)
+	if err != nil {
+		return err
+	}
+	rt := &cniRuntime{
+		PluginPath:     nc.PluginPath,
+		CapabilityArgs: nw.CapabilityArgs,
+		ConfigArgs:     cfgArgs,
+	}
+
+	configs := make([]json.RawMessage, len(nc.Plugins))
+	for i := range nc.Plugins {
+		config, err := nc.pluginConfig(i, nil, rt)
+		if err != nil {
+			return err
+		}
+		configs[i] = config
+	}
+	out, err := json.MarshalIndent(configs, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", out)
+	return err
+}
@@ -0,0 +1,454 @@
+package driver
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// libnetwork's label for an interface MTU
+	mtuOption = "com.docker.network.driver.mtu"
+
+	// CreateEndpoint options under this prefix, such as exposed ports and
+	// swarm service VIPs, are kept and reported by EndpointOperInfo
+	endpointOptionPrefix = "com.docker.network.endpoint."
+
+	// Linux interface names are at most IFNAMSIZ-1 characters
+	maxIfNameLen = 15
+	// room left after the prefix for an endpoint's interface index
+	ifIndexLen = 2
+
+	// the network option overriding the prefix libnetwork renames the
+	// network's container interfaces to; see Options.DstPrefix
+	dstPrefixOption = "cni.dstprefix"
+)
+
+// validateIfPrefix checks that prefix plus an interface index makes a legal
+// interface name
+func validateIfPrefix(prefix string) error {
+	if prefix == "" {
+		return fmt.Errorf("interface name prefix may not be empty")
+	}
+	if len(prefix)+ifIndexLen > maxIfNameLen {
+		return fmt.Errorf("interface name prefix %q is longer than %d characters", prefix, maxIfNameLen-ifIndexLen)
+	}
+	for _, c := range prefix {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return fmt.Errorf("interface name prefix %q contains invalid character %q", prefix, c)
+		}
+	}
+	return nil
+}
+
+// networkDstPrefix returns the prefix of the name libnetwork gives the
+// network's container interfaces: from its options, else its network map
+// entry, else ours
+func (driver *driver) networkDstPrefix(nw *network) string {
+	if prefix := nw.Options[dstPrefixOption]; prefix != "" {
+		return prefix
+	}
+	if entry := driver.networkMapEntry(nw.ID); entry != nil && entry.DstPrefix != "" {
+		return entry.DstPrefix
+	}
+	return driver.dstPrefix
+}
+
+// endpoint records what was used to attach an endpoint at Join time so later
+// operations on it run the plugins with the same context
+type endpoint struct {
+	ID        string
+	NetworkID string
+	Conf      *netConf
+	Runtime   *cniRuntime
+	// raw result of the ADD
+	Result []byte
+	// the config each plugin in the chain was given for ADD
+	Configs [][]byte
+	// published ports set up by ProgramExternalConnectivity
+	PortMappings []portMapping
+	// MTU from the network config or the one we gave the plugins, or 0 if
+	// neither did
+	MTU int
+}
+
+type endpoints struct {
+	sync.Mutex
+	byID map[string]*endpoint
+	// options from CreateEndpoint, kept until DeleteEndpoint
+	options map[string]map[string]interface{}
+	// interface index of each endpoint in a container, by container ID
+	ifIndexes map[string]map[string]int
+	// held while joining or leaving an endpoint
+	locks map[string]*endpointLock
+	// addresses allocated at CreateEndpoint, kept until DeleteEndpoint
+	preallocs map[string]*preallocation
+	// interface aliases from CreateEndpoint or Join, kept until
+	// DeleteEndpoint
+	aliases map[string]string
+	// the interface Docker recorded at CreateEndpoint, kept until
+	// DeleteEndpoint
+	ifaces map[string]*iface
+	// endpoints whose container shares the netns of the container that
+	// joined through another, by the other's ID; see sharedJoinResponse
+	shared map[string]string
+	// the last CHECK of each joined endpoint, kept until it is removed
+	checks map[string]*checkResult
+}
+
+type endpointLock struct {
+	sync.Mutex
+	// how many are holding or waiting for it
+	refs int
+}
+
+func newEndpoints() *endpoints {
+	return &endpoints{
+		byID:      make(map[string]*endpoint),
+		options:   make(map[string]map[string]interface{}),
+		ifIndexes: make(map[string]map[string]int),
+		locks:     make(map[string]*endpointLock),
+		preallocs: make(map[string]*preallocation),
+		aliases:   make(map[string]string),
+		ifaces:    make(map[string]*iface),
+		shared:    make(map[string]string),
+		checks:    make(map[string]*checkResult),
+	}
+}
+
+// lock serializes operations on an endpoint, so a Leave can't run while
+// its Join is still running the plugins; it returns the unlock function.
+// Only the endpoint is locked, not its container, so a container joining
+// several networks at once has their plugins run in parallel, each on the
+// interface reserveIfIndex gave it.
+func (e *endpoints) lock(id string) func() {
+	e.Lock()
+	l, ok := e.locks[id]
+	if !ok {
+		l = &endpointLock{}
+		e.locks[id] = l
+	}
+	l.refs++
+	e.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		e.Lock()
+		defer e.Unlock()
+		if l.refs--; l.refs == 0 {
+			delete(e.locks, id)
+		}
+	}
+}
+
+// reserveIfIndex picks the lowest interface index not used by any of the
+// container's other endpoints, so a container joined to several networks
+// gets a distinct interface for each
+func (e *endpoints) reserveIfIndex(containerID string, endpointID string) int {
+	e.Lock()
+	defer e.Unlock()
+
+	indexes, ok := e.ifIndexes[containerID]
+	if !ok {
+		indexes = make(map[string]int)
+		e.ifIndexes[containerID] = indexes
+	}
+	if index, ok := indexes[endpointID]; ok {
+		return index
+	}
+
+	used := make(map[int]bool)
+	for _, index := range indexes {
+		used[index] = true
+	}
+	index := 0
+	for used[index] {
+		index++
+	}
+	indexes[endpointID] = index
+	return index
+}
+
+func (e *endpoints) releaseIfIndex(containerID string, endpointID string) {
+	e.Lock()
+	defer e.Unlock()
+	e.releaseIfIndexLocked(containerID, endpointID)
+}
+
+func (e *endpoints) releaseIfIndexLocked(containerID string, endpointID string) {
+	indexes, ok := e.ifIndexes[containerID]
+	if !ok {
+		return
+	}
+	delete(indexes, endpointID)
+	if len(indexes) == 0 {
+		delete(e.ifIndexes, containerID)
+	}
+}
+
+func (e *endpoints) add(ep *endpoint) {
+	e.Lock()
+	defer e.Unlock()
+	e.byID[ep.ID] = ep
+	// A re-join's attachment hasn't been checked yet
+	delete(e.checks, ep.ID)
+}
+
+// get returns a copy of the endpoint, or nil if it is unknown
+func (e *endpoints) get(id string) *endpoint {
+	e.Lock()
+	defer e.Unlock()
+	ep, ok := e.byID[id]
+	if !ok {
+		return nil
+	}
+	cp := *ep
+	return &cp
+}
+
+// list returns copies of all the endpoints
+func (e *endpoints) list() []*endpoint {
+	e.Lock()
+	defer e.Unlock()
+	eps := make([]*endpoint, 0, len(e.byID))
+	for _, ep := range e.byID {
+		cp := *ep
+		eps = append(eps, &cp)
+	}
+	return eps
+}
+
+func (e *endpoints) remove(id string) {
+	e.Lock()
+	defer e.Unlock()
+	if ep, ok := e.byID[id]; ok {
+		e.releaseIfIndexLocked(ep.Runtime.ContainerID, id)
+	}
+	delete(e.byID, id)
+	delete(e.checks, id)
+}
+
+// setOptions keeps the endpoint options we report back to Docker, its
+// published ports, which decide whether Join needs a portmap plugin, and
+// its CNI_ARGS
+func (e *endpoints) setOptions(id string, options map[string]interface{}) {
+	kept := make(map[string]interface{})
+	for k, v := range options {
+		if strings.HasPrefix(k, endpointOptionPrefix) || k == portMapOption {
+			kept[k] = v
+		}
+	}
+	if cniArgs, _ := optionCNIArgs(options); cniArgs != "" {
+		kept[cniArgsKey] = cniArgs
+	}
+
+	e.Lock()
+	defer e.Unlock()
+	e.options[id] = kept
+}
+
+func (e *endpoints) getOptions(id string) map[string]interface{} {
+	e.Lock()
+	defer e.Unlock()
+	return e.options[id]
+}
+
+func (e *endpoints) removeOptions(id string) {
+	e.Lock()
+	defer e.Unlock()
+	delete(e.options, id)
+}
+
+func (e *endpoints) setAlias(id string, alias string) {
+	e.Lock()
+	defer e.Unlock()
+	e.aliases[id] = alias
+}
+
+func (e *endpoints) getAlias(id string) string {
+	e.Lock()
+	defer e.Unlock()
+	return e.aliases[id]
+}
+
+func (e *endpoints) removeAlias(id string) {
+	e.Lock()
+	defer e.Unlock()
+	delete(e.aliases, id)
+}
+
+func (e *endpoints) setIface(id string, i *iface) {
+	e.Lock()
+	defer e.Unlock()
+	e.ifaces[id] = i
+}
+
+func (e *endpoints) getIface(id string) *iface {
+	e.Lock()
+	defer e.Unlock()
+	return e.ifaces[id]
+}
+
+func (e *endpoints) removeIface(id string) {
+	e.Lock()
+	defer e.Unlock()
+	delete(e.ifaces, id)
+}
+
+func (e *endpoints) setShared(id string, ownerID string) {
+	e.Lock()
+	defer e.Unlock()
+	e.shared[id] = ownerID
+}
+
+// removeShared returns the ID of the endpoint whose interface id shares, or
+// "" if it isn't sharing one
+func (e *endpoints) removeShared(id string) string {
+	e.Lock()
+	defer e.Unlock()
+	ownerID := e.shared[id]
+	delete(e.shared, id)
+	return ownerID
+}
+
+func (e *endpoints) setCheck(id string, result *checkResult) {
+	e.Lock()
+	defer e.Unlock()
+	if _, ok := e.byID[id]; ok {
+		e.checks[id] = result
+	}
+}
+
+func (e *endpoints) getCheck(id string) *checkResult {
+	e.Lock()
+	defer e.Unlock()
+	return e.checks[id]
+}
+
+func (e *endpoints) setPrealloc(id string, p *preallocation) {
+	e.Lock()
+	defer e.Unlock()
+	e.preallocs[id] = p
+}
+
+func (e *endpoints) getPrealloc(id string) *preallocation {
+	e.Lock()
+	defer e.Unlock()
+	return e.preallocs[id]
+}
+
+// listPreallocs returns all the preallocations
+func (e *endpoints) listPreallocs() []*preallocation {
+	e.Lock()
+	defer e.Unlock()
+	preallocs := make([]*preallocation, 0, len(e.preallocs))
+	for _, p := range e.preallocs {
+		preallocs = append(preallocs, p)
+	}
+	return preallocs
+}
+
+func (e *endpoints) removePrealloc(id string) *preallocation {
+	e.Lock()
+	defer e.Unlock()
+	p := e.preallocs[id]
+	delete(e.preallocs, id)
+	return p
+}
+
+func (e *endpoints) setPortMappings(id string, mappings []portMapping) {
+	e.Lock()
+	defer e.Unlock()
+	if ep, ok := e.byID[id]; ok {
+		ep.PortMappings = mappings
+	}
+}
+
+// endpointMTU returns the endpoint's MTU, reading it from the container's
+// interface if the network config didn't specify one
+func (driver *driver) endpointMTU(ep *endpoint) int {
+	if ep.MTU > 0 {
+		return ep.MTU
+	}
+	if ep.Runtime.IfName == "" {
+		return 0
+	}
+	container := driver.watcher.GetContainer(ep.Runtime.ContainerID)
+	if container == nil {
+		return 0
+	}
+	mtu, err := containerIfaceMTU(container.State.Pid, ep.Runtime.IfName)
+	if err != nil {
+		log.Printf("Failed to read endpoint %s MTU: %v", ep.ID, err)
+		return 0
+	}
+	return mtu
+}
+
+// optionMTU returns the MTU set by a network's mtu option, or 0
+func optionMTU(options map[string]string) (int, error) {
+	value, ok := options[mtuOption]
+	if !ok {
+		return 0, nil
+	}
+	mtu, err := strconv.Atoi(value)
+	if err != nil || mtu < 0 {
+		return 0, fmt.Errorf("invalid %s %q", mtuOption, value)
+	}
+	return mtu, nil
+}
+
+// forcedMTU returns the MTU we must have the plugins set on a network's
+// interfaces because its CNI config doesn't: the network's mtu option, or
+// else the default MTU, or 0 to leave the plugin's choice alone
+func (driver *driver) forcedMTU(nc *netConf, nw *network) int {
+	if nc.mtu() > 0 {
+		return 0
+	}
+	if mtu, _ := optionMTU(nw.Options); mtu > 0 {
+		return mtu
+	}
+	return driver.defaultMTU
+}
+
+// containerIfaceMTU reads an interface's MTU through the container's own
+// view of sysfs, which reflects its network namespace
+func containerIfaceMTU(pid int, ifname string) (int, error) {
+	if pid <= 0 {
+		return 0, fmt.Errorf("container not running")
+	}
+	path := fmt.Sprintf("/proc/%d/root/sys/class/net/%s/mtu", pid, ifname)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(data)))
+}
+
+// delEndpoint runs DEL for the endpoint's chain with the context of its ADD
+func (driver *driver) delEndpoint(ep *endpoint) error {
+	rt := *ep.Runtime
+	if len(ep.PortMappings) > 0 {
+		rt = *rt.withCapabilityArg(portMappingsCapability, ep.PortMappings)
+	}
+	// A container that exited before leaving takes its netns with it.  DEL
+	// must still run to release its addresses, and CNI allows an empty
+	// CNI_NETNS for that rather than a path that no longer exists.
+	if rt.Netns != "" {
+		if err := checkNetns(rt.Netns); err != nil {
+			log.Printf("Deleting endpoint %s without a netns: %v", ep.ID, err)
+			rt.Netns = ""
+		}
+	}
+	if err := driver.delNetwork(ep.Conf, &rt, ep.Result, ep.Configs); err != nil {
+		return err
+	}
+	if err := driver.cache.remove(ep); err != nil {
+		log.Printf("Failed to remove endpoint %s cached result: %v", ep.ID, err)
+	}
+	return nil
+}
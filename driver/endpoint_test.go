@@ -0,0 +1,283 @@
+package driver
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	docker "github.com/dcbw/go-dockerclient"
+)
+
+func TestValidateIfPrefix(t *testing.T) {
+	tests := []struct {
+		prefix  string
+		wantErr bool
+	}{
+		{prefix: "eth"},
+		{prefix: "net-1_a"},
+		{prefix: "abcdefghijklm"},
+		{prefix: "", wantErr: true},
+		{prefix: "abcdefghijklmn", wantErr: true},
+		{prefix: "eth.", wantErr: true},
+		{prefix: "eth/", wantErr: true},
+		{prefix: "et h", wantErr: true},
+		{prefix: "ethé", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		if err := validateIfPrefix(tt.prefix); (err != nil) != tt.wantErr {
+			t.Errorf("validateIfPrefix(%q) error = %v, want error %v", tt.prefix, err, tt.wantErr)
+		}
+	}
+}
+
+func TestNetworkDstPrefix(t *testing.T) {
+	d := &driver{
+		dstPrefix: "eth",
+		networkMap: map[string]*networkMapEntry{
+			"id1":   {DstPrefix: "byid"},
+			"named": {DstPrefix: "byname"},
+		},
+		watcher: &watcher{networks: map[string]*docker.Network{
+			"id2": {ID: "id2", Name: "named"},
+		}},
+	}
+	tests := []struct {
+		id      string
+		options map[string]string
+		want    string
+	}{
+		{id: "id0", options: map[string]string{}, want: "eth"},
+		{id: "id0", options: map[string]string{dstPrefixOption: ""}, want: "eth"},
+		{id: "id0", options: map[string]string{dstPrefixOption: "cni"}, want: "cni"},
+		{id: "id1", options: map[string]string{}, want: "byid"},
+		{id: "id1", options: map[string]string{dstPrefixOption: "cni"}, want: "cni"},
+		{id: "id2", options: map[string]string{}, want: "byname"},
+	}
+
+	for _, tt := range tests {
+		nw := &network{ID: tt.id, Options: tt.options}
+		if got := d.networkDstPrefix(nw); got != tt.want {
+			t.Errorf("networkDstPrefix(%s, %v) = %q, want %q", tt.id, tt.options, got, tt.want)
+		}
+	}
+}
+
+func TestDelEndpointWithoutNetns(t *testing.T) {
+	dir, err := ioutil.TempDir("", "plugins")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// Records what it was run with, and fails like plugins given a
+	// netns that doesn't exist
+	writePlugin(t, dir, "rec", `echo "$CNI_COMMAND netns=$CNI_NETNS" >> "$(dirname "$0")/calls"
+if [ -n "$CNI_NETNS" ] && [ ! -e "$CNI_NETNS" ]; then
+	echo '{"code": 11, "msg": "netns not found"}'
+	exit 1
+fi
+`)
+
+	d := &driver{plugpath: dir, latency: newPluginLatency()}
+	ep := &endpoint{
+		ID: "ep1",
+		Conf: &netConf{Name: "net", CNIVersion: "0.4.0", Plugins: []map[string]interface{}{
+			{"type": "rec", "ipam": map[string]interface{}{"type": "host-local"}},
+		}},
+		// the container died before Leave, taking its netns with it
+		Runtime: &cniRuntime{ContainerID: "c1", IfName: "eth0", Netns: filepath.Join(dir, "gone")},
+		Result:  []byte(`{"cniVersion": "0.4.0", "ips": [{"version": "4", "address": "10.0.0.2/24"}]}`),
+	}
+	if err := d.delEndpoint(ep); err != nil {
+		t.Fatalf("delEndpoint() error = %v", err)
+	}
+
+	calls, err := ioutil.ReadFile(filepath.Join(dir, "calls"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(calls) != "DEL netns=\n" {
+		t.Errorf("plugin calls = %q, want one DEL without a netns", calls)
+	}
+	if ep.Runtime.Netns == "" {
+		t.Errorf("delEndpoint() cleared the endpoint's recorded netns")
+	}
+}
+
+func TestConcurrentJoins(t *testing.T) {
+	dir, err := ioutil.TempDir("", "plugins")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// Only succeeds once both Joins are running it
+	writePlugin(t, dir, "pair", `dir=$(dirname "$0")
+touch "$dir/$CNI_IFNAME.started"
+for i in $(seq 50); do
+	[ $(ls "$dir" | grep -c '\.started$') -ge 2 ] && exec echo '{"cniVersion": "0.4.0"}'
+	sleep 0.1
+done
+echo '{"code": 100, "msg": "the other Join never ran"}'
+exit 1
+`)
+
+	d := &driver{plugpath: dir, ifPrefix: "eth", endpoints: newEndpoints(), breaker: newBreaker(0, 0, 0), latency: newPluginLatency()}
+	join := func(networkName string, endpointID string, ifnames chan<- string, errs chan<- error) {
+		defer d.endpoints.lock(endpointID)()
+		ifIndex := d.endpoints.reserveIfIndex("c1", endpointID)
+		rt := &cniRuntime{ContainerID: "c1", EndpointID: endpointID, IfName: fmt.Sprintf("%s%d", d.ifPrefix, ifIndex)}
+		nc := &netConf{Name: networkName, CNIVersion: "0.4.0", Plugins: []map[string]interface{}{{"type": "pair"}}}
+		_, _, err := d.addNetwork(nc, rt)
+		ifnames <- rt.IfName
+		errs <- err
+	}
+
+	ifnames := make(chan string, 2)
+	errs := make(chan error, 2)
+	go join("cni-a", "ep-a", ifnames, errs)
+	go join("cni-b", "ep-b", ifnames, errs)
+
+	seen := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("Join error = %v; did the Joins run one at a time?", err)
+		}
+		ifname := <-ifnames
+		if seen[ifname] {
+			t.Errorf("both Joins used interface %s", ifname)
+		}
+		seen[ifname] = true
+	}
+	if !seen["eth0"] || !seen["eth1"] {
+		t.Errorf("Joins used interfaces %v, want eth0 and eth1", seen)
+	}
+}
+
+func TestEndpointLock(t *testing.T) {
+	e := newEndpoints()
+	unlock := e.lock("ep1")
+
+	// Another endpoint isn't held up
+	done := make(chan struct{})
+	go func() {
+		e.lock("ep2")()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("locking ep2 waited for ep1")
+	}
+
+	// The same endpoint is
+	locked := make(chan struct{})
+	go func() {
+		e.lock("ep1")()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		t.Fatal("ep1 was locked twice")
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlock()
+	<-locked
+
+	if len(e.locks) != 0 {
+		t.Errorf("%d endpoint locks left after unlocking", len(e.locks))
+	}
+}
+
+func TestReserveIfIndex(t *testing.T) {
+	e := newEndpoints()
+	steps := []struct {
+		op        string
+		container string
+		endpoint  string
+		want      int
+	}{
+		{op: "reserve", container: "c1", endpoint: "ep-a", want: 0},
+		{op: "reserve", container: "c1", endpoint: "ep-b", want: 1},
+		// a re-join keeps its interface
+		{op: "reserve", container: "c1", endpoint: "ep-a", want: 0},
+		// other containers count from 0
+		{op: "reserve", container: "c2", endpoint: "ep-c", want: 0},
+		{op: "release", container: "c1", endpoint: "ep-a"},
+		// the lowest free index is reused
+		{op: "reserve", container: "c1", endpoint: "ep-d", want: 0},
+		{op: "reserve", container: "c1", endpoint: "ep-e", want: 2},
+	}
+
+	for i, step := range steps {
+		if step.op == "release" {
+			e.releaseIfIndex(step.container, step.endpoint)
+			continue
+		}
+		if got := e.reserveIfIndex(step.container, step.endpoint); got != step.want {
+			t.Errorf("step %d: reserveIfIndex(%s, %s) = %d, want %d", i, step.container, step.endpoint, got, step.want)
+		}
+	}
+
+	for _, id := range []string{"ep-b", "ep-d", "ep-e"} {
+		e.releaseIfIndex("c1", id)
+	}
+	if _, ok := e.ifIndexes["c1"]; ok {
+		t.Errorf("container c1 still has interface indexes after releasing them all")
+	}
+}
+
+func TestJoinNetConfPerNetwork(t *testing.T) {
+	dir, err := ioutil.TempDir("", "netconf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for name, plugin := range map[string]string{"cni-a": "bridge", "cni-b": "macvlan"} {
+		data := fmt.Sprintf(`{"cniVersion": "0.4.0", "name": %q, "plugins": [{"type": %q}]}`, name, plugin)
+		if err := ioutil.WriteFile(filepath.Join(dir, name+".conflist"), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		writePlugin(t, dir, plugin, "")
+	}
+
+	d := &driver{
+		netconfpath: dir,
+		plugpath:    dir,
+		networks:    newNetworks(),
+		endpoints:   newEndpoints(),
+		watcher: &watcher{networks: map[string]*docker.Network{
+			"id-a": {ID: "id-a", Name: "cni-a"},
+			"id-b": {ID: "id-b", Name: "cni-b"},
+		}},
+	}
+
+	// One container joins both networks
+	tests := []struct {
+		networkID string
+		endpoint  string
+		plugin    string
+		ifname    string
+	}{
+		{networkID: "id-a", endpoint: "ep-a", plugin: "bridge", ifname: "eth0"},
+		{networkID: "id-b", endpoint: "ep-b", plugin: "macvlan", ifname: "eth1"},
+	}
+	for _, tt := range tests {
+		confName, err := d.networkConfName(tt.networkID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nc, err := d.joinNetConf(confName, d.createdNetwork(tt.networkID), nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := nc.pluginBinary(0); got != tt.plugin {
+			t.Errorf("network %s runs plugin %s, want %s", tt.networkID, got, tt.plugin)
+		}
+		if got := fmt.Sprintf("eth%d", d.endpoints.reserveIfIndex("c1", tt.endpoint)); got != tt.ifname {
+			t.Errorf("network %s interface %s, want %s", tt.networkID, got, tt.ifname)
+		}
+	}
+}
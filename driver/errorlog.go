@@ -0,0 +1,159 @@
+package driver
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How much of a failed response we keep to find its error in
+const maxErrorResponse = 64 << 10
+
+// recentErrors keeps the last failed requests and plugin executions, for
+// /debug/errors, so an operator can see what went wrong lately without
+// trawling the logs
+type recentErrors struct {
+	sync.Mutex
+	records []*errorRecord
+	size    int
+	// index of the oldest record, once there are size of them
+	next int
+}
+
+type errorRecord struct {
+	Time        time.Time
+	Operation   string
+	NetworkID   string `json:",omitempty"`
+	EndpointID  string `json:",omitempty"`
+	ContainerID string `json:",omitempty"`
+	Plugin      string `json:",omitempty"`
+	Error       string
+}
+
+// newRecentErrors returns a buffer of the last size errors, or nil if size
+// isn't positive
+func newRecentErrors(size int) *recentErrors {
+	if size <= 0 {
+		return nil
+	}
+	return &recentErrors{size: size}
+}
+
+// record adds an error, dropping the oldest if the buffer is full; it is a
+// no-op when errors aren't kept
+func (e *recentErrors) record(rec *errorRecord) {
+	if e == nil {
+		return
+	}
+	rec.Time = time.Now().UTC()
+
+	e.Lock()
+	defer e.Unlock()
+	if len(e.records) < e.size {
+		e.records = append(e.records, rec)
+		return
+	}
+	e.records[e.next] = rec
+	e.next = (e.next + 1) % e.size
+}
+
+// list returns the errors, oldest first
+func (e *recentErrors) list() []*errorRecord {
+	if e == nil {
+		return []*errorRecord{}
+	}
+	e.Lock()
+	defer e.Unlock()
+	return append(append([]*errorRecord{}, e.records[e.next:]...), e.records[:e.next]...)
+}
+
+// failureWriter captures the status and start of a response, to tell if
+// the request failed
+type failureWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (fw *failureWriter) WriteHeader(status int) {
+	fw.status = status
+	fw.ResponseWriter.WriteHeader(status)
+}
+
+func (fw *failureWriter) Write(p []byte) (int, error) {
+	if room := maxErrorResponse - fw.body.Len(); room > 0 {
+		if len(p) < room {
+			room = len(p)
+		}
+		fw.body.Write(p[:room])
+	}
+	return fw.ResponseWriter.Write(p)
+}
+
+// failure returns the error the response carries, either as an HTTP error
+// or in the Err field libnetwork reads, or "" if the request succeeded
+func (fw *failureWriter) failure() string {
+	if fw.status >= http.StatusBadRequest {
+		return strings.TrimSpace(fw.body.String())
+	}
+	var resp struct {
+		Err string
+	}
+	if json.Unmarshal(fw.body.Bytes(), &resp) == nil {
+		return resp.Err
+	}
+	return ""
+}
+
+// recordFailures records the requests for method that h fails, with the
+// network and endpoint they were for
+func (driver *driver) recordFailures(method string, h http.Handler) http.Handler {
+	if driver.errors == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			sendError(w, "Failed to read request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		fw := &failureWriter{ResponseWriter: w}
+		h.ServeHTTP(fw, r)
+		msg := fw.failure()
+		if msg == "" {
+			return
+		}
+		var req struct {
+			NetworkID  string
+			EndpointID string
+		}
+		json.Unmarshal(body, &req)
+		driver.errors.record(&errorRecord{
+			Operation:  method,
+			NetworkID:  req.NetworkID,
+			EndpointID: req.EndpointID,
+			Error:      msg,
+		})
+	})
+}
+
+// recordExecError records a failed plugin execution
+func (driver *driver) recordExecError(plugin string, cmd string, rt *cniRuntime, err error) {
+	driver.errors.record(&errorRecord{
+		Operation:   "exec " + cmd,
+		ContainerID: rt.ContainerID,
+		Plugin:      plugin,
+		Error:       err.Error(),
+	})
+}
+
+// debugErrors serves the recent errors, oldest first
+func (driver *driver) debugErrors(w http.ResponseWriter, r *http.Request) {
+	objectResponse(w, driver.errors.list())
+}
@@ -0,0 +1,113 @@
+package driver
+
+import (
+	"sync"
+
+	docker "github.com/dcbw/go-dockerclient"
+)
+
+// eventQueue hands Docker events to a bounded pool of workers, so a storm
+// of container starts doesn't inspect each container in turn while the
+// event stream backs up.  Events are queued by container: while one is
+// waiting, a newer event of the same kind for the same container replaces
+// it, since handling an event inspects the container's current state
+// anyway.  Events of different kinds aren't merged, as they aren't handled
+// alike; a network disconnect, say, only refreshes containers we already
+// track, so it mustn't swallow the start before it.  A container's events
+// are handled in order and never by two workers at once.
+type eventQueue struct {
+	sync.Mutex
+	cond *sync.Cond
+	// unhandled events of each container, oldest first, at most one of
+	// each eventKind
+	pending map[string][]*docker.APIEvents
+	// containers with pending events that no worker is handling, oldest
+	// first
+	ready []string
+	// containers whose events a worker is handling
+	busy map[string]bool
+}
+
+func newEventQueue() *eventQueue {
+	q := &eventQueue{
+		pending: make(map[string][]*docker.APIEvents),
+		busy:    make(map[string]bool),
+	}
+	q.cond = sync.NewCond(q)
+	return q
+}
+
+// eventKind is what events must share to be coalesced, eg "container
+// start" or "network disconnect"
+func eventKind(event *docker.APIEvents) string {
+	action := event.Action
+	if action == "" {
+		action = event.Status
+	}
+	return event.Type + " " + action
+}
+
+func (q *eventQueue) push(id string, event *docker.APIEvents) {
+	q.Lock()
+	defer q.Unlock()
+	events, ok := q.pending[id]
+	if !ok && !q.busy[id] {
+		q.ready = append(q.ready, id)
+		q.cond.Signal()
+	}
+	// The newer event goes last, after any of other kinds that came
+	// before it, so a start, die, start is handled as die, start
+	kind := eventKind(event)
+	for i, old := range events {
+		if eventKind(old) == kind {
+			debugf("Coalescing container %s %s events", id, kind)
+			events = append(events[:i], events[i+1:]...)
+			break
+		}
+	}
+	q.pending[id] = append(events, event)
+}
+
+// pop waits for a container with pending events and returns them, oldest
+// first; the caller must call done once it has handled them
+func (q *eventQueue) pop() (string, []*docker.APIEvents) {
+	q.Lock()
+	defer q.Unlock()
+	for len(q.ready) == 0 {
+		q.cond.Wait()
+	}
+	id := q.ready[0]
+	q.ready = q.ready[1:]
+	events := q.pending[id]
+	delete(q.pending, id)
+	q.busy[id] = true
+	return id, events
+}
+
+func (q *eventQueue) done(id string) {
+	q.Lock()
+	defer q.Unlock()
+	delete(q.busy, id)
+	if _, ok := q.pending[id]; ok {
+		q.ready = append(q.ready, id)
+		q.cond.Signal()
+	}
+}
+
+// run handles queued events with workers goroutines, forever
+func (q *eventQueue) run(workers int, handle func(*docker.APIEvents)) {
+	if workers < 1 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		go func() {
+			for {
+				id, events := q.pop()
+				for _, event := range events {
+					handle(event)
+				}
+				q.done(id)
+			}
+		}()
+	}
+}
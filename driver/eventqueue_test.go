@@ -0,0 +1,104 @@
+package driver
+
+import (
+	"reflect"
+	"testing"
+
+	docker "github.com/dcbw/go-dockerclient"
+)
+
+func containerEvent(id string, action string) *docker.APIEvents {
+	return &docker.APIEvents{Type: "container", Action: action, Status: action, ID: id}
+}
+
+func networkEvent(container string, action string) *docker.APIEvents {
+	return &docker.APIEvents{
+		Type:   "network",
+		Action: action,
+		Actor:  docker.APIActor{ID: "net", Attributes: map[string]string{"container": container}},
+	}
+}
+
+func TestEventQueueCoalescing(t *testing.T) {
+	tests := []struct {
+		name   string
+		events []*docker.APIEvents
+		want   []string
+	}{
+		{
+			name:   "same kind replaced",
+			events: []*docker.APIEvents{containerEvent("c", "start"), containerEvent("c", "start")},
+			want:   []string{"container start"},
+		},
+		{
+			name:   "different kinds kept in order",
+			events: []*docker.APIEvents{containerEvent("c", "start"), networkEvent("c", "disconnect")},
+			want:   []string{"container start", "network disconnect"},
+		},
+		{
+			name: "replacement moves last",
+			events: []*docker.APIEvents{
+				containerEvent("c", "start"),
+				containerEvent("c", "die"),
+				containerEvent("c", "start"),
+			},
+			want: []string{"container die", "container start"},
+		},
+		{
+			name: "connect and disconnect kept apart",
+			events: []*docker.APIEvents{
+				networkEvent("c", "connect"),
+				networkEvent("c", "disconnect"),
+				networkEvent("c", "connect"),
+			},
+			want: []string{"network disconnect", "network connect"},
+		},
+	}
+
+	for _, tt := range tests {
+		q := newEventQueue()
+		for _, event := range tt.events {
+			q.push("c", event)
+		}
+		id, events := q.pop()
+		if id != "c" {
+			t.Errorf("%s: popped container %s", tt.name, id)
+		}
+		var got []string
+		for _, event := range events {
+			got = append(got, eventKind(event))
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: popped %v, want %v", tt.name, got, tt.want)
+		}
+		q.done(id)
+		if len(q.ready) != 0 || len(q.pending) != 0 {
+			t.Errorf("%s: events left after pop: %v", tt.name, q.ready)
+		}
+	}
+}
+
+func TestEventQueueBusy(t *testing.T) {
+	q := newEventQueue()
+	q.push("a", containerEvent("a", "start"))
+	q.push("b", containerEvent("b", "start"))
+
+	id, _ := q.pop()
+	if id != "a" {
+		t.Fatalf("popped %s first, want a", id)
+	}
+	// Not handed to another worker while a is being handled
+	q.push("a", containerEvent("a", "die"))
+	if id, _ := q.pop(); id != "b" {
+		t.Fatalf("popped %s while a was busy, want b", id)
+	}
+	if len(q.ready) != 0 {
+		t.Fatalf("ready %v while a is busy", q.ready)
+	}
+
+	q.done("a")
+	id, events := q.pop()
+	if id != "a" || len(events) != 1 || eventKind(events[0]) != "container die" {
+		t.Errorf("popped %s %v after done, want a's die", id, events)
+	}
+}
@@ -0,0 +1,61 @@
+package driver
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// parseFallbackPlugins parses "capability=plugin" strings, naming the plugin
+// to append to chains that lack the capability when a Join needs it
+func parseFallbackPlugins(specs []string) (map[string]string, error) {
+	fallbacks := make(map[string]string)
+	for _, spec := range specs {
+		parts := strings.SplitN(spec, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid fallback plugin %q, expected capability=plugin", spec)
+		}
+		fallbacks[parts[0]] = parts[1]
+	}
+	return fallbacks, nil
+}
+
+// requestedCapabilities returns the capabilities a Join needs of the
+// chain: portMappings if Docker gave the endpoint published ports, and any
+// the network passes capability arguments for
+func requestedCapabilities(nw *network, endpointOptions map[string]interface{}) []string {
+	var caps []string
+	if ports, ok := endpointOptions[portMapOption].([]interface{}); ok && len(ports) > 0 {
+		caps = append(caps, portMappingsCapability)
+	}
+	for capability := range nw.CapabilityArgs {
+		caps = append(caps, capability)
+	}
+	return caps
+}
+
+// appendFallbackPlugins appends the configured fallback plugin for each
+// requested capability no plugin in the chain declares, so that base
+// configs can leave out plugins like portmap and bandwidth
+func (driver *driver) appendFallbackPlugins(nc *netConf, capabilities []string) error {
+	for _, capability := range capabilities {
+		plugin, ok := driver.fallbackPlugins[capability]
+		if !ok || len(nc.capabilityPlugins(capability)) > 0 {
+			continue
+		}
+		path := nc.PluginPath
+		if path == "" {
+			path = driver.plugpath
+		}
+		if _, err := findPlugin(plugin, path); err != nil {
+			return fmt.Errorf("fallback plugin for %s: %v", capability, err)
+		}
+		log.Printf("Network %s has no plugin with the %s capability, appending %s", nc.Name, capability, plugin)
+		nc.Plugins = append(nc.Plugins, map[string]interface{}{
+			"type":         plugin,
+			"capabilities": map[string]interface{}{capability: true},
+		})
+		nc.Binaries = append(nc.Binaries, plugin)
+	}
+	return nil
+}
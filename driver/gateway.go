@@ -0,0 +1,59 @@
+package driver
+
+import (
+	"fmt"
+	"log"
+	"net"
+)
+
+// Network options forcing the gateways a Join returns, whatever the plugins
+// say, to route containers' egress through somewhere else; their other
+// routes are kept
+const (
+	gatewayOption     = "cni.gateway"
+	gatewayIPv6Option = "cni.gateway6"
+)
+
+// optionGateways returns the network's gateway overrides, "" for a family
+// without one
+func optionGateways(options map[string]string) (string, string, error) {
+	gw4, gw6 := options[gatewayOption], options[gatewayIPv6Option]
+	if gw4 != "" {
+		if ip := net.ParseIP(gw4); ip == nil || ip.To4() == nil {
+			return "", "", fmt.Errorf("%s option %q is not an IPv4 address", gatewayOption, gw4)
+		}
+	}
+	if gw6 != "" {
+		if ip := net.ParseIP(gw6); ip == nil || ip.To4() != nil {
+			return "", "", fmt.Errorf("%s option %q is not an IPv6 address", gatewayIPv6Option, gw6)
+		}
+	}
+	return gw4, gw6, nil
+}
+
+// overrideGateway returns the override for a gateway, if any, logging when
+// it replaces the plugins' gateway
+func overrideGateway(network string, gateway string, override string) string {
+	if override == "" {
+		return gateway
+	}
+	if gateway != "" && gateway != override {
+		log.Printf("Network %s gateway %s overridden with %s", network, gateway, override)
+	}
+	return override
+}
+
+// applyNetworkGateways applies the network's gateway options to a Join
+// response, and takes away the gateways and default routes of internal
+// networks
+func applyNetworkGateways(res *joinResponse, netName string, nw *network) {
+	// Validated at CreateNetwork
+	gw4, gw6, _ := optionGateways(nw.Options)
+	res.Gateway = overrideGateway(netName, res.Gateway, gw4)
+	res.GatewayIPv6 = overrideGateway(netName, res.GatewayIPv6, gw6)
+	if nw.Internal {
+		res.Gateway = ""
+		res.GatewayIPv6 = ""
+		res.StaticRoutes = withoutDefaultRoutes(res.StaticRoutes)
+	}
+}
@@ -0,0 +1,155 @@
+package driver
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+)
+
+// GC first appeared in this version of the spec
+const gcMinVersion = "1.1.0"
+
+// the GC config key listing the attachments plugins must keep
+const validAttachmentsKey = "cni.dev/valid-attachments"
+
+type attachment struct {
+	ContainerID string `json:"containerID"`
+	IfName      string `json:"ifname"`
+}
+
+// GCSummary lists what a GC did with each network config
+type GCSummary struct {
+	Collected []string
+	Skipped   []string
+	Failed    map[string]string
+}
+
+// gcLocks keeps GC of a network config from running while ADDs for it are
+// in flight: until an ADD's attachment is recorded, it isn't among those
+// GC tells the plugins to keep, and they would release what it allocated
+type gcLocks struct {
+	sync.Mutex
+	byConf map[string]*sync.RWMutex
+}
+
+func newGCLocks() *gcLocks {
+	return &gcLocks{byConf: make(map[string]*sync.RWMutex)}
+}
+
+func (l *gcLocks) get(confName string) *sync.RWMutex {
+	l.Lock()
+	defer l.Unlock()
+	m, ok := l.byConf[confName]
+	if !ok {
+		m = &sync.RWMutex{}
+		l.byConf[confName] = m
+	}
+	return m
+}
+
+// adding holds off GC of the network config until the returned function
+// is called, once the ADD's attachment is recorded or undone
+func (l *gcLocks) adding(confName string) func() {
+	m := l.get(confName)
+	m.RLock()
+	return m.RUnlock
+}
+
+// collecting waits for the network config's ADDs in flight and holds off
+// new ones until the returned function is called
+func (l *gcLocks) collecting(confName string) func() {
+	m := l.get(confName)
+	m.Lock()
+	return m.Unlock
+}
+
+// validAttachments returns the attachments of the network config that we
+// know of, joined or preallocated
+func (driver *driver) validAttachments(confName string) []attachment {
+	attachments := []attachment{}
+	for _, ep := range driver.endpoints.list() {
+		if ep.Conf.Name == confName {
+			attachments = append(attachments, attachment{
+				ContainerID: ep.Runtime.ContainerID,
+				IfName:      ep.Runtime.IfName,
+			})
+		}
+	}
+	for _, p := range driver.endpoints.listPreallocs() {
+		if p.ConfName == confName {
+			attachments = append(attachments, attachment{
+				ContainerID: p.Runtime.ContainerID,
+				IfName:      p.Runtime.IfName,
+			})
+		}
+	}
+	return attachments
+}
+
+// gc runs CNI GC for each network config, telling its plugins which
+// attachments are still ours so they can release anything else, like IPAM
+// allocations leaked by a DEL that never ran.  That is only safe if we know
+// every attachment, including those made before we last started, so it is
+// refused unless the endpoints were restored from the result cache.
+func (driver *driver) gc() (*GCSummary, error) {
+	if !driver.restored {
+		return nil, fmt.Errorf("endpoints made before we started are unknown without -cni-cache-dir, so GC would release their addresses")
+	}
+	confs, err := loadNetConfs(driver.netconfpath)
+	if err != nil {
+		return nil, err
+	}
+
+	summary := &GCSummary{Failed: make(map[string]string)}
+	for _, nc := range confs {
+		if !versionAtLeast(nc.CNIVersion, gcMinVersion) {
+			summary.Skipped = append(summary.Skipped, nc.Name)
+			continue
+		}
+		if err := driver.gcNetwork(nc); err != nil {
+			log.Printf("GC of network %s failed: %v", nc.Name, err)
+			summary.Failed[nc.Name] = err.Error()
+			continue
+		}
+		summary.Collected = append(summary.Collected, nc.Name)
+	}
+	log.Printf("GC: %+v", summary)
+	return summary, nil
+}
+
+func (driver *driver) gcNetwork(nc *netConf) error {
+	defer driver.gcLocks.collecting(nc.Name)()
+	attachments := driver.validAttachments(nc.Name)
+	rt := &cniRuntime{}
+	for i := range nc.Plugins {
+		config, err := nc.pluginConfig(i, nil, rt)
+		if err != nil {
+			return err
+		}
+		var conf map[string]interface{}
+		if err := json.Unmarshal(config, &conf); err != nil {
+			return err
+		}
+		conf[validAttachmentsKey] = attachments
+		if config, err = json.Marshal(conf); err != nil {
+			return err
+		}
+
+		plugin := nc.pluginBinary(i)
+		if _, err := driver.execPlugin(plugin, "GC", rt, config); err != nil {
+			return fmt.Errorf("plugin %s failed the GC operation: %v", plugin, err)
+		}
+	}
+	return nil
+}
+
+func (driver *driver) gcHandler(w http.ResponseWriter, r *http.Request) {
+	summary, err := driver.gc()
+	if err != nil {
+		sendError(w, "GC failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	objectResponse(w, summary)
+}
@@ -0,0 +1,98 @@
+package driver
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// dockerHealth tracks whether Docker answered our last ping
+type dockerHealth struct {
+	sync.Mutex
+	connected bool
+	// when connected last changed
+	since   time.Time
+	lastErr error
+}
+
+func newDockerHealth() *dockerHealth {
+	return &dockerHealth{connected: true, since: time.Now()}
+}
+
+// update records a ping's outcome and returns whether Docker has just come
+// back after being unreachable
+func (h *dockerHealth) update(err error) bool {
+	h.Lock()
+	defer h.Unlock()
+	h.lastErr = err
+	connected := err == nil
+	if connected == h.connected {
+		return false
+	}
+	h.connected = connected
+	h.since = time.Now()
+	return connected
+}
+
+func (h *dockerHealth) status() string {
+	h.Lock()
+	defer h.Unlock()
+	if h.connected {
+		return fmt.Sprintf("Docker: connected since %s", h.since.Format(time.RFC3339))
+	}
+	return fmt.Sprintf("Docker: disconnected since %s: %v", h.since.Format(time.RFC3339), h.lastErr)
+}
+
+func (h *dockerHealth) err() error {
+	h.Lock()
+	defer h.Unlock()
+	if h.connected {
+		return nil
+	}
+	return h.lastErr
+}
+
+// jitter spreads pings by up to a fifth of the interval either way, so a
+// fleet of hosts restarted together doesn't ping in lockstep
+func jitter(rng *rand.Rand, interval time.Duration) time.Duration {
+	spread := int64(interval) / 5
+	if spread <= 0 {
+		return interval
+	}
+	return interval - time.Duration(spread) + time.Duration(rng.Int63n(2*spread))
+}
+
+// monitorDocker pings Docker every interval.  The event stream dies with
+// the connection without telling us, so once a failed ping shows Docker
+// went away, the first successful one reconnects the event listener, and
+// then deletes the endpoints of containers that didn't survive a restart.
+func (driver *driver) monitorDocker(interval time.Duration) {
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	for {
+		time.Sleep(jitter(rng, interval))
+		err := driver.Ping()
+		if err != nil && driver.health.err() == nil {
+			log.Printf("Docker is unreachable: %v", err)
+		}
+		if driver.health.update(err) {
+			log.Printf("Docker is reachable again, reconnecting event listener")
+			if err := driver.watcher.Reconnect(); err != nil {
+				log.Printf("Failed to reconnect to Docker: %v", err)
+				driver.health.update(err)
+				continue
+			}
+			driver.reconcileEndpoints()
+		}
+	}
+}
+
+func (driver *driver) healthCheck(w http.ResponseWriter, r *http.Request) {
+	if err := driver.health.err(); err != nil {
+		sendError(w, fmt.Sprintf("Docker is unreachable: %v", err), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "OK")
+}
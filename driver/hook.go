@@ -0,0 +1,95 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// How long a hook may run before it is killed
+const hookTimeout = 30 * time.Second
+
+// Lifecycle events hooks are run for
+const (
+	hookCreateNetwork  = "create-network"
+	hookDeleteNetwork  = "delete-network"
+	hookCreateEndpoint = "create-endpoint"
+	hookDeleteEndpoint = "delete-endpoint"
+	hookJoin           = "join"
+	hookLeave          = "leave"
+)
+
+// execHook runs an operator's command on network and endpoint lifecycle
+// events, passing their details in CNI_DOCKER_* environment variables.
+// Hooks are best-effort: they run in the background, after we have
+// responded to Docker, and their failures are only logged.
+type execHook struct {
+	cmd []string
+}
+
+// hookEvent is what a hook is told of an event; empty fields aren't passed
+type hookEvent struct {
+	Event       string
+	NetworkID   string
+	EndpointID  string
+	ContainerID string
+	Netns       string
+	IfName      string
+	Addresses   []string
+}
+
+// newExecHook parses a hook command, split on whitespace; it returns nil
+// if spec is empty
+func newExecHook(spec string) (*execHook, error) {
+	cmd := strings.Fields(spec)
+	if len(cmd) == 0 {
+		return nil, nil
+	}
+	path, err := exec.LookPath(cmd[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid exec hook: %v", err)
+	}
+	cmd[0] = path
+	return &execHook{cmd: cmd}, nil
+}
+
+func (ev *hookEvent) env() []string {
+	env := []string{"CNI_DOCKER_EVENT=" + ev.Event}
+	add := func(key, value string) {
+		if value != "" {
+			env = append(env, key+"="+value)
+		}
+	}
+	add("CNI_DOCKER_NETWORK_ID", ev.NetworkID)
+	add("CNI_DOCKER_ENDPOINT_ID", ev.EndpointID)
+	add("CNI_DOCKER_CONTAINER_ID", ev.ContainerID)
+	add("CNI_DOCKER_NETNS", ev.Netns)
+	add("CNI_DOCKER_IFNAME", ev.IfName)
+	add("CNI_DOCKER_ADDRESSES", strings.Join(ev.Addresses, ","))
+	return env
+}
+
+// run starts the hook for ev in the background; it is a no-op when no hook
+// is configured
+func (h *execHook) run(ev *hookEvent) {
+	if h == nil {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+		defer cancel()
+
+		c := exec.CommandContext(ctx, h.cmd[0], h.cmd[1:]...)
+		c.Env = append(os.Environ(), ev.env()...)
+		out, err := c.CombinedOutput()
+		if err != nil {
+			log.Printf("Exec hook for %s failed: %v: %s", ev.Event, err, strings.TrimSpace(string(out)))
+			return
+		}
+		debugf("Exec hook for %s: %s", ev.Event, out)
+	}()
+}
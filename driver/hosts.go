@@ -0,0 +1,70 @@
+package driver
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+
+	docker "github.com/dcbw/go-dockerclient"
+)
+
+// hostsOption, when true, makes Joins to the network generate the
+// container's /etc/hosts, mapping its addresses to its hostname as Docker
+// does on its own networks
+const hostsOption = "cni.hosts"
+
+// Entries Docker puts in every container's /etc/hosts
+const defaultHosts = `127.0.0.1	localhost
+::1	localhost ip6-localhost ip6-loopback
+fe00::0	ip6-localnet
+ff00::0	ip6-mcastprefix
+ff02::1	ip6-allnodes
+ff02::2	ip6-allrouters
+`
+
+// hosts renders an /etc/hosts mapping each of addrs, in CIDR notation, to
+// the container's hostname
+func hosts(container *docker.Container, addrs []string) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(defaultHosts)
+
+	names := container.Config.Hostname
+	if container.Config.Domainname != "" {
+		names = fmt.Sprintf("%s.%s %s", container.Config.Hostname, container.Config.Domainname, container.Config.Hostname)
+	}
+	for _, addr := range addrs {
+		ip, _, err := net.ParseCIDR(addr)
+		if err != nil {
+			continue
+		}
+		fmt.Fprintf(&buf, "%s\t%s\n", ip, names)
+	}
+	return buf.Bytes()
+}
+
+func (driver *driver) hostsPath(endpointID string) string {
+	return filepath.Join(driver.hostsDir, endpointID+".hosts")
+}
+
+// writeHosts generates the endpoint's /etc/hosts and returns its path
+func (driver *driver) writeHosts(endpointID string, container *docker.Container, addrs []string) (string, error) {
+	if err := os.MkdirAll(driver.hostsDir, 0755); err != nil {
+		return "", err
+	}
+	path := driver.hostsPath(endpointID)
+	if err := ioutil.WriteFile(path, hosts(container, addrs), 0644); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// removeHosts removes the endpoint's generated /etc/hosts, if any
+func (driver *driver) removeHosts(endpointID string) {
+	if err := os.Remove(driver.hostsPath(endpointID)); err != nil && !os.IsNotExist(err) {
+		log.Printf("Failed to remove endpoint %s hosts: %v", endpointID, err)
+	}
+}
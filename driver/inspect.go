@@ -0,0 +1,85 @@
+package driver
+
+import (
+	"log"
+	"net"
+	"strings"
+)
+
+// docker inspect's IPAddress, IPPrefixLen, GlobalIPv6Address and
+// MacAddress for an endpoint are what libnetwork recorded of its interface
+// at CreateEndpoint, from Docker's IPAM and our response, and can't be
+// changed at Join; only Gateway and IPv6Gateway come from the Join
+// response.  So the plugins must be steered into using the recorded
+// interface: the MAC is passed to them as the mac capability, and with
+// -prealloc-ip the addresses are theirs to begin with.  Without it,
+// plugins whose IPAM hands out other addresses than Docker's make inspect
+// show Docker's, which Join warns of.
+
+// recordedIface merges the interface Docker asked CreateEndpoint for with
+// what we reported back, into the interface libnetwork recorded
+func recordedIface(requested []*iface, reported []*iface) *iface {
+	rec := &iface{}
+	for _, i := range append(requested, reported...) {
+		if rec.Address == "" {
+			rec.Address = i.Address
+		}
+		if rec.AddressIPv6 == "" {
+			rec.AddressIPv6 = i.AddressIPv6
+		}
+		if rec.MacAddress == "" {
+			rec.MacAddress = i.MacAddress
+		}
+	}
+	return rec
+}
+
+// endpointMac returns the MAC to report for an endpoint Docker gave an IPv4
+// address but no MAC, derived from the address as Docker's bridge driver
+// does, or "" if there's none to report
+func endpointMac(requested []*iface) string {
+	rec := recordedIface(requested, nil)
+	if rec.MacAddress != "" || rec.Address == "" {
+		return ""
+	}
+	ip, _, err := net.ParseCIDR(rec.Address)
+	if err != nil || ip.To4() == nil {
+		return ""
+	}
+	return makeMac(ip)
+}
+
+// sameAddress tells if two addresses in CIDR notation are equal, ignoring
+// how the prefix was written
+func sameAddress(a, b string) bool {
+	ipA, netA, errA := net.ParseCIDR(a)
+	ipB, netB, errB := net.ParseCIDR(b)
+	if errA != nil || errB != nil {
+		return a == b
+	}
+	return ipA.Equal(ipB) && netA.String() == netB.String()
+}
+
+// checkRecorded warns when a Join result disagrees with the interface
+// Docker recorded for the endpoint, which docker inspect will show
+func checkRecorded(endpointID string, netName string, rec *iface, result *cniResult, netns string) {
+	if rec == nil {
+		return
+	}
+	var mismatches []string
+	check := func(what, recorded, got string) {
+		if recorded != "" && got != "" && !sameAddress(recorded, got) {
+			mismatches = append(mismatches, what+" "+got+" (recorded "+recorded+")")
+		}
+	}
+	check("address", rec.Address, result.IP4.address())
+	check("IPv6 address", rec.AddressIPv6, result.IP6.address())
+	if intf := result.containerIface(netns); intf != nil && rec.MacAddress != "" && intf.Mac != "" &&
+		!strings.EqualFold(rec.MacAddress, intf.Mac) {
+		mismatches = append(mismatches, "MAC "+intf.Mac+" (recorded "+rec.MacAddress+")")
+	}
+	if len(mismatches) > 0 {
+		log.Printf("Network %s gave endpoint %s %s; docker inspect will show what Docker recorded at CreateEndpoint",
+			netName, endpointID, strings.Join(mismatches, ", "))
+	}
+}
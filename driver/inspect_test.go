@@ -0,0 +1,106 @@
+package driver
+
+import (
+	"encoding/json"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// inspectNetwork is the part of docker inspect's NetworkSettings.Networks
+// entry that libnetwork fills in from the driver
+type inspectNetwork struct {
+	IPAddress         string
+	IPPrefixLen       int
+	Gateway           string
+	GlobalIPv6Address string
+	IPv6Gateway       string
+	MacAddress        string
+}
+
+// inspectView builds what docker inspect shows of an endpoint from the
+// interface libnetwork recorded at CreateEndpoint and the Join response
+func inspectView(rec *iface, res *joinResponse) inspectNetwork {
+	view := inspectNetwork{
+		Gateway:     res.Gateway,
+		IPv6Gateway: res.GatewayIPv6,
+		MacAddress:  rec.MacAddress,
+	}
+	if ip, ipnet, err := net.ParseCIDR(rec.Address); err == nil {
+		view.IPAddress = ip.String()
+		view.IPPrefixLen, _ = ipnet.Mask.Size()
+	}
+	if ip, _, err := net.ParseCIDR(rec.AddressIPv6); err == nil {
+		view.GlobalIPv6Address = ip.String()
+	}
+	return view
+}
+
+func TestInspectFields(t *testing.T) {
+	output := `{"cniVersion": "0.4.0",
+		"interfaces": [{"name": "eth0", "mac": "7a:42:0a:00:00:02", "sandbox": "/var/run/docker/netns/abc"}],
+		"ips": [
+			{"version": "4", "interface": 0, "address": "10.0.0.2/24", "gateway": "10.0.0.1"},
+			{"version": "6", "interface": 0, "address": "fd00::2/64", "gateway": "fd00::1"}
+		],
+		"routes": [{"dst": "0.0.0.0/0"}, {"dst": "::/0"}]}`
+	result, err := parseResult([]byte(output))
+	if err != nil {
+		t.Fatal(err)
+	}
+	nc := &netConf{Name: "net", Plugins: []map[string]interface{}{
+		{"type": "bridge", "ipam": map[string]interface{}{"type": "host-local"}},
+	}}
+	want := inspectNetwork{
+		IPAddress:         "10.0.0.2",
+		IPPrefixLen:       24,
+		Gateway:           "10.0.0.1",
+		GlobalIPv6Address: "fd00::2",
+		IPv6Gateway:       "fd00::1",
+		MacAddress:        "7a:42:0a:00:00:02",
+	}
+
+	tests := []struct {
+		name      string
+		requested []*iface
+		prealloc  *preallocation
+	}{
+		{
+			name:      "addresses from Docker's IPAM",
+			requested: []*iface{{Address: "10.0.0.2/24", AddressIPv6: "fd00::2/64"}},
+		},
+		{
+			name:     "addresses preallocated by the plugins",
+			prealloc: &preallocation{Result: result, Mac: "7a:42:0a:00:00:02"},
+		},
+	}
+
+	for _, tt := range tests {
+		d := &driver{endpoints: newEndpoints(), preallocIP: tt.prealloc != nil}
+		var reported []*iface
+		if tt.prealloc != nil {
+			reported = []*iface{tt.prealloc.iface()}
+		} else {
+			// CreateEndpoint reports a MAC for Docker's address
+			body, _ := json.Marshal(&endpointCreate{NetworkID: "n1", EndpointID: "ep1", Interfaces: tt.requested})
+			w := httptest.NewRecorder()
+			d.createEndpoint(w, httptest.NewRequest("POST", "/NetworkDriver.CreateEndpoint", strings.NewReader(string(body))))
+			var resp endpointResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("%s: CreateEndpoint returned %q: %v", tt.name, w.Body, err)
+			}
+			reported = resp.Interfaces
+		}
+
+		rec := recordedIface(tt.requested, reported)
+		res, err := d.resultJoinResponse(nc, result, "ep1")
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got := inspectView(rec, res); got != want {
+			t.Errorf("%s: docker inspect would show %+v, want %+v", tt.name, got, want)
+		}
+	}
+}
@@ -0,0 +1,392 @@
+package driver
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	IpamMethodReceiver = "IpamDriver"
+
+	localAddressSpace  = "CNILocal"
+	globalAddressSpace = "CNIGlobal"
+
+	requestAddressType = "RequestAddressType"
+	gatewayAddressType = "com.docker.network.gateway"
+
+	// CNI IPAM plugins key allocations by container and interface, neither
+	// of which Docker gives us, so each address gets its own made-up
+	// container ID on this interface
+	ipamIfName = "eth0"
+)
+
+// When an IPAM plugin is configured we also act as a Docker IPAM driver,
+// with pools and addresses managed by that CNI IPAM plugin
+
+type pool struct {
+	ID           string
+	AddressSpace string
+	Subnet       *net.IPNet
+	V6           bool
+	// the CNI container ID of each address allocated from the pool
+	Allocations map[string]string
+}
+
+// pools are kept in the cache as they change, since Docker doesn't
+// request them again when we restart, and the IPAM plugin's allocations
+// can only be released with the container IDs we made up for them
+type pools struct {
+	sync.Mutex
+	byID  map[string]*pool
+	cache *resultCache
+}
+
+func newPools() *pools {
+	return &pools{
+		byID: make(map[string]*pool),
+	}
+}
+
+// save writes the pool to the cache; the caller must hold the lock
+func (p *pools) save(pl *pool) {
+	if err := p.cache.writePool(pl); err != nil {
+		log.Printf("Failed to cache pool %s: %v", pl.ID, err)
+	}
+}
+
+func (p *pools) add(pl *pool) {
+	p.Lock()
+	defer p.Unlock()
+	p.byID[pl.ID] = pl
+	p.save(pl)
+}
+
+// restore adds a pool loaded from the cache
+func (p *pools) restore(pl *pool) {
+	p.Lock()
+	defer p.Unlock()
+	p.byID[pl.ID] = pl
+}
+
+func (p *pools) get(id string) *pool {
+	p.Lock()
+	defer p.Unlock()
+	return p.byID[id]
+}
+
+func (p *pools) remove(id string) {
+	p.Lock()
+	defer p.Unlock()
+	delete(p.byID, id)
+	if err := p.cache.removePool(id); err != nil {
+		log.Printf("Failed to remove cached pool %s: %v", id, err)
+	}
+}
+
+func (p *pools) allocate(id string, address string, containerID string) {
+	p.Lock()
+	defer p.Unlock()
+	if pl, ok := p.byID[id]; ok {
+		pl.Allocations[address] = containerID
+		p.save(pl)
+	}
+}
+
+// release forgets an allocated address, returning its CNI container ID
+func (p *pools) release(id string, address string) (string, bool) {
+	p.Lock()
+	defer p.Unlock()
+	pl, ok := p.byID[id]
+	if !ok {
+		return "", false
+	}
+	containerID, ok := pl.Allocations[address]
+	if ok {
+		delete(pl.Allocations, address)
+		p.save(pl)
+	}
+	return containerID, ok
+}
+
+func newIpamContainerID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return "docker-ipam-" + hex.EncodeToString(buf), nil
+}
+
+// poolName is a pool's ID made fit for a file name
+func poolName(id string) string {
+	return strings.NewReplacer("/", "-", ":", "-").Replace(id)
+}
+
+// ipamConfig is the config for the IPAM plugin for a pool.  The network
+// name keys the plugin's store, so it must be unique to the pool.
+func (driver *driver) ipamConfig(pl *pool) ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"name": poolName(pl.ID),
+		"ipam": map[string]interface{}{
+			"type":   driver.ipamPlugin,
+			"subnet": pl.Subnet.String(),
+		},
+	})
+}
+
+func (driver *driver) handleIpam(router *mux.Router) {
+	handleMethod := func(method string, h http.HandlerFunc) {
+		driver.handleMethod(router, IpamMethodReceiver, method, h)
+	}
+
+	handleMethod("GetCapabilities", driver.ipamCapabilities)
+	handleMethod("GetDefaultAddressSpaces", driver.defaultAddressSpaces)
+	handleMethod("RequestPool", driver.requestPool)
+	handleMethod("ReleasePool", driver.releasePool)
+	handleMethod("RequestAddress", driver.requestAddress)
+	handleMethod("ReleaseAddress", driver.releaseAddress)
+}
+
+type ipamCapabilities struct {
+	RequiresMACAddress    bool
+	RequiresRequestReplay bool
+}
+
+func (driver *driver) ipamCapabilities(w http.ResponseWriter, r *http.Request) {
+	objectResponse(w, &ipamCapabilities{})
+}
+
+type addressSpaces struct {
+	LocalDefaultAddressSpace  string
+	GlobalDefaultAddressSpace string
+}
+
+func (driver *driver) defaultAddressSpaces(w http.ResponseWriter, r *http.Request) {
+	objectResponse(w, &addressSpaces{
+		LocalDefaultAddressSpace:  localAddressSpace,
+		GlobalDefaultAddressSpace: globalAddressSpace,
+	})
+}
+
+type poolRequest struct {
+	AddressSpace string
+	Pool         string
+	SubPool      string
+	Options      map[string]string
+	V6           bool
+}
+
+type poolResponse struct {
+	PoolID string
+	Pool   string
+	Data   map[string]string
+}
+
+// CNI IPAM plugins allocate from configured ranges rather than choosing
+// subnets, so the subnet must be given with "docker network create --subnet"
+func (driver *driver) requestPool(w http.ResponseWriter, r *http.Request) {
+	var req poolRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendError(w, "Could not decode JSON encode payload", http.StatusBadRequest)
+		return
+	}
+	log.Printf("Request pool request: %+v", &req)
+
+	if req.Pool == "" {
+		errorResponsef(w, "%s requires a subnet", driver.ipamPlugin)
+		return
+	}
+	_, subnet, err := net.ParseCIDR(req.Pool)
+	if err != nil {
+		errorResponsef(w, "invalid pool %q: %v", req.Pool, err)
+		return
+	}
+	if (subnet.IP.To4() == nil) != req.V6 {
+		errorResponsef(w, "pool %s is the wrong address family", req.Pool)
+		return
+	}
+
+	pl := &pool{
+		ID:           req.AddressSpace + "/" + subnet.String(),
+		AddressSpace: req.AddressSpace,
+		Subnet:       subnet,
+		V6:           req.V6,
+		Allocations:  make(map[string]string),
+	}
+	driver.pools.add(pl)
+
+	objectResponse(w, &poolResponse{
+		PoolID: pl.ID,
+		Pool:   subnet.String(),
+		Data:   map[string]string{},
+	})
+	log.Printf("Registered pool %s", pl.ID)
+}
+
+type poolRelease struct {
+	PoolID string
+}
+
+func (driver *driver) releasePool(w http.ResponseWriter, r *http.Request) {
+	var req poolRelease
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendError(w, "Could not decode JSON encode payload", http.StatusBadRequest)
+		return
+	}
+	log.Printf("Release pool request: %+v", &req)
+
+	driver.pools.remove(req.PoolID)
+	emptyResponse(w)
+}
+
+type addressRequest struct {
+	PoolID  string
+	Address string
+	Options map[string]string
+}
+
+type addressResponse struct {
+	Address string
+	Data    map[string]string
+}
+
+// firstAddress returns the subnet's first host address, which CNI IPAM
+// plugins use as the gateway by default
+func firstAddress(subnet *net.IPNet) net.IP {
+	ip := make(net.IP, len(subnet.IP))
+	copy(ip, subnet.IP)
+	ip[len(ip)-1]++
+	return ip
+}
+
+// RequestAddress runs the IPAM plugin's ADD, asking for a specific address
+// with the IP CNI_ARG if Docker wants one
+func (driver *driver) requestAddress(w http.ResponseWriter, r *http.Request) {
+	var req addressRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendError(w, "Could not decode JSON encode payload", http.StatusBadRequest)
+		return
+	}
+	log.Printf("Request address request: %+v", &req)
+
+	pl := driver.pools.get(req.PoolID)
+	if pl == nil {
+		errorResponsef(w, "unknown pool %s", req.PoolID)
+		return
+	}
+	ones, _ := pl.Subnet.Mask.Size()
+
+	// The IPAM plugin reserves the gateway itself, so don't allocate it
+	if req.Options[requestAddressType] == gatewayAddressType {
+		gw := req.Address
+		if gw == "" {
+			gw = firstAddress(pl.Subnet).String()
+		}
+		objectResponse(w, &addressResponse{
+			Address: fmt.Sprintf("%s/%d", gw, ones),
+			Data:    map[string]string{},
+		})
+		return
+	}
+
+	config, err := driver.ipamConfig(pl)
+	if err != nil {
+		errorResponsef(w, "%v", err)
+		return
+	}
+	containerID, err := newIpamContainerID()
+	if err != nil {
+		errorResponsef(w, "%v", err)
+		return
+	}
+	rt := &cniRuntime{
+		ContainerID: containerID,
+		IfName:      ipamIfName,
+	}
+	if req.Address != "" {
+		rt.Args = [][2]string{{"IP", req.Address}}
+	}
+
+	output, err := driver.execPlugin(driver.ipamPlugin, "ADD", rt, config)
+	if err != nil {
+		errorResponsef(w, "IPAM plugin %s failed: %v", driver.ipamPlugin, err)
+		return
+	}
+	result, err := parseResult(output)
+	if err != nil {
+		errorResponsef(w, "IPAM plugin %s: %v", driver.ipamPlugin, err)
+		return
+	}
+	ipc := result.IP4
+	if pl.V6 {
+		ipc = result.IP6
+	}
+	if ipc == nil || ipc.IP == "" {
+		errorResponsef(w, "IPAM plugin %s returned no address", driver.ipamPlugin)
+		return
+	}
+	ip, _, err := net.ParseCIDR(ipc.IP)
+	if err != nil {
+		errorResponsef(w, "IPAM plugin %s returned invalid address %q", driver.ipamPlugin, ipc.IP)
+		return
+	}
+
+	driver.pools.allocate(pl.ID, ip.String(), containerID)
+	objectResponse(w, &addressResponse{
+		Address: fmt.Sprintf("%s/%d", ip, ones),
+		Data:    map[string]string{},
+	})
+	log.Printf("Allocated %s from pool %s", ip, pl.ID)
+}
+
+type addressRelease struct {
+	PoolID  string
+	Address string
+}
+
+func (driver *driver) releaseAddress(w http.ResponseWriter, r *http.Request) {
+	var req addressRelease
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendError(w, "Could not decode JSON encode payload", http.StatusBadRequest)
+		return
+	}
+	log.Printf("Release address request: %+v", &req)
+
+	pl := driver.pools.get(req.PoolID)
+	if pl == nil {
+		errorResponsef(w, "unknown pool %s", req.PoolID)
+		return
+	}
+	containerID, ok := driver.pools.release(pl.ID, req.Address)
+	if !ok {
+		// Most likely the gateway, which we never allocated
+		emptyResponse(w)
+		return
+	}
+
+	config, err := driver.ipamConfig(pl)
+	if err != nil {
+		errorResponsef(w, "%v", err)
+		return
+	}
+	rt := &cniRuntime{
+		ContainerID: containerID,
+		IfName:      ipamIfName,
+	}
+	if _, err := driver.execPlugin(driver.ipamPlugin, "DEL", rt, config); err != nil {
+		driver.pools.allocate(pl.ID, req.Address, containerID)
+		errorResponsef(w, "IPAM plugin %s failed: %v", driver.ipamPlugin, err)
+		return
+	}
+
+	emptyResponse(w)
+	log.Printf("Released %s from pool %s", req.Address, pl.ID)
+}
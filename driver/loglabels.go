@@ -0,0 +1,95 @@
+package driver
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	docker "github.com/dcbw/go-dockerclient"
+)
+
+// Container metadata logged unless configured otherwise: the container's
+// name and image, but none of its labels, which may carry secrets
+var defaultLogLabels = []string{"name", "image"}
+
+// labelFilter chooses which container labels, and event attributes such as
+// "name" and "image", may appear in our logs.  Keys are matched as shell
+// patterns, eg com.example.*; a denied key is never logged, even if it is
+// also allowed.
+type labelFilter struct {
+	allow []string
+	deny  []string
+}
+
+// set from Options.LogLabelAllow and Options.LogLabelDeny
+var logLabels = &labelFilter{allow: defaultLogLabels}
+
+func newLabelFilter(allow []string, deny []string) (*labelFilter, error) {
+	if len(allow) == 0 {
+		allow = defaultLogLabels
+	}
+	for _, pattern := range append(append([]string{}, allow...), deny...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid log label pattern %q: %v", pattern, err)
+		}
+	}
+	return &labelFilter{allow: allow, deny: deny}, nil
+}
+
+func matchesAny(patterns []string, key string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, key); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *labelFilter) allowed(key string) bool {
+	return matchesAny(f.allow, key) && !matchesAny(f.deny, key)
+}
+
+// format returns the allowed labels as sorted key=value pairs
+func (f *labelFilter) format(labels map[string]string) string {
+	var kvs []string
+	for k, v := range labels {
+		if f.allowed(k) {
+			kvs = append(kvs, k+"="+v)
+		}
+	}
+	sort.Strings(kvs)
+	return strings.Join(kvs, ",")
+}
+
+// describeEvent formats a Docker event for the logs.  Container events'
+// attributes hold the container's labels, so only allowed ones are kept.
+func describeEvent(event *docker.APIEvents) string {
+	action := event.Action
+	if action == "" {
+		action = event.Status
+	}
+	id := event.Actor.ID
+	if id == "" {
+		id = event.ID
+	}
+	desc := fmt.Sprintf("%s %s %s", event.Type, action, id)
+	if attrs := logLabels.format(event.Actor.Attributes); attrs != "" {
+		desc += " (" + attrs + ")"
+	}
+	return desc
+}
+
+// describeContainerLabels formats a container's allowed name, image and
+// labels for the logs, or "" if none are allowed
+func describeContainerLabels(container *docker.Container) string {
+	meta := map[string]string{}
+	if container.Config != nil {
+		for k, v := range container.Config.Labels {
+			meta[k] = v
+		}
+		meta["image"] = container.Config.Image
+	}
+	meta["name"] = containerName(container)
+	return logLabels.format(meta)
+}
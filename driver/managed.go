@@ -0,0 +1,84 @@
+package driver
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	docker "github.com/dcbw/go-dockerclient"
+)
+
+// managedLabelPrefix marks an allowlist entry selecting networks by label
+const managedLabelPrefix = "label:"
+
+// managedNetworks is the allowlist of networks we handle, by name or by
+// label; an empty allowlist allows every network
+type managedNetworks struct {
+	names map[string]bool
+	// key and value of each label selector; an empty value matches any
+	labels [][2]string
+}
+
+// parseManagedNetworks parses allowlist entries, each either a network name
+// or "label:KEY[=VALUE]"
+func parseManagedNetworks(specs []string) (*managedNetworks, error) {
+	m := &managedNetworks{names: make(map[string]bool)}
+	for _, spec := range specs {
+		if !strings.HasPrefix(spec, managedLabelPrefix) {
+			if spec == "" {
+				return nil, fmt.Errorf("empty managed network name")
+			}
+			m.names[spec] = true
+			continue
+		}
+		kv := strings.SplitN(strings.TrimPrefix(spec, managedLabelPrefix), "=", 2)
+		if kv[0] == "" {
+			return nil, fmt.Errorf("invalid managed network selector %q, expected label:KEY[=VALUE]", spec)
+		}
+		label := [2]string{kv[0]}
+		if len(kv) == 2 {
+			label[1] = kv[1]
+		}
+		m.labels = append(m.labels, label)
+	}
+	return m, nil
+}
+
+func (m *managedNetworks) all() bool {
+	return m == nil || len(m.names) == 0 && len(m.labels) == 0
+}
+
+func (m *managedNetworks) matches(nw *docker.Network) bool {
+	if m.all() || m.names[nw.Name] {
+		return true
+	}
+	for _, label := range m.labels {
+		if value, ok := nw.Labels[label[0]]; ok && (label[1] == "" || value == label[1]) {
+			return true
+		}
+	}
+	return false
+}
+
+// isManaged returns whether the allowlist lets us handle the network,
+// looking it up in Docker if we aren't watching it.  Docker only tells us
+// a network's name and labels once it has committed it, after our
+// CreateNetwork response, so unmanaged networks can't be refused there;
+// instead the watcher ignores them and their Joins are refused.
+func (driver *driver) isManaged(networkID string) (bool, error) {
+	if driver.managed.all() {
+		return true, nil
+	}
+	nw := driver.watcher.GetNetworkById(networkID)
+	if nw == nil {
+		var err error
+		if nw, err = driver.NetworkInfo(networkID); err != nil {
+			return false, networkLookupError(networkID, err)
+		}
+	}
+	if !driver.managed.matches(nw) {
+		log.Printf("Skipping network %s (%s): not in the managed networks allowlist", nw.Name, networkID)
+		return false, nil
+	}
+	return true, nil
+}
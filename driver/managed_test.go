@@ -0,0 +1,44 @@
+package driver
+
+import (
+	"testing"
+
+	docker "github.com/dcbw/go-dockerclient"
+)
+
+func TestManagedNetworks(t *testing.T) {
+	managed, err := parseManagedNetworks([]string{"net1", "label:cni", "label:team=a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		network *docker.Network
+		want    bool
+	}{
+		{name: "by name", network: &docker.Network{ID: "n1", Name: "net1"}, want: true},
+		{name: "other name", network: &docker.Network{ID: "n2", Name: "net2"}, want: false},
+		{name: "any label value", network: &docker.Network{ID: "n3", Labels: map[string]string{"cni": ""}}, want: true},
+		{name: "label value", network: &docker.Network{ID: "n4", Labels: map[string]string{"team": "a"}}, want: true},
+		{name: "other label value", network: &docker.Network{ID: "n5", Labels: map[string]string{"team": "b"}}, want: false},
+	}
+
+	for _, tt := range tests {
+		if got := managed.matches(tt.network); got != tt.want {
+			t.Errorf("%s: matches() = %v, want %v", tt.name, got, tt.want)
+		}
+
+		// The watcher ignores the networks whose Joins are refused
+		w := &watcher{networks: map[string]*docker.Network{}, managed: managed}
+		w.WatchNetwork(tt.network)
+		if got := w.GetNetworkById(tt.network.ID) != nil; got != tt.want {
+			t.Errorf("%s: watched = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	for _, spec := range []string{"", "label:", "label:=a"} {
+		if _, err := parseManagedNetworks([]string{spec}); err == nil {
+			t.Errorf("parseManagedNetworks(%q) succeeded", spec)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package driver
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Upper bounds, in seconds, of the plugin latency histogram buckets.  CNI
+// execs range from a millisecond or two for a loopback or tuning plugin to
+// tens of seconds for a DHCP lease, so the buckets are spread over that.
+var latencyBuckets = []float64{
+	0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30,
+}
+
+const latencyMetric = "cni_docker_plugin_exec_duration_seconds"
+
+// Result label values of plugin executions
+const (
+	resultSuccess = "success"
+	resultError   = "error"
+	resultTimeout = "timeout"
+)
+
+// pluginLatency holds a histogram of execPlugin durations for each command,
+// plugin and result, served at /metrics so percentiles can be computed with
+// Prometheus's histogram_quantile()
+type pluginLatency struct {
+	sync.Mutex
+	series map[latencyKey]*histogram
+}
+
+type latencyKey struct {
+	command string
+	plugin  string
+	result  string
+}
+
+type byLatencyKey []latencyKey
+
+func (k byLatencyKey) Len() int      { return len(k) }
+func (k byLatencyKey) Swap(i, j int) { k[i], k[j] = k[j], k[i] }
+
+func (k byLatencyKey) Less(i, j int) bool {
+	if k[i].command != k[j].command {
+		return k[i].command < k[j].command
+	}
+	if k[i].plugin != k[j].plugin {
+		return k[i].plugin < k[j].plugin
+	}
+	return k[i].result < k[j].result
+}
+
+type histogram struct {
+	// counts[i] is the number of observations <= latencyBuckets[i], and
+	// not in an earlier bucket; they are made cumulative when written
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func newPluginLatency() *pluginLatency {
+	return &pluginLatency{series: make(map[latencyKey]*histogram)}
+}
+
+func execResult(err error) string {
+	if err == nil {
+		return resultSuccess
+	}
+	if e, ok := err.(*pluginError); ok && e.timedOut {
+		return resultTimeout
+	}
+	return resultError
+}
+
+func (l *pluginLatency) observe(command, plugin string, err error, d time.Duration) {
+	key := latencyKey{command: command, plugin: plugin, result: execResult(err)}
+	secs := d.Seconds()
+
+	l.Lock()
+	defer l.Unlock()
+	h, ok := l.series[key]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(latencyBuckets))}
+		l.series[key] = h
+	}
+	// Observations above the last bucket only count towards +Inf
+	if i := sort.SearchFloat64s(latencyBuckets, secs); i < len(latencyBuckets) {
+		h.counts[i]++
+	}
+	h.count++
+	h.sum += secs
+}
+
+// escapeLabel escapes a label value for the text exposition format
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func formatBound(bound float64) string {
+	return strconv.FormatFloat(bound, 'g', -1, 64)
+}
+
+// write writes the histograms in the Prometheus text format, which is also
+// valid OpenMetrics but for the "# EOF" the caller adds
+func (l *pluginLatency) write(w io.Writer) {
+	l.Lock()
+	defer l.Unlock()
+
+	keys := make([]latencyKey, 0, len(l.series))
+	for key := range l.series {
+		keys = append(keys, key)
+	}
+	sort.Sort(byLatencyKey(keys))
+
+	fmt.Fprintf(w, "# HELP %s Duration of CNI plugin executions, including retries.\n", latencyMetric)
+	fmt.Fprintf(w, "# TYPE %s histogram\n", latencyMetric)
+	for _, key := range keys {
+		h := l.series[key]
+		labels := fmt.Sprintf(`command="%s",plugin="%s",result="%s"`,
+			escapeLabel(key.command), escapeLabel(key.plugin), escapeLabel(key.result))
+		var cumulative uint64
+		for i, bound := range latencyBuckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(w, "%s_bucket{%s,le=\"%s\"} %d\n", latencyMetric, labels, formatBound(bound), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", latencyMetric, labels, h.count)
+		fmt.Fprintf(w, "%s_sum{%s} %s\n", latencyMetric, labels, formatBound(h.sum))
+		fmt.Fprintf(w, "%s_count{%s} %d\n", latencyMetric, labels, h.count)
+	}
+}
+
+// metrics serves the plugin latency histograms, in OpenMetrics format if
+// the scraper asks for it and the Prometheus text format otherwise
+func (driver *driver) metrics(w http.ResponseWriter, r *http.Request) {
+	openMetrics := strings.Contains(r.Header.Get("Accept"), "application/openmetrics-text")
+	if openMetrics {
+		w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+	} else {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	}
+	driver.latency.write(w)
+	if openMetrics {
+		io.WriteString(w, "# EOF\n")
+	}
+}
@@ -0,0 +1,437 @@
+package driver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// CNI network configurations are read from netconfpath and matched to
+// Docker networks by name.  A single-plugin .conf (or .json) file is
+// treated as a chain of one plugin; a .conflist holds the whole chain.
+type netConf struct {
+	Path       string
+	Name       string
+	CNIVersion string
+	Plugins    []map[string]interface{}
+	// plugin binaries, as resolved by resolvePlugins
+	Binaries []string
+	// the network's own plugin search path, if it overrides ours
+	PluginPath string
+}
+
+type confList struct {
+	Name       string                   `json:"name"`
+	CNIVersion string                   `json:"cniVersion,omitempty"`
+	Plugins    []map[string]interface{} `json:"plugins"`
+}
+
+func loadNetConfFile(path string) (*netConf, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	nc := &netConf{Path: path}
+	if filepath.Ext(path) == ".conflist" {
+		var list confList
+		if err := json.Unmarshal(data, &list); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+		}
+		if len(list.Plugins) == 0 {
+			return nil, fmt.Errorf("%s has no plugins", path)
+		}
+		nc.Name = list.Name
+		nc.CNIVersion = list.CNIVersion
+		nc.Plugins = list.Plugins
+	} else {
+		var plugin map[string]interface{}
+		if err := json.Unmarshal(data, &plugin); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+		}
+		nc.Name, _ = plugin["name"].(string)
+		nc.CNIVersion, _ = plugin["cniVersion"].(string)
+		nc.Plugins = []map[string]interface{}{plugin}
+	}
+
+	if nc.Name == "" {
+		return nil, fmt.Errorf("%s has no network name", path)
+	}
+	for i := range nc.Plugins {
+		if nc.pluginType(i) == "" {
+			return nil, fmt.Errorf("%s plugin %d has no type", path, i)
+		}
+	}
+	return nc, nil
+}
+
+// confDuplicates remembers the networks configured by several files that
+// we have warned of, so that the configs being loaded for every Join
+// doesn't repeat the warning until the files change
+type confDuplicates struct {
+	sync.Mutex
+	// the files configuring each network, by network name
+	warned map[string]string
+}
+
+var duplicateConfs = &confDuplicates{warned: make(map[string]string)}
+
+// check warns of each network configured by several of confs, unless it
+// already did for the same files
+func (d *confDuplicates) check(confs []*netConf) {
+	var names []string
+	paths := make(map[string][]string)
+	for _, nc := range confs {
+		if _, ok := paths[nc.Name]; !ok {
+			names = append(names, nc.Name)
+		}
+		paths[nc.Name] = append(paths[nc.Name], nc.Path)
+	}
+
+	d.Lock()
+	defer d.Unlock()
+	// Forget those that changed, to warn again if they come back
+	for name, warned := range d.warned {
+		if warned != strings.Join(paths[name], ", ") {
+			delete(d.warned, name)
+		}
+	}
+	for _, name := range names {
+		if len(paths[name]) < 2 {
+			continue
+		}
+		files := strings.Join(paths[name], ", ")
+		if d.warned[name] == files {
+			continue
+		}
+		d.warned[name] = files
+		log.Printf("Warning: CNI network %s is configured by %s; using %s", name, files, paths[name][0])
+	}
+}
+
+// loadNetConfs loads every valid network config in dir, in the order libcni
+// looks for a network's config: .conflist files first, then .conf and
+// .json files, each in filename order.  Of several configs of a network,
+// the first is the one used, and we warn of the others.
+func loadNetConfs(dir string) ([]*netConf, error) {
+	var files []string
+	for _, exts := range [][]string{{"*.conflist"}, {"*.conf", "*.json"}} {
+		var group []string
+		for _, ext := range exts {
+			matches, err := filepath.Glob(filepath.Join(dir, ext))
+			if err != nil {
+				return nil, err
+			}
+			group = append(group, matches...)
+		}
+		sort.Strings(group)
+		files = append(files, group...)
+	}
+
+	var confs []*netConf
+	for _, path := range files {
+		nc, err := loadNetConfFile(path)
+		if err != nil {
+			log.Printf("Skipping network config: %v", err)
+			continue
+		}
+		confs = append(confs, nc)
+	}
+	duplicateConfs.check(confs)
+	return confs, nil
+}
+
+// findNetConf returns the configuration for the named network, the one
+// libcni's LoadConfList would pick if several files configure it
+func findNetConf(dir string, name string) (*netConf, error) {
+	confs, err := loadNetConfs(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, nc := range confs {
+		if nc.Name == name {
+			return nc, nil
+		}
+	}
+	return nil, fmt.Errorf("no CNI network config named %s in %s", name, dir)
+}
+
+func (nc *netConf) pluginType(i int) string {
+	t, _ := nc.Plugins[i]["type"].(string)
+	return t
+}
+
+// mtu returns the MTU set by the first plugin in the chain that sets one
+func (nc *netConf) mtu() int {
+	for _, plugin := range nc.Plugins {
+		if mtu, ok := plugin["mtu"].(float64); ok && mtu > 0 {
+			return int(mtu)
+		}
+	}
+	return 0
+}
+
+// mtuPluginTypes are the reference plugins that create the container's
+// interface and take an "mtu", which they set on both its ends
+var mtuPluginTypes = map[string]bool{
+	"bridge":  true,
+	"ptp":     true,
+	"macvlan": true,
+	"ipvlan":  true,
+	"vlan":    true,
+}
+
+// setMTU has every plugin in the chain that takes an MTU set mtu, and
+// tells whether any does
+func (nc *netConf) setMTU(mtu int) bool {
+	set := false
+	for _, plugin := range nc.Plugins {
+		if t, _ := plugin["type"].(string); mtuPluginTypes[t] {
+			plugin["mtu"] = float64(mtu)
+			set = true
+		}
+	}
+	return set
+}
+
+// setIPAMRanges makes every plugin whose IPAM takes ranges allocate from
+// the given ones instead of the subnet the config file says.  Configs
+// that already set ranges keep them.
+func (nc *netConf) setIPAMRanges(ranges [][]map[string]interface{}) {
+	for _, plugin := range nc.Plugins {
+		ipam, ok := plugin["ipam"].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if t, _ := ipam["type"].(string); !rangesIPAMTypes[t] {
+			log.Printf("Network %s IPAM %s doesn't take ranges; not allocating from Docker's pools", nc.Name, t)
+			continue
+		}
+		if _, ok := ipam["ranges"]; ok {
+			log.Printf("Network %s IPAM already sets ranges; not allocating from Docker's pools", nc.Name)
+			continue
+		}
+		for _, key := range []string{"subnet", "gateway", "rangeStart", "rangeEnd"} {
+			delete(ipam, key)
+		}
+		ipam["ranges"] = ranges
+	}
+}
+
+// hasIPAM returns whether any plugin in the chain is configured to
+// allocate addresses
+func (nc *netConf) hasIPAM() bool {
+	for _, plugin := range nc.Plugins {
+		if ipam, ok := plugin["ipam"].(map[string]interface{}); ok && ipam["type"] != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// makeInternal takes the chain's route out of the host away, for internal
+// networks: plugins like bridge are told not to be the gateway nor to
+// masquerade, and plugins publishing ports are dropped
+func (nc *netConf) makeInternal() {
+	var plugins []map[string]interface{}
+	var binaries []string
+	for i, plugin := range nc.Plugins {
+		if nc.hasCapability(i, portMappingsCapability) {
+			log.Printf("Network %s is internal, dropping plugin %s", nc.Name, nc.pluginType(i))
+			continue
+		}
+		if _, ok := plugin["isGateway"]; ok || nc.pluginType(i) == "bridge" {
+			cp := make(map[string]interface{})
+			for k, v := range plugin {
+				cp[k] = v
+			}
+			cp["isGateway"] = false
+			cp["ipMasq"] = false
+			plugin = cp
+		}
+		plugins = append(plugins, plugin)
+		if i < len(nc.Binaries) {
+			binaries = append(binaries, nc.Binaries[i])
+		}
+	}
+	nc.Plugins = plugins
+	if nc.Binaries != nil {
+		nc.Binaries = binaries
+	}
+}
+
+// masterInterfaces returns the host interfaces the chain's plugins (eg,
+// macvlan and ipvlan) attach to
+func (nc *netConf) masterInterfaces() []string {
+	var masters []string
+	for _, plugin := range nc.Plugins {
+		if master, ok := plugin["master"].(string); ok && master != "" {
+			masters = append(masters, master)
+		}
+	}
+	return masters
+}
+
+// pluginBinary returns the binary to run for plugin i, which is the
+// plugin's type unless the network pinned a different one
+func (nc *netConf) pluginBinary(i int) string {
+	if i < len(nc.Binaries) {
+		return nc.Binaries[i]
+	}
+	return nc.pluginType(i)
+}
+
+// hasCapability returns whether plugin i declares the given capability
+func (nc *netConf) hasCapability(i int, capability string) bool {
+	caps, _ := nc.Plugins[i]["capabilities"].(map[string]interface{})
+	enabled, _ := caps[capability].(bool)
+	return enabled
+}
+
+// capabilityPlugins returns the indexes of the plugins in the chain which
+// declare the given capability
+func (nc *netConf) capabilityPlugins(capability string) []int {
+	var plugins []int
+	for i := range nc.Plugins {
+		if nc.hasCapability(i, capability) {
+			plugins = append(plugins, i)
+		}
+	}
+	return plugins
+}
+
+// pluginConfig builds the stdin config for plugin i of the chain.  Capability
+// arguments are only passed to plugins declaring the capability.
+func (nc *netConf) pluginConfig(i int, prevResult []byte, rt *cniRuntime) ([]byte, error) {
+	conf := make(map[string]interface{})
+	for k, v := range nc.Plugins[i] {
+		conf[k] = v
+	}
+	conf["name"] = nc.Name
+	if nc.CNIVersion != "" {
+		conf["cniVersion"] = nc.CNIVersion
+	}
+	if prevResult != nil {
+		conf["prevResult"] = json.RawMessage(prevResult)
+	}
+
+	runtimeConfig := make(map[string]interface{})
+	for capability, arg := range rt.CapabilityArgs {
+		if nc.hasCapability(i, capability) {
+			runtimeConfig[capability] = arg
+		}
+	}
+	if len(runtimeConfig) > 0 {
+		conf["runtimeConfig"] = runtimeConfig
+	}
+
+	if len(rt.ConfigArgs) > 0 {
+		args := make(map[string]interface{})
+		if confArgs, ok := conf["args"].(map[string]interface{}); ok {
+			for k, v := range confArgs {
+				args[k] = v
+			}
+		}
+		for k, v := range rt.ConfigArgs {
+			args[k] = v
+		}
+		conf["args"] = args
+	}
+
+	return json.Marshal(conf)
+}
+
+// replayConfig turns the config plugin i was given for ADD into its config
+// for a later command, replacing only the prevResult and the capability
+// arguments, which may have changed since (eg, published ports)
+func (nc *netConf) replayConfig(i int, addConfig []byte, prevResult []byte, rt *cniRuntime) ([]byte, error) {
+	var conf map[string]json.RawMessage
+	if err := json.Unmarshal(addConfig, &conf); err != nil {
+		return nil, fmt.Errorf("invalid stored config for plugin %d: %v", i, err)
+	}
+	delete(conf, "prevResult")
+	if prevResult != nil {
+		conf["prevResult"] = json.RawMessage(prevResult)
+	}
+
+	runtimeConfig := make(map[string]interface{})
+	for capability, arg := range rt.CapabilityArgs {
+		if nc.hasCapability(i, capability) {
+			runtimeConfig[capability] = arg
+		}
+	}
+	delete(conf, "runtimeConfig")
+	if len(runtimeConfig) > 0 {
+		data, err := json.Marshal(runtimeConfig)
+		if err != nil {
+			return nil, err
+		}
+		conf["runtimeConfig"] = data
+	}
+	return json.Marshal(conf)
+}
+
+// resolveNetConf loads the named network config and resolves its plugins
+// for the network
+func (driver *driver) resolveNetConf(confName string, nw *network) (*netConf, error) {
+	nc, err := findNetConf(driver.netconfpath, confName)
+	if err != nil {
+		return nil, err
+	}
+	if err := driver.resolvePlugins(nc, nw); err != nil {
+		return nil, fmt.Errorf("Network %s: %v", nc.Name, err)
+	}
+	return nc, nil
+}
+
+// joinNetConf builds the network config for a Join of a container with the
+// given labels, as far as it doesn't depend on the container's endpoint:
+// the config the conf rules pick, its plugins, the fields the network's
+// raw options set, the chain's adjustments for internal networks or the
+// capabilities the endpoint needs, the tuning plugin for its sysctls, a
+// cniVersion its plugins support if it has none, Docker's IPAM pools for
+// the network if its cni.dockerpools option is set, and the network's or
+// the default MTU if the config has none
+func (driver *driver) joinNetConf(confName string, nw *network, labels map[string]string, endpointOptions map[string]interface{}) (*netConf, error) {
+	confName = driver.selectConf(confName, nw, labels)
+	nc, err := driver.resolveNetConf(confName, nw)
+	if err != nil {
+		return nil, err
+	}
+	if err := nc.applyRawFields(nw.RawFields); err != nil {
+		return nil, err
+	}
+	if nw.Internal {
+		nc.makeInternal()
+	} else if err := driver.appendFallbackPlugins(nc, requestedCapabilities(nw, endpointOptions)); err != nil {
+		return nil, wrapf(err, "Network %s", nc.Name)
+	}
+	if err := driver.appendTuning(nc, nw.Sysctls); err != nil {
+		return nil, wrapf(err, "Network %s", nc.Name)
+	}
+	if err := driver.negotiateVersion(nc); err != nil {
+		return nil, wrapf(err, "Network %s", nc.Name)
+	}
+
+	// Allocate from the pools Docker picked for the network, if it asks
+	// to, so Docker's view of the network's addressing matches ours
+	ranges, err := nw.ipamRanges()
+	if err != nil {
+		return nil, fmt.Errorf("Network %s: %v", nc.Name, err)
+	}
+	if len(ranges) > 0 {
+		debugf("Network %s IPAM ranges from Docker: %+v", nc.Name, ranges)
+		nc.setIPAMRanges(ranges)
+	}
+
+	// libnetwork's Join response has no MTU, so the plugins must set it
+	if mtu := driver.forcedMTU(nc, nw); mtu > 0 && !nc.setMTU(mtu) {
+		log.Printf("Network %s has no plugin that takes an MTU; leaving its MTU to the plugins", nc.Name)
+	}
+	return nc, nil
+}
@@ -0,0 +1,216 @@
+package driver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestFindNetConfPrecedence(t *testing.T) {
+	tests := []struct {
+		name  string
+		files []string
+		want  string
+	}{
+		{
+			name:  "conflist before conf",
+			files: []string{"10-net.conf", "20-net.conflist"},
+			want:  "20-net.conflist",
+		},
+		{
+			name:  "conflist before json",
+			files: []string{"10-net.json", "20-net.conflist"},
+			want:  "20-net.conflist",
+		},
+		{
+			name:  "first conflist by filename",
+			files: []string{"20-net.conflist", "10-net.conflist"},
+			want:  "10-net.conflist",
+		},
+		{
+			name:  "conf and json by filename",
+			files: []string{"20-net.conf", "10-net.json"},
+			want:  "10-net.json",
+		},
+		{
+			name:  "single conf",
+			files: []string{"10-net.conf"},
+			want:  "10-net.conf",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "netconf")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			for _, file := range tt.files {
+				var data string
+				if filepath.Ext(file) == ".conflist" {
+					data = `{"name": "net", "plugins": [{"type": "bridge"}]}`
+				} else {
+					data = `{"name": "net", "type": "bridge"}`
+				}
+				if err := ioutil.WriteFile(filepath.Join(dir, file), []byte(data), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			nc, err := findNetConf(dir, "net")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := filepath.Base(nc.Path); got != tt.want {
+				t.Errorf("findNetConf picked %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFindNetConfByName(t *testing.T) {
+	dir, err := ioutil.TempDir("", "netconf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for i, name := range []string{"a", "b"} {
+		data := fmt.Sprintf(`{"name": %q, "plugins": [{"type": "bridge"}]}`, name)
+		if err := ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("%d.conflist", i)), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	nc, err := findNetConf(dir, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nc.Name != "b" || filepath.Base(nc.Path) != "1.conflist" {
+		t.Errorf("findNetConf(b) = %s from %s", nc.Name, nc.Path)
+	}
+	if _, err := findNetConf(dir, "c"); err == nil {
+		t.Errorf("findNetConf(c) found a config")
+	}
+}
+
+func TestDelUsesAddConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "netconf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	plugins := filepath.Join(dir, "plugins")
+	if err := os.Mkdir(plugins, 0755); err != nil {
+		t.Fatal(err)
+	}
+	writePlugin(t, plugins, "rec", `cat > "$(dirname "$0")/$CNI_COMMAND.json"
+if [ "$CNI_COMMAND" = ADD ]; then
+	echo '{"cniVersion": "0.4.0", "ips": [{"version": "4", "address": "10.0.0.2/24"}]}'
+fi
+`)
+	confPath := filepath.Join(dir, "10-net.conflist")
+	writeConf := func(bridge string) {
+		data := fmt.Sprintf(`{"cniVersion": "0.4.0", "name": "net", "plugins": [{"type": "rec", "bridge": %q}]}`, bridge)
+		if err := ioutil.WriteFile(confPath, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	d := &driver{plugpath: plugins, breaker: newBreaker(0, 0, 0), latency: newPluginLatency()}
+	rt := &cniRuntime{ContainerID: "c1", IfName: "eth0"}
+	writeConf("br0")
+	nc, err := findNetConf(dir, "net")
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, addConfigs, err := d.addNetwork(nc, rt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The config changes on disk between Join and Leave
+	writeConf("br1")
+	changed, err := findNetConf(dir, "net")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.delNetwork(changed, rt, result, addConfigs); err != nil {
+		t.Fatal(err)
+	}
+
+	var add, del map[string]interface{}
+	for name, conf := range map[string]*map[string]interface{}{"ADD.json": &add, "DEL.json": &del} {
+		data, err := ioutil.ReadFile(filepath.Join(plugins, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal(data, conf); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+	}
+	if del["bridge"] != "br0" {
+		t.Errorf("DEL got bridge %v, want br0 as ADD got", del["bridge"])
+	}
+	if _, ok := del["prevResult"]; !ok {
+		t.Errorf("DEL config has no prevResult: %v", del)
+	}
+	delete(del, "prevResult")
+	if !reflect.DeepEqual(del, add) {
+		t.Errorf("DEL config %v, want ADD's %v", del, add)
+	}
+}
+
+func TestReplayConfig(t *testing.T) {
+	nc := &netConf{Name: "net", Plugins: []map[string]interface{}{
+		{"type": "portmap", "capabilities": map[string]interface{}{"portMappings": true}},
+	}}
+	addConfig := []byte(`{"cniVersion": "0.4.0", "name": "net", "type": "portmap", "snat": false,
+		"prevResult": {"cniVersion": "0.4.0"}, "runtimeConfig": {"portMappings": [{"hostPort": 80}]}}`)
+	tests := []struct {
+		name       string
+		prevResult []byte
+		capArgs    map[string]interface{}
+		want       string
+	}{
+		{
+			name: "no result or capabilities",
+			want: `{"cniVersion": "0.4.0", "name": "net", "type": "portmap", "snat": false}`,
+		},
+		{
+			name:       "new result and ports",
+			prevResult: []byte(`{"cniVersion": "0.4.0", "ips": []}`),
+			capArgs:    map[string]interface{}{"portMappings": []int{8080}, "bandwidth": 1},
+			want: `{"cniVersion": "0.4.0", "name": "net", "type": "portmap", "snat": false,
+				"prevResult": {"cniVersion": "0.4.0", "ips": []}, "runtimeConfig": {"portMappings": [8080]}}`,
+		},
+	}
+
+	for _, tt := range tests {
+		got, err := nc.replayConfig(0, addConfig, tt.prevResult, &cniRuntime{CapabilityArgs: tt.capArgs})
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		var gotConf, wantConf interface{}
+		if err := json.Unmarshal(got, &gotConf); err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal([]byte(tt.want), &wantConf); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(gotConf, wantConf) {
+			t.Errorf("%s: replayConfig() = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+
+	if _, err := nc.replayConfig(0, []byte("{"), nil, &cniRuntime{}); err == nil {
+		t.Errorf("replayConfig() of an invalid stored config succeeded")
+	}
+}
@@ -0,0 +1,171 @@
+package driver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+
+	docker "github.com/dcbw/go-dockerclient"
+)
+
+// The network option naming the CNI network config to use, for when it
+// isn't named after the Docker network
+const confNameOption = "cni.network"
+
+// networkMapEntry statically configures a Docker network.  The network map
+// is a JSON object of these keyed by Docker network ID or name.
+type networkMapEntry struct {
+	// name of the CNI network config
+	Conf string `json:"conf"`
+	// plugin search path overriding ours for this network
+	Path string `json:"path,omitempty"`
+	// DNS settings for when the plugins don't give all of them
+	DNS *cniDNS `json:"dns,omitempty"`
+	// prefix of the names libnetwork gives container interfaces
+	DstPrefix string `json:"dstPrefix,omitempty"`
+}
+
+func loadNetworkMap(path string) (map[string]*networkMapEntry, error) {
+	netmap := make(map[string]*networkMapEntry)
+	if path == "" {
+		return netmap, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &netmap); err != nil {
+		return nil, fmt.Errorf("failed to parse network map %s: %v", path, err)
+	}
+	for key, entry := range netmap {
+		if entry == nil || entry.Conf == "" {
+			return nil, fmt.Errorf("network map entry %s has no conf", key)
+		}
+		if entry.DNS != nil {
+			if err := entry.DNS.validate(); err != nil {
+				return nil, fmt.Errorf("network map entry %s: %v", key, err)
+			}
+		}
+		if entry.DstPrefix != "" {
+			if err := validateIfPrefix(entry.DstPrefix); err != nil {
+				return nil, fmt.Errorf("network map entry %s: %v", key, err)
+			}
+		}
+	}
+	return netmap, nil
+}
+
+// networkConfName returns the name of the CNI network config for a Docker
+// network: from the network's options, else the network map, else the
+// Docker network's own name
+func (driver *driver) networkConfName(networkID string) (string, error) {
+	if name := driver.createdNetwork(networkID).Options[confNameOption]; name != "" {
+		return name, nil
+	}
+	if entry, ok := driver.networkMap[networkID]; ok {
+		return entry.Conf, nil
+	}
+	if driver.noWatch {
+		return "", fmt.Errorf("network %s has no %s option and is not in the network map", networkID, confNameOption)
+	}
+
+	nw, err := driver.watchedNetwork(networkID)
+	if err != nil {
+		return "", err
+	}
+	if entry, ok := driver.networkMap[nw.Name]; ok {
+		return entry.Conf, nil
+	}
+	return nw.Name, nil
+}
+
+// createdNetwork returns what CreateNetwork told us of a network.  We missed
+// that for networks created before we started, so rebuild those from
+// Docker's view of the network and remember them; a network we can't look
+// up is treated as having no options.
+func (driver *driver) createdNetwork(networkID string) *network {
+	if nw := driver.networks.get(networkID); nw != nil {
+		return nw
+	}
+	info, err := driver.watchedNetwork(networkID)
+	if err != nil {
+		return &network{ID: networkID, Options: map[string]string{}}
+	}
+	nw, err := networkFromDocker(info)
+	if err != nil {
+		log.Printf("Network %s has invalid options, ignoring them: %v", networkID, err)
+		return &network{ID: networkID, Options: map[string]string{}}
+	}
+	log.Printf("Network %s options recovered from Docker: %v", networkID, nw.Options)
+	driver.networks.add(nw)
+	return nw
+}
+
+// networkMapEntry returns the network map's entry for a network, by ID or
+// else by the name of the watched network
+func (driver *driver) networkMapEntry(networkID string) *networkMapEntry {
+	if entry, ok := driver.networkMap[networkID]; ok {
+		return entry
+	}
+	if nw := driver.watcher.GetNetworkById(networkID); nw != nil {
+		return driver.networkMap[nw.Name]
+	}
+	return nil
+}
+
+// networkKnown returns whether we know of the network from CreateNetwork or
+// Docker's events; deleting it forgets it
+func (driver *driver) networkKnown(networkID string) bool {
+	return driver.networks.has(networkID) || driver.watcher.GetNetworkById(networkID) != nil
+}
+
+// Joins of networks we can't resolve fail with one of these prefixes, so
+// automation can tell a network Docker doesn't have, which is a 404 and
+// not worth retrying, from one we couldn't look up, which is retryable
+const (
+	networkNotFoundPrefix   = "network not found: "
+	networkNotWatchedPrefix = "network not watched: "
+)
+
+// networkNotFoundError is a network Docker says doesn't exist
+type networkNotFoundError struct {
+	id string
+}
+
+func (e *networkNotFoundError) Error() string {
+	return fmt.Sprintf("%snetwork %s does not exist in Docker", networkNotFoundPrefix, e.id)
+}
+
+// networkLookupError wraps the failure to look up a network we aren't
+// watching, telling the two cases apart
+func networkLookupError(networkID string, err error) error {
+	if isNoSuchNetwork(err) {
+		return &networkNotFoundError{id: networkID}
+	}
+	return transientf("%snetwork %s is not watched and looking it up failed: %v", networkNotWatchedPrefix, networkID, err)
+}
+
+func isNoSuchNetwork(err error) bool {
+	_, ok := err.(*docker.NoSuchNetwork)
+	return ok
+}
+
+// watchedNetwork returns the watched network.  We may have missed it if its
+// CreateNetwork lookup failed or it was created before we started, so look
+// unknown networks up in Docker directly and watch them from now on.
+func (driver *driver) watchedNetwork(networkID string) (*docker.Network, error) {
+	if nw := driver.watcher.GetNetworkById(networkID); nw != nil {
+		return nw, nil
+	}
+
+	log.Printf("Network %s is not watched (did its CreateNetwork lookup fail, or did we restart?); asking Docker", networkID)
+	nw, err := driver.NetworkInfo(networkID)
+	if err != nil {
+		err = networkLookupError(networkID, err)
+		log.Printf("Network %s lookup: %v", networkID, err)
+		return nil, err
+	}
+	driver.watcher.WatchNetwork(nw)
+	return nw, nil
+}
@@ -0,0 +1,51 @@
+package driver
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	docker "github.com/dcbw/go-dockerclient"
+)
+
+func TestNetworkLookupError(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		prefix    string
+		notFound  bool
+		transient bool
+	}{
+		{
+			name:     "no such network",
+			err:      &docker.NoSuchNetwork{ID: "n1"},
+			prefix:   networkNotFoundPrefix,
+			notFound: true,
+		},
+		{
+			name:      "timeout",
+			err:       errors.New("docker network info n1 timed out after 5s"),
+			prefix:    networkNotWatchedPrefix,
+			transient: true,
+		},
+		{
+			name:      "other not found",
+			err:       errors.New("socket not found"),
+			prefix:    networkNotWatchedPrefix,
+			transient: true,
+		},
+	}
+
+	for _, tt := range tests {
+		err := networkLookupError("n1", tt.err)
+		if _, ok := err.(*networkNotFoundError); ok != tt.notFound {
+			t.Errorf("%s: networkLookupError() = %T, want not found %v", tt.name, err, tt.notFound)
+		}
+		if isTransient(err) != tt.transient {
+			t.Errorf("%s: networkLookupError() transient = %v, want %v", tt.name, isTransient(err), tt.transient)
+		}
+		if !strings.HasPrefix(err.Error(), tt.prefix) {
+			t.Errorf("%s: networkLookupError() = %q, want prefix %q", tt.name, err, tt.prefix)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package driver
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+const (
+	// Docker bind-mounts each sandbox's network namespace here
+	dockerNetnsDir = "/var/run/docker/netns"
+
+	// statfs magic of namespace files; before Linux 3.19 they were on proc
+	nsfsMagic = 0x6e736673
+	procMagic = 0x9fa0
+)
+
+// sandboxKeyToNetns converts a libnetwork SandboxKey to the path of the
+// network namespace for CNI_NETNS.  Docker normally sends the absolute path
+// of the netns bind mount, but we also accept it relative to / or /var/run,
+// or just the bare sandbox ID.
+func sandboxKeyToNetns(key string) (string, error) {
+	if key == "" {
+		return "", fmt.Errorf("empty sandbox key")
+	}
+	for _, elem := range strings.Split(key, "/") {
+		if elem == ".." {
+			return "", fmt.Errorf("invalid sandbox key %q", key)
+		}
+	}
+
+	switch {
+	case filepath.IsAbs(key):
+		return filepath.Clean(key), nil
+	case strings.HasPrefix(key, "var/run/"):
+		return filepath.Join("/", key), nil
+	case strings.HasPrefix(key, "run/"):
+		return filepath.Join("/var", key), nil
+	case strings.HasPrefix(key, "docker/netns/"):
+		return filepath.Join("/var/run", key), nil
+	case !strings.Contains(key, "/"):
+		return filepath.Join(dockerNetnsDir, key), nil
+	}
+	return "", fmt.Errorf("unrecognized sandbox key %q", key)
+}
+
+// checkNetns verifies that path is still a network namespace, since the
+// container may have exited since we looked it up
+func checkNetns(path string) error {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("container netns %s no longer exists", path)
+		}
+		return fmt.Errorf("failed to check container netns %s: %v", path, err)
+	}
+	if st.Type != nsfsMagic && st.Type != procMagic {
+		return fmt.Errorf("container netns %s is not a network namespace", path)
+	}
+	return nil
+}
+
+// checkMasterInterfaces verifies the host interfaces a network config's
+// plugins attach to exist, since plugins fail obscurely when they don't.
+// A missing one may yet be created, so that is transient.
+func checkMasterInterfaces(nc *netConf) error {
+	for _, master := range nc.masterInterfaces() {
+		if _, err := os.Stat(filepath.Join("/sys/class/net", master)); err != nil {
+			if os.IsNotExist(err) {
+				return transientf("network %s master interface %s not found", nc.Name, master)
+			}
+			return fmt.Errorf("network %s master interface %s: %v", nc.Name, master, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+package driver
+
+import (
+	"testing"
+)
+
+func TestSandboxKeyToNetns(t *testing.T) {
+	tests := []struct {
+		key     string
+		want    string
+		wantErr bool
+	}{
+		{key: "/var/run/docker/netns/abc123", want: "/var/run/docker/netns/abc123"},
+		{key: "/run/docker/netns/abc123", want: "/run/docker/netns/abc123"},
+		{key: "/var/run/docker/netns//abc123/", want: "/var/run/docker/netns/abc123"},
+		{key: "var/run/docker/netns/abc123", want: "/var/run/docker/netns/abc123"},
+		{key: "run/docker/netns/abc123", want: "/var/run/docker/netns/abc123"},
+		{key: "docker/netns/abc123", want: "/var/run/docker/netns/abc123"},
+		{key: "abc123", want: "/var/run/docker/netns/abc123"},
+		{key: "", wantErr: true},
+		{key: "/var/run/docker/netns/../../../etc", wantErr: true},
+		{key: "../abc123", wantErr: true},
+		{key: "tmp/netns/abc123", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := sandboxKeyToNetns(tt.key)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("sandboxKeyToNetns(%q) error = %v, want error %v", tt.key, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("sandboxKeyToNetns(%q) = %q, want %q", tt.key, got, tt.want)
+		}
+	}
+}
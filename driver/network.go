@@ -0,0 +1,268 @@
+package driver
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+
+	docker "github.com/dcbw/go-dockerclient"
+)
+
+const (
+	genericOption = "com.docker.network.generic"
+	// set by "docker network create --internal"
+	internalOption = "com.docker.network.internal"
+
+	// -o cni.plugin.<type>=<binary> runs the named binary for plugins of
+	// the given type on this network
+	pluginBinaryOptionPrefix = "cni.plugin."
+	// overrides the plugin search path, and so CNI_PATH, for the network
+	pluginPathOption = "cni.path"
+	// when true, the network's IPAM allocates from the pools Docker chose
+	// for it rather than the ranges in its config
+	dockerPoolsOption = "cni.dockerpools"
+)
+
+// IPAM plugins whose config takes host-local style ranges
+var rangesIPAMTypes = map[string]bool{
+	"host-local": true,
+}
+
+// network records what Docker told us about a network at CreateNetwork;
+// Docker doesn't include any of it in later requests.  Networks we didn't
+// see created are rebuilt from Docker's own view of them, see
+// networkFromDocker.
+type network struct {
+	ID string
+	// driver options given with "docker network create -o"
+	Options map[string]string
+	// capability arguments from the options, for every endpoint
+	CapabilityArgs map[string]interface{}
+	// config fields set by the options, for every endpoint
+	RawFields []*rawField
+	// interface sysctls from the options, set by an appended tuning plugin
+	Sysctls map[string]string
+	// pools Docker's IPAM chose for the network
+	IPv4Data []*ipamData
+	IPv6Data []*ipamData
+	// whether the network is cut off from outside the host
+	Internal bool
+}
+
+// libnetwork's IPAMData
+type ipamData struct {
+	AddressSpace string
+	Pool         string
+	Gateway      string
+	AuxAddresses map[string]string
+}
+
+// newNetwork parses and validates a network's driver options
+func newNetwork(id string, options map[string]string, ipv4Data, ipv6Data []*ipamData, internal bool) (*network, error) {
+	if _, err := optionMTU(options); err != nil {
+		return nil, err
+	}
+	if _, err := optionDNS(options); err != nil {
+		return nil, err
+	}
+	if _, err := boolOption(options, hostsOption); err != nil {
+		return nil, err
+	}
+	if _, err := boolOption(options, dockerPoolsOption); err != nil {
+		return nil, err
+	}
+	if _, _, err := optionGateways(options); err != nil {
+		return nil, err
+	}
+	if _, err := parseCNIArgs(options[cniArgsKey]); err != nil {
+		return nil, err
+	}
+	if prefix, ok := options[dstPrefixOption]; ok {
+		if err := validateIfPrefix(prefix); err != nil {
+			return nil, fmt.Errorf("invalid %s option: %v", dstPrefixOption, err)
+		}
+	}
+	capabilityArgs, err := networkCapabilityArgs(options)
+	if err != nil {
+		return nil, err
+	}
+	rawFields, err := networkRawFields(options)
+	if err != nil {
+		return nil, err
+	}
+	sysctls, err := networkSysctls(options)
+	if err != nil {
+		return nil, err
+	}
+	return &network{
+		ID:             id,
+		Options:        options,
+		CapabilityArgs: capabilityArgs,
+		RawFields:      rawFields,
+		Sysctls:        sysctls,
+		IPv4Data:       ipv4Data,
+		IPv6Data:       ipv6Data,
+		Internal:       internal,
+	}, nil
+}
+
+// networkFromDocker rebuilds a network from Docker's inspect data, which
+// has the options and pools CreateNetwork gave us, for networks created
+// before we started
+func networkFromDocker(nw *docker.Network) (*network, error) {
+	var ipv4Data, ipv6Data []*ipamData
+	for _, config := range nw.IPAM.Config {
+		if config.Subnet == "" {
+			continue
+		}
+		_, subnet, err := net.ParseCIDR(config.Subnet)
+		if err != nil {
+			return nil, fmt.Errorf("invalid subnet %q: %v", config.Subnet, err)
+		}
+		data := &ipamData{
+			Pool:         subnet.String(),
+			AuxAddresses: config.AuxAddress,
+		}
+		// libnetwork gives CreateNetwork the gateway in CIDR form, but
+		// inspect doesn't
+		if config.Gateway != "" {
+			gw := net.ParseIP(config.Gateway)
+			if gw == nil {
+				return nil, fmt.Errorf("invalid gateway %q", config.Gateway)
+			}
+			data.Gateway = (&net.IPNet{IP: gw, Mask: subnet.Mask}).String()
+		}
+		if subnet.IP.To4() != nil {
+			ipv4Data = append(ipv4Data, data)
+		} else {
+			ipv6Data = append(ipv6Data, data)
+		}
+	}
+	options := make(map[string]string)
+	for k, v := range nw.Options {
+		options[k] = v
+	}
+	return newNetwork(nw.ID, options, ipv4Data, ipv6Data, nw.Internal)
+}
+
+// ipamRanges converts the network's pools to host-local style ranges, one
+// range set per address family, if its cni.dockerpools option asks for
+// them.  Docker picks a default pool for networks created without
+// --subnet, which we can't tell from one the user gave, so using Docker's
+// pools is opt-in rather than changing the addressing of existing configs.
+func (nw *network) ipamRanges() ([][]map[string]interface{}, error) {
+	if use, err := boolOption(nw.Options, dockerPoolsOption); !use || err != nil {
+		return nil, err
+	}
+	var ranges [][]map[string]interface{}
+	for _, data := range [][]*ipamData{nw.IPv4Data, nw.IPv6Data} {
+		var set []map[string]interface{}
+		for _, d := range data {
+			if d.Pool == "" {
+				continue
+			}
+			_, subnet, err := net.ParseCIDR(d.Pool)
+			if err != nil {
+				return nil, fmt.Errorf("invalid pool %q: %v", d.Pool, err)
+			}
+			r := map[string]interface{}{
+				"subnet": subnet.String(),
+			}
+			// Docker gives the gateway in CIDR form
+			if d.Gateway != "" {
+				gw, _, err := net.ParseCIDR(d.Gateway)
+				if err != nil {
+					return nil, fmt.Errorf("invalid gateway %q: %v", d.Gateway, err)
+				}
+				r["gateway"] = gw.String()
+			}
+			set = append(set, r)
+		}
+		if len(set) > 0 {
+			ranges = append(ranges, set)
+		}
+	}
+	return ranges, nil
+}
+
+// genericOptions extracts the user's driver options from a CreateNetwork
+// request's options
+func genericOptions(options map[string]interface{}) (map[string]string, error) {
+	generic := make(map[string]string)
+	opt, ok := options[genericOption]
+	if !ok {
+		return generic, nil
+	}
+	values, ok := opt.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid %s option %v", genericOption, opt)
+	}
+	for k, v := range values {
+		s, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("network option %s is not a string", k)
+		}
+		generic[k] = s
+	}
+	return generic, nil
+}
+
+// boolOption returns the value of a boolean network option, or false if it
+// isn't set
+func boolOption(options map[string]string, name string) (bool, error) {
+	value, ok := options[name]
+	if !ok {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s option %q", name, value)
+	}
+	return b, nil
+}
+
+// internal tells if a CreateNetwork request's options make it internal
+func internal(options map[string]interface{}) bool {
+	internal, _ := options[internalOption].(bool)
+	return internal
+}
+
+type networks struct {
+	sync.Mutex
+	byID map[string]*network
+}
+
+func newNetworks() *networks {
+	return &networks{
+		byID: make(map[string]*network),
+	}
+}
+
+func (n *networks) add(nw *network) {
+	n.Lock()
+	defer n.Unlock()
+	n.byID[nw.ID] = nw
+}
+
+// get returns the network, or nil if Docker never told us about it (eg, it
+// was created before we started)
+func (n *networks) get(id string) *network {
+	n.Lock()
+	defer n.Unlock()
+	return n.byID[id]
+}
+
+// has returns whether Docker told us about the network and hasn't deleted it
+func (n *networks) has(id string) bool {
+	n.Lock()
+	defer n.Unlock()
+	_, ok := n.byID[id]
+	return ok
+}
+
+func (n *networks) remove(id string) {
+	n.Lock()
+	defer n.Unlock()
+	delete(n.byID, id)
+}
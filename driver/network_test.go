@@ -0,0 +1,88 @@
+package driver
+
+import (
+	"reflect"
+	"testing"
+
+	docker "github.com/dcbw/go-dockerclient"
+)
+
+func TestNetworkFromDocker(t *testing.T) {
+	tests := []struct {
+		name     string
+		network  *docker.Network
+		ipv4Data []*ipamData
+		ipv6Data []*ipamData
+		wantErr  bool
+	}{
+		{
+			name:    "no IPAM",
+			network: &docker.Network{ID: "n1", Options: map[string]string{confNameOption: "net"}},
+		},
+		{
+			name: "dual stack pools",
+			network: &docker.Network{ID: "n1", IPAM: docker.IPAMOptions{Config: []docker.IPAMConfig{
+				{Subnet: "10.1.0.0/16", Gateway: "10.1.0.1"},
+				{Subnet: "fd00::/64", Gateway: "fd00::1"},
+				{Subnet: "10.2.0.0/16"},
+			}}},
+			ipv4Data: []*ipamData{
+				{Pool: "10.1.0.0/16", Gateway: "10.1.0.1/16"},
+				{Pool: "10.2.0.0/16"},
+			},
+			ipv6Data: []*ipamData{{Pool: "fd00::/64", Gateway: "fd00::1/64"}},
+		},
+		{
+			name:    "invalid option",
+			network: &docker.Network{ID: "n1", Options: map[string]string{cniArgsKey: "A"}},
+			wantErr: true,
+		},
+		{
+			name: "invalid gateway",
+			network: &docker.Network{ID: "n1", IPAM: docker.IPAMOptions{Config: []docker.IPAMConfig{
+				{Subnet: "10.1.0.0/16", Gateway: "gateway"},
+			}}},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		nw, err := networkFromDocker(tt.network)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: networkFromDocker() error = %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr {
+			continue
+		}
+		if nw.ID != tt.network.ID || len(nw.Options) != len(tt.network.Options) {
+			t.Errorf("%s: networkFromDocker() = %s %v, want %s %v", tt.name, nw.ID, nw.Options, tt.network.ID, tt.network.Options)
+		}
+		if !reflect.DeepEqual(nw.IPv4Data, tt.ipv4Data) || !reflect.DeepEqual(nw.IPv6Data, tt.ipv6Data) {
+			t.Errorf("%s: networkFromDocker() pools = %+v %+v, want %+v %+v", tt.name, nw.IPv4Data, nw.IPv6Data, tt.ipv4Data, tt.ipv6Data)
+		}
+	}
+}
+
+func TestCreatedNetworkFromWatcher(t *testing.T) {
+	d := &driver{
+		networks: newNetworks(),
+		watcher: &watcher{networks: map[string]*docker.Network{
+			"n1": {ID: "n1", Name: "docker-net", Options: map[string]string{confNameOption: "cni-net", dockerPoolsOption: "true"}},
+		}},
+	}
+
+	name, err := d.networkConfName("n1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "cni-net" {
+		t.Errorf("networkConfName() = %s, want the cni-net option", name)
+	}
+	if !d.networks.has("n1") {
+		t.Errorf("rebuilt network n1 wasn't remembered")
+	}
+	if use, _ := boolOption(d.createdNetwork("n1").Options, dockerPoolsOption); !use {
+		t.Errorf("createdNetwork() lost the %s option", dockerPoolsOption)
+	}
+}
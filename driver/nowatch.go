@@ -0,0 +1,111 @@
+package driver
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	docker "github.com/dcbw/go-dockerclient"
+)
+
+// how often a no-watch Join looks for its container again
+const containerPollInterval = 250 * time.Millisecond
+
+// directWatcher is the Watcher for --no-watch mode.  It neither listens for
+// events nor tracks networks, and inspects containers on demand instead of
+// caching them.  That avoids needing Docker's events, at the cost of
+// listing and inspecting every running or created container on each Join.
+type directWatcher struct {
+	dockerer
+}
+
+func NewDirectWatcher(client *dockerClient, apiTimeout time.Duration) Watcher {
+	return &directWatcher{
+		dockerer: dockerer{
+			client:  client,
+			timeout: apiTimeout,
+		},
+	}
+}
+
+func (w *directWatcher) WatchNetwork(nw *docker.Network) {
+}
+
+func (w *directWatcher) UnwatchNetwork(id string) {
+}
+
+func (w *directWatcher) GetNetworkById(id string) *docker.Network {
+	return nil
+}
+
+func (w *directWatcher) GetContainerBySandboxKey(sandbox string) *docker.Container {
+	list, err := w.ListContainers(liveContainersOptions)
+	if err != nil {
+		log.Printf("error listing containers: %s", err)
+		return nil
+	}
+	for _, c := range list {
+		container, err := w.InspectContainer(c.ID)
+		if err != nil {
+			log.Printf("error inspecting container %s: %s", c.ID, err)
+			continue
+		}
+		if container.NetworkSettings != nil && container.NetworkSettings.SandboxKey == sandbox {
+			return container
+		}
+	}
+	return nil
+}
+
+func (w *directWatcher) WaitContainerBySandboxKey(sandbox string, timeout time.Duration) *docker.Container {
+	deadline := time.Now().Add(timeout)
+	for {
+		if container := w.GetContainerBySandboxKey(sandbox); container != nil {
+			return container
+		}
+		if time.Now().After(deadline) {
+			return nil
+		}
+		time.Sleep(containerPollInterval)
+	}
+}
+
+func (w *directWatcher) GetContainer(id string) *docker.Container {
+	container, err := w.InspectContainer(id)
+	if err != nil {
+		log.Printf("error inspecting container %s: %s", id, err)
+		return nil
+	}
+	return container
+}
+
+func (w *directWatcher) GetContainerNetns(id string) (string, error) {
+	container, err := w.InspectContainer(id)
+	if err != nil {
+		return "", err
+	}
+	pid := container.State.Pid
+	if pid <= 0 {
+		return "", fmt.Errorf("Container %s not running", id)
+	}
+	return fmt.Sprintf("/proc/%d/ns/net", pid), nil
+}
+
+func (w *directWatcher) WaitContainerNetns(id string, timeout time.Duration) (string, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		netns, err := w.GetContainerNetns(id)
+		if err == nil || time.Now().After(deadline) {
+			return netns, err
+		}
+		time.Sleep(containerPollInterval)
+	}
+}
+
+func (w *directWatcher) Resync() (*ResyncSummary, error) {
+	return &ResyncSummary{}, nil
+}
+
+func (w *directWatcher) Reconnect() error {
+	return nil
+}
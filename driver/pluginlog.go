@@ -0,0 +1,57 @@
+package driver
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+)
+
+// longest stderr line we hold back waiting for its newline; longer ones
+// are logged in pieces
+const maxPluginLogLine = 4096
+
+// pluginLogger logs a plugin's stderr through our logger a line at a time,
+// each prefixed with the plugin and endpoint it came from, so diagnostics
+// of plugins running at once can be told apart
+type pluginLogger struct {
+	prefix string
+	line   []byte
+}
+
+func newPluginLogger(plugin string, rt *cniRuntime) *pluginLogger {
+	prefix := fmt.Sprintf("[plugin:%s]", plugin)
+	if rt.EndpointID != "" {
+		prefix = fmt.Sprintf("[plugin:%s ep:%s]", plugin, rt.EndpointID)
+	}
+	return &pluginLogger{prefix: prefix}
+}
+
+func (l *pluginLogger) Write(p []byte) (int, error) {
+	l.line = append(l.line, p...)
+	for {
+		i := bytes.IndexByte(l.line, '\n')
+		if i < 0 {
+			break
+		}
+		l.logLine(l.line[:i])
+		l.line = l.line[i+1:]
+	}
+	if len(l.line) >= maxPluginLogLine {
+		l.flush()
+	}
+	return len(p), nil
+}
+
+// flush logs whatever is left of an unterminated last line
+func (l *pluginLogger) flush() {
+	if len(l.line) > 0 {
+		l.logLine(l.line)
+	}
+	l.line = nil
+}
+
+func (l *pluginLogger) logLine(line []byte) {
+	if line = bytes.TrimRight(line, "\r"); len(line) > 0 {
+		log.Printf("%s %s", l.prefix, line)
+	}
+}
@@ -0,0 +1,193 @@
+package driver
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+)
+
+const (
+	portMapOption          = "com.docker.network.portmap"
+	portMappingsCapability = "portMappings"
+)
+
+// libnetwork's types.PortBinding
+type portBinding struct {
+	Proto       uint8
+	IP          net.IP
+	Port        uint16
+	HostIP      net.IP
+	HostPort    uint16
+	HostPortEnd uint16
+}
+
+// CNI's portMappings capability argument
+type portMapping struct {
+	HostPort      int    `json:"hostPort"`
+	ContainerPort int    `json:"containerPort"`
+	Protocol      string `json:"protocol"`
+	HostIP        string `json:"hostIP,omitempty"`
+}
+
+func protoName(proto uint8) (string, error) {
+	switch proto {
+	case 6:
+		return "tcp", nil
+	case 17:
+		return "udp", nil
+	case 132:
+		return "sctp", nil
+	}
+	return "", fmt.Errorf("unsupported port protocol %d", proto)
+}
+
+// portMappings translates the Docker port bindings in the options of a
+// ProgramExternalConnectivity request to CNI port mappings
+func portMappings(options map[string]interface{}) ([]portMapping, error) {
+	opt, ok := options[portMapOption]
+	if !ok {
+		return nil, nil
+	}
+	// Options arrive as generic JSON; round-trip to get typed bindings
+	data, err := json.Marshal(opt)
+	if err != nil {
+		return nil, err
+	}
+	var bindings []portBinding
+	if err := json.Unmarshal(data, &bindings); err != nil {
+		return nil, fmt.Errorf("invalid %s option: %v", portMapOption, err)
+	}
+
+	mappings := []portMapping{}
+	for _, b := range bindings {
+		if b.HostPort == 0 {
+			log.Printf("Skipping port %d with no host port", b.Port)
+			continue
+		}
+		proto, err := protoName(b.Proto)
+		if err != nil {
+			return nil, err
+		}
+		pm := portMapping{
+			HostPort:      int(b.HostPort),
+			ContainerPort: int(b.Port),
+			Protocol:      proto,
+		}
+		if b.HostIP != nil && !b.HostIP.IsUnspecified() {
+			pm.HostIP = b.HostIP.String()
+		}
+		mappings = append(mappings, pm)
+	}
+	return mappings, nil
+}
+
+// execPortMap runs cmd for the chain's portMappings-capable plugins with
+// the given mappings as their runtimeConfig
+func (driver *driver) execPortMap(ep *endpoint, cmd string, mappings []portMapping) error {
+	plugins := ep.Conf.capabilityPlugins(portMappingsCapability)
+	if len(plugins) == 0 {
+		return fmt.Errorf("network config %s has no plugin with the %s capability", ep.Conf.Name, portMappingsCapability)
+	}
+
+	rt := ep.Runtime.withCapabilityArg(portMappingsCapability, mappings)
+	for _, i := range plugins {
+		var config []byte
+		var err error
+		if i < len(ep.Configs) {
+			config, err = ep.Conf.replayConfig(i, ep.Configs[i], ep.Result, rt)
+		} else {
+			config, err = ep.Conf.pluginConfig(i, ep.Result, rt)
+		}
+		if err != nil {
+			return err
+		}
+		plugin := ep.Conf.pluginBinary(i)
+		if _, err := driver.execPlugin(plugin, cmd, rt, config); err != nil {
+			return fmt.Errorf("plugin %s failed the %s operation: %v", plugin, cmd, err)
+		}
+	}
+	return nil
+}
+
+type programExternalConnectivity struct {
+	NetworkID  string
+	EndpointID string
+	Options    map[string]interface{}
+}
+
+// Docker hands us the container's published ports after Join; these are
+// set up by (re)running the chain's portmap plugin
+func (driver *driver) programExternalConnectivity(w http.ResponseWriter, r *http.Request) {
+	var p programExternalConnectivity
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		sendError(w, "Could not decode JSON encode payload", http.StatusBadRequest)
+		return
+	}
+	log.Printf("Program external connectivity request: %+v", &p)
+
+	mappings, err := portMappings(p.Options)
+	if err != nil {
+		sendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(mappings) == 0 {
+		emptyResponse(w)
+		return
+	}
+
+	ep := driver.endpoints.get(p.EndpointID)
+	if ep == nil {
+		sendError(w, fmt.Sprintf("Endpoint %s has not been joined", p.EndpointID), http.StatusInternalServerError)
+		return
+	}
+
+	if err := driver.execPortMap(ep, "ADD", mappings); err != nil {
+		sendError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	driver.endpoints.setPortMappings(p.EndpointID, mappings)
+	if ep := driver.endpoints.get(p.EndpointID); ep != nil {
+		if err := driver.cache.write(ep); err != nil {
+			log.Printf("Failed to cache endpoint %s result: %v", ep.ID, err)
+		}
+	}
+
+	emptyResponse(w)
+	log.Printf("Programmed port mappings %+v for endpoint %s", mappings, p.EndpointID)
+}
+
+type revokeExternalConnectivity struct {
+	NetworkID  string
+	EndpointID string
+}
+
+func (driver *driver) revokeExternalConnectivity(w http.ResponseWriter, r *http.Request) {
+	var rev revokeExternalConnectivity
+	if err := json.NewDecoder(r.Body).Decode(&rev); err != nil {
+		sendError(w, "Could not decode JSON encode payload", http.StatusBadRequest)
+		return
+	}
+	log.Printf("Revoke external connectivity request: %+v", &rev)
+
+	ep := driver.endpoints.get(rev.EndpointID)
+	if ep == nil || len(ep.PortMappings) == 0 {
+		emptyResponse(w)
+		return
+	}
+
+	if err := driver.execPortMap(ep, "DEL", ep.PortMappings); err != nil {
+		sendError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	driver.endpoints.setPortMappings(rev.EndpointID, nil)
+	if ep := driver.endpoints.get(rev.EndpointID); ep != nil {
+		if err := driver.cache.write(ep); err != nil {
+			log.Printf("Failed to cache endpoint %s result: %v", ep.ID, err)
+		}
+	}
+
+	emptyResponse(w)
+	log.Printf("Revoked port mappings for endpoint %s", rev.EndpointID)
+}
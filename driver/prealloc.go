@@ -0,0 +1,154 @@
+package driver
+
+import (
+	"fmt"
+	"log"
+	"net"
+)
+
+// With --prealloc-ip, CreateEndpoint allocates the endpoint's address by
+// running the network config's IPAM plugin on its own, so Docker learns it
+// before Join.  Join then wires the endpoint up with that address through
+// the static IPAM plugin instead of allocating another, and DeleteEndpoint
+// releases it.  Preallocations are kept in the cache dir, so that they are
+// still released if we restart in between.
+
+// staticIPAM is the CNI IPAM plugin handing out fixed addresses
+const staticIPAM = "static"
+
+// preallocation is an address allocated at CreateEndpoint
+type preallocation struct {
+	// the network config it was allocated for
+	ConfName string
+	// the IPAM plugin and what it was run with, to release the address
+	Plugin  string
+	Config  []byte
+	Runtime *cniRuntime
+	Result  *cniResult
+	Mac     string
+}
+
+// ipamPlugin returns the index of the first plugin in the chain with an
+// IPAM section, and that section's plugin type
+func (nc *netConf) ipamPlugin() (int, string, bool) {
+	for i, plugin := range nc.Plugins {
+		if ipam, ok := plugin["ipam"].(map[string]interface{}); ok {
+			if t, _ := ipam["type"].(string); t != "" {
+				return i, t, true
+			}
+		}
+	}
+	return 0, "", false
+}
+
+// setStaticIPAM makes every plugin with an IPAM section use the static
+// IPAM plugin with the given addresses and routes
+func (nc *netConf) setStaticIPAM(addresses []map[string]interface{}, routes []*cniRoute) {
+	for _, plugin := range nc.Plugins {
+		if _, ok := plugin["ipam"].(map[string]interface{}); !ok {
+			continue
+		}
+		ipam := map[string]interface{}{
+			"type":      staticIPAM,
+			"addresses": addresses,
+		}
+		if len(routes) > 0 {
+			ipam["routes"] = routes
+		}
+		plugin["ipam"] = ipam
+	}
+}
+
+// staticAddresses returns the preallocated addresses and routes in the
+// static IPAM plugin's format
+func (p *preallocation) staticAddresses() ([]map[string]interface{}, []*cniRoute) {
+	var addresses []map[string]interface{}
+	var routes []*cniRoute
+	for _, ipc := range []*ipConfig{p.Result.IP4, p.Result.IP6} {
+		if ipc.address() == "" {
+			continue
+		}
+		address := map[string]interface{}{"address": ipc.IP}
+		if ipc.Gateway != "" {
+			address["gateway"] = ipc.Gateway
+		}
+		addresses = append(addresses, address)
+		routes = append(routes, ipc.Routes...)
+	}
+	return addresses, routes
+}
+
+// preallocate runs the network config's IPAM plugin for the endpoint and
+// records the allocation
+func (driver *driver) preallocate(networkID string, endpointID string) (*preallocation, error) {
+	confName, err := driver.networkConfName(networkID)
+	if err != nil {
+		return nil, err
+	}
+	netInfo := driver.createdNetwork(networkID)
+	nc, err := driver.resolveNetConf(confName, netInfo)
+	if err != nil {
+		return nil, err
+	}
+	ranges, err := netInfo.ipamRanges()
+	if err != nil {
+		return nil, fmt.Errorf("network %s: %v", nc.Name, err)
+	}
+	if len(ranges) > 0 {
+		nc.setIPAMRanges(ranges)
+	}
+
+	i, plugin, ok := nc.ipamPlugin()
+	if !ok {
+		return nil, fmt.Errorf("network %s has no IPAM to preallocate from", nc.Name)
+	}
+	// There's no container yet, so the allocation belongs to the endpoint
+	rt := &cniRuntime{
+		ContainerID: endpointID,
+		EndpointID:  endpointID,
+		IfName:      ipamIfName,
+		PluginPath:  nc.PluginPath,
+	}
+	config, err := nc.pluginConfig(i, nil, rt)
+	if err != nil {
+		return nil, err
+	}
+	// Until the allocation is recorded, GC wouldn't know to keep it
+	defer driver.gcLocks.adding(nc.Name)()
+	output, err := driver.execPlugin(plugin, "ADD", rt, config)
+	if err != nil {
+		return nil, fmt.Errorf("IPAM plugin %s failed: %v", plugin, err)
+	}
+	p := &preallocation{ConfName: nc.Name, Plugin: plugin, Config: config, Runtime: rt}
+	if p.Result, err = parseResult(output); err != nil || !p.Result.hasIP() {
+		driver.releasePreallocation(p)
+		return nil, fmt.Errorf("IPAM plugin %s returned no address: %s", plugin, output)
+	}
+	if p.Result.IP4.address() != "" {
+		if ip, _, err := net.ParseCIDR(p.Result.IP4.IP); err == nil {
+			p.Mac = makeMac(ip)
+		}
+	}
+	driver.endpoints.setPrealloc(endpointID, p)
+	// Without it, a restart would leak the address
+	if err := driver.cache.writePrealloc(endpointID, p); err != nil {
+		log.Printf("Failed to cache endpoint %s preallocation: %v", endpointID, err)
+	}
+	return p, nil
+}
+
+func (driver *driver) releasePreallocation(p *preallocation) error {
+	if _, err := driver.execPlugin(p.Plugin, "DEL", p.Runtime, p.Config); err != nil {
+		return fmt.Errorf("IPAM plugin %s failed: %v", p.Plugin, err)
+	}
+	return nil
+}
+
+// iface returns the interface to report to Docker for the preallocation
+func (p *preallocation) iface() *iface {
+	return &iface{
+		Address:     p.Result.IP4.address(),
+		AddressIPv6: p.Result.IP6.address(),
+		MacAddress:  p.Mac,
+	}
+}
@@ -0,0 +1,127 @@
+package driver
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// -o cni.raw.<path>=<value> sets a field of the network's CNI config at
+// Join, for plugin settings we have no option of our own for.  The path is
+// dotted, eg ipam.subnet, and is into the first plugin of the chain unless
+// it starts with the index of another, eg 1.snat; numbers further on index
+// into arrays.  The value is JSON, or a string if it doesn't parse as JSON.
+const rawOptionPrefix = "cni.raw."
+
+// Plugin config fields that raw options may not set, because they pick the
+// plugin or carry what we pass it ourselves
+var protectedRawFields = map[string]bool{
+	"type":          true,
+	"name":          true,
+	"cniVersion":    true,
+	"capabilities":  true,
+	"runtimeConfig": true,
+	"prevResult":    true,
+	"args":          true,
+}
+
+// rawField is a config field set by a raw option
+type rawField struct {
+	// the option, for errors
+	Option string
+	// index of the plugin in the chain
+	Plugin int
+	Path   []string
+	Value  interface{}
+}
+
+// networkRawFields parses the raw options in a network's options, ordered
+// by option so that fields nested in others set by the same network are set
+// after them
+func networkRawFields(options map[string]string) ([]*rawField, error) {
+	var keys []string
+	for k := range options {
+		if strings.HasPrefix(k, rawOptionPrefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	var fields []*rawField
+	for _, k := range keys {
+		path := strings.Split(strings.TrimPrefix(k, rawOptionPrefix), ".")
+		field := &rawField{Option: k}
+		if i, err := strconv.Atoi(path[0]); err == nil && len(path) > 1 {
+			if i < 0 {
+				return nil, fmt.Errorf("network option %s has a negative plugin index", k)
+			}
+			field.Plugin = i
+			path = path[1:]
+		}
+		for _, p := range path {
+			if p == "" {
+				return nil, fmt.Errorf("network option %s has an empty path element", k)
+			}
+		}
+		if protectedRawFields[path[0]] {
+			return nil, fmt.Errorf("network option %s may not set the plugin's %s", k, path[0])
+		}
+		field.Path = path
+		if err := json.Unmarshal([]byte(options[k]), &field.Value); err != nil {
+			field.Value = options[k]
+		}
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
+
+// applyRawFields sets the raw fields in the config's plugins.  A field that
+// already exists may only be replaced by a value of the same JSON type;
+// missing objects along the path are created.
+func (nc *netConf) applyRawFields(fields []*rawField) error {
+	for _, f := range fields {
+		if f.Plugin >= len(nc.Plugins) {
+			return fmt.Errorf("network option %s: network %s has no plugin %d", f.Option, nc.Name, f.Plugin)
+		}
+		if err := setRawPath(nc.Plugins[f.Plugin], f.Path, f.Value); err != nil {
+			return fmt.Errorf("network option %s: %v", f.Option, err)
+		}
+	}
+	return nil
+}
+
+// setRawPath sets the value at path under parent, a JSON object or array
+func setRawPath(parent interface{}, path []string, value interface{}) error {
+	key := path[0]
+	var cur interface{}
+	var set func(interface{})
+	switch p := parent.(type) {
+	case map[string]interface{}:
+		cur = p[key]
+		set = func(v interface{}) { p[key] = v }
+	case []interface{}:
+		i, err := strconv.Atoi(key)
+		if err != nil || i < 0 || i >= len(p) {
+			return fmt.Errorf("%s is not an index of an array of %d", key, len(p))
+		}
+		cur = p[i]
+		set = func(v interface{}) { p[i] = v }
+	default:
+		return fmt.Errorf("can't set %s in a JSON %s", key, jsonType(parent))
+	}
+
+	if len(path) == 1 {
+		if cur != nil && jsonType(cur) != jsonType(value) {
+			return fmt.Errorf("%s is a JSON %s, not %s", key, jsonType(cur), jsonType(value))
+		}
+		set(value)
+		return nil
+	}
+	if cur == nil {
+		cur = make(map[string]interface{})
+		set(cur)
+	}
+	return setRawPath(cur, path[1:], value)
+}
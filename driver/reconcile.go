@@ -0,0 +1,81 @@
+package driver
+
+import (
+	"log"
+
+	docker "github.com/dcbw/go-dockerclient"
+)
+
+// ReconcileSummary lists what reconciling our endpoints against Docker's
+// containers did
+type ReconcileSummary struct {
+	Checked int
+	Deleted []string
+	// endpoints whose container we couldn't look up, which are kept
+	Unknown map[string]string
+	Failed  map[string]string
+}
+
+// containerGone tells if a container no longer exists or has stopped, so
+// that its netns, and with it our interface, is gone.  Only Docker saying
+// the container doesn't exist counts; any other error, like a 404 from an
+// API mismatch, leaves the endpoint alone, as does a container Docker is
+// restarting.
+func (driver *driver) containerGone(id string) (bool, error) {
+	container, err := driver.InspectContainer(id)
+	if err != nil {
+		if _, ok := err.(*docker.NoSuchContainer); ok {
+			return true, nil
+		}
+		return false, err
+	}
+	return !container.State.Running && !container.State.Restarting, nil
+}
+
+// reconcileEndpoints runs DEL for endpoints whose container is gone.  When
+// Docker restarts while we stay up, containers that died with it never
+// have their endpoints left, so this releases what their ADD allocated
+// once Docker is back.  Endpoints are locked while checked, so one joining
+// meanwhile isn't mistaken for stale, and containers that can't be looked
+// up are left alone.
+func (driver *driver) reconcileEndpoints() *ReconcileSummary {
+	summary := &ReconcileSummary{
+		Unknown: make(map[string]string),
+		Failed:  make(map[string]string),
+	}
+	for _, listed := range driver.endpoints.list() {
+		summary.Checked++
+		driver.reconcileEndpoint(listed.ID, summary)
+	}
+	log.Printf("Reconcile: %+v", summary)
+	return summary
+}
+
+func (driver *driver) reconcileEndpoint(id string, summary *ReconcileSummary) {
+	defer driver.endpoints.lock(id)()
+
+	// It may have been left since it was listed
+	ep := driver.endpoints.get(id)
+	if ep == nil {
+		return
+	}
+	gone, err := driver.containerGone(ep.Runtime.ContainerID)
+	if err != nil {
+		summary.Unknown[id] = err.Error()
+		return
+	}
+	if !gone {
+		return
+	}
+
+	log.Printf("Endpoint %s's container %s is gone; deleting it", id, ep.Runtime.ContainerID)
+	if err := driver.delEndpoint(ep); err != nil {
+		log.Printf("Failed to delete stale endpoint %s: %v", id, err)
+		summary.Failed[id] = err.Error()
+		return
+	}
+	driver.endpoints.remove(id)
+	driver.removeResolvConf(id)
+	driver.removeHosts(id)
+	summary.Deleted = append(summary.Deleted, id)
+}
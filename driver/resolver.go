@@ -0,0 +1,89 @@
+package driver
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	docker "github.com/dcbw/go-dockerclient"
+)
+
+// Ways of finding a container's network namespace, chosen by -netns-resolver
+const (
+	// by the container's OCI runtime, see runtimeResolver
+	netnsResolverAuto = "auto"
+	// the sandbox's netns, falling back to that of the container's init
+	// process, which is right for runc
+	netnsResolverProc = "proc"
+	// only the sandbox's netns, for runtimes like gVisor's runsc or Kata
+	// whose container processes aren't in the netns they are given
+	netnsResolverSandbox = "sandbox"
+)
+
+// OCI runtimes whose container processes run in the container's netns
+var procRuntimes = map[string]bool{
+	"":                      true,
+	"runc":                  true,
+	"crun":                  true,
+	"io.containerd.runc.v1": true,
+	"io.containerd.runc.v2": true,
+}
+
+// netnsResolver finds the path of a joining container's network namespace
+type netnsResolver interface {
+	netns(sandboxKey string, container *docker.Container) (string, error)
+}
+
+// procResolver uses the sandbox's netns when the sandbox key names one,
+// since Docker sets that up before the container starts.  Only otherwise
+// does it need the netns of the container's init process, and so wait up
+// to timeout for the container to have one.
+type procResolver struct {
+	watcher Watcher
+	timeout time.Duration
+}
+
+func (r *procResolver) netns(sandboxKey string, container *docker.Container) (string, error) {
+	netns, err := sandboxKeyToNetns(sandboxKey)
+	if err == nil {
+		return netns, nil
+	}
+	log.Printf("Using container %s netns: %v", container.ID, err)
+	return r.watcher.WaitContainerNetns(container.ID, r.timeout)
+}
+
+type sandboxResolver struct{}
+
+func (r *sandboxResolver) netns(sandboxKey string, container *docker.Container) (string, error) {
+	return sandboxKeyToNetns(sandboxKey)
+}
+
+// runtimeResolver picks the proc or sandbox resolver by the container's
+// runtime, since the processes of non-runc runtimes usually aren't in the
+// netns Docker set up
+type runtimeResolver struct {
+	proc    netnsResolver
+	sandbox netnsResolver
+}
+
+func (r *runtimeResolver) netns(sandboxKey string, container *docker.Container) (string, error) {
+	if container.HostConfig != nil && !procRuntimes[container.HostConfig.Runtime] {
+		debugf("Container %s runtime %s: using only its sandbox netns", container.ID, container.HostConfig.Runtime)
+		return r.sandbox.netns(sandboxKey, container)
+	}
+	return r.proc.netns(sandboxKey, container)
+}
+
+func newNetnsResolver(name string, watcher Watcher) (netnsResolver, error) {
+	proc := &procResolver{watcher: watcher, timeout: containerStartTimeout}
+	sandbox := &sandboxResolver{}
+	switch name {
+	case "", netnsResolverAuto:
+		return &runtimeResolver{proc: proc, sandbox: sandbox}, nil
+	case netnsResolverProc:
+		return proc, nil
+	case netnsResolverSandbox:
+		return sandbox, nil
+	}
+	return nil, fmt.Errorf("invalid netns resolver %q, must be %s, %s or %s", name, netnsResolverAuto, netnsResolverProc, netnsResolverSandbox)
+}
@@ -0,0 +1,98 @@
+package driver
+
+import (
+	"fmt"
+	"testing"
+
+	docker "github.com/dcbw/go-dockerclient"
+)
+
+// namedResolver returns its name as the netns, to tell which one was used
+type namedResolver string
+
+func (r namedResolver) netns(sandboxKey string, container *docker.Container) (string, error) {
+	return string(r), nil
+}
+
+func TestNewNetnsResolver(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    string
+		wantErr bool
+	}{
+		{name: "", want: "*driver.runtimeResolver"},
+		{name: netnsResolverAuto, want: "*driver.runtimeResolver"},
+		{name: netnsResolverProc, want: "*driver.procResolver"},
+		{name: netnsResolverSandbox, want: "*driver.sandboxResolver"},
+		{name: "shim", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		r, err := newNetnsResolver(tt.name, &watcher{})
+		if (err != nil) != tt.wantErr {
+			t.Errorf("newNetnsResolver(%q) error = %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if got := fmt.Sprintf("%T", r); !tt.wantErr && got != tt.want {
+			t.Errorf("newNetnsResolver(%q) = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRuntimeResolver(t *testing.T) {
+	r := &runtimeResolver{proc: namedResolver("proc"), sandbox: namedResolver("sandbox")}
+	tests := []struct {
+		name       string
+		hostConfig *docker.HostConfig
+		want       string
+	}{
+		{name: "no host config", want: "proc"},
+		{name: "default runtime", hostConfig: &docker.HostConfig{}, want: "proc"},
+		{name: "runc", hostConfig: &docker.HostConfig{Runtime: "runc"}, want: "proc"},
+		{name: "containerd runc shim", hostConfig: &docker.HostConfig{Runtime: "io.containerd.runc.v2"}, want: "proc"},
+		{name: "gVisor", hostConfig: &docker.HostConfig{Runtime: "runsc"}, want: "sandbox"},
+		{name: "Kata", hostConfig: &docker.HostConfig{Runtime: "io.containerd.kata.v2"}, want: "sandbox"},
+	}
+
+	for _, tt := range tests {
+		container := &docker.Container{ID: "c1", HostConfig: tt.hostConfig}
+		if got, _ := r.netns("/var/run/docker/netns/abc", container); got != tt.want {
+			t.Errorf("%s: used the %s resolver, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestProcResolver(t *testing.T) {
+	w := &watcher{
+		containers:        map[string]*docker.Container{"c1": testContainer("c1", 42, true)},
+		containersChanged: make(chan struct{}),
+	}
+	r := &procResolver{watcher: w}
+	tests := []struct {
+		name       string
+		sandboxKey string
+		container  string
+		want       string
+		wantErr    bool
+	}{
+		{name: "sandbox netns", sandboxKey: "/var/run/docker/netns/abc", container: "c1", want: "/var/run/docker/netns/abc"},
+		{name: "init process netns", sandboxKey: "", container: "c1", want: "/proc/42/ns/net"},
+		{name: "unknown container", sandboxKey: "", container: "c2", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := r.netns(tt.sandboxKey, &docker.Container{ID: tt.container})
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: netns() error = %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: netns() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	// sandbox-only runtimes have no other netns to fall back to
+	if _, err := (&sandboxResolver{}).netns("", &docker.Container{ID: "c1"}); err == nil {
+		t.Errorf("sandboxResolver.netns() without a sandbox key succeeded")
+	}
+}
@@ -0,0 +1,348 @@
+package driver
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+)
+
+// libnetwork route types; see libnetwork/types NEXTHOP and CONNECTED
+const (
+	routeNextHop   = 0
+	routeConnected = 1
+)
+
+// CNI plugin result, as written to stdout by a successful ADD. Results
+// before 0.3.0 have ip4/ip6; later ones list interfaces, ips and routes,
+// which parseResult folds into IP4/IP6.
+type cniResult struct {
+	CNIVersion string `json:"cniVersion,omitempty"`
+
+	IP4 *ipConfig `json:"ip4,omitempty"`
+	IP6 *ipConfig `json:"ip6,omitempty"`
+
+	Interfaces []*cniInterface `json:"interfaces,omitempty"`
+	IPs        []*cniIP        `json:"ips,omitempty"`
+	Routes     []*cniRoute     `json:"routes,omitempty"`
+
+	DNS *cniDNS `json:"dns,omitempty"`
+}
+
+// cniInterface is an interface the plugin created; Sandbox is the netns of
+// container-side interfaces and empty for host-side ones like veth peers
+type cniInterface struct {
+	Name    string `json:"name"`
+	Mac     string `json:"mac,omitempty"`
+	Sandbox string `json:"sandbox,omitempty"`
+}
+
+type cniIP struct {
+	// "4" or "6"; dropped in 1.0.0, so then taken from the address
+	Version string `json:"version,omitempty"`
+	// index into Interfaces, if the plugin says which interface has it
+	Interface *int   `json:"interface,omitempty"`
+	Address   string `json:"address"`
+	Gateway   string `json:"gateway,omitempty"`
+}
+
+type ipConfig struct {
+	IP      string      `json:"ip"`
+	Gateway string      `json:"gateway,omitempty"`
+	Routes  []*cniRoute `json:"routes,omitempty"`
+}
+
+type cniRoute struct {
+	Dst string `json:"dst"`
+	GW  string `json:"gw,omitempty"`
+}
+
+// Result versions parseResult understands; results from plugins made before
+// versioning have none.  Anything else may have changed shape in ways we'd
+// misread, so it is refused rather than half parsed.
+var resultVersions = []string{"", "0.1.0", "0.2.0", "0.3.0", "0.3.1", "0.4.0", "1.0.0", "1.1.0"}
+
+func parseResult(output []byte) (*cniResult, error) {
+	var res cniResult
+	if err := json.Unmarshal(output, &res); err != nil {
+		return nil, fmt.Errorf("failed to parse plugin result: %v", err)
+	}
+	if !containsString(resultVersions, res.CNIVersion) {
+		return nil, fmt.Errorf("unsupported result version %s", res.CNIVersion)
+	}
+	if res.IP4 == nil && res.IP6 == nil {
+		if err := res.foldIPs(); err != nil {
+			return nil, fmt.Errorf("failed to parse plugin result: %v", err)
+		}
+	}
+	return &res, nil
+}
+
+// foldIPs maps a 0.3.0+ result's addresses and routes onto IP4/IP6. Only
+// the first address of each family on a container-side interface is used;
+// addresses on host-side interfaces aren't the container's.
+func (res *cniResult) foldIPs() error {
+	for _, ip := range res.IPs {
+		if ip.Interface != nil {
+			i := *ip.Interface
+			if i < 0 || i >= len(res.Interfaces) {
+				return fmt.Errorf("address %s refers to unknown interface %d", ip.Address, i)
+			}
+			if res.Interfaces[i].Sandbox == "" {
+				continue
+			}
+		}
+		version := ip.Version
+		if version == "" {
+			addr, _, err := net.ParseCIDR(ip.Address)
+			if err != nil {
+				return fmt.Errorf("invalid address %q: %v", ip.Address, err)
+			}
+			version = "6"
+			if addr.To4() != nil {
+				version = "4"
+			}
+		}
+		ipc := &ipConfig{IP: ip.Address, Gateway: ip.Gateway}
+		switch {
+		case version == "4" && res.IP4 == nil:
+			res.IP4 = ipc
+		case version == "6" && res.IP6 == nil:
+			res.IP6 = ipc
+		}
+	}
+	for _, r := range res.Routes {
+		_, dst, err := net.ParseCIDR(r.Dst)
+		if err != nil {
+			return fmt.Errorf("invalid route destination %q: %v", r.Dst, err)
+		}
+		// An interface configured by router advertisements has routes
+		// but no address; SLAAC assigns that later
+		ipc := &res.IP4
+		if dst.IP.To4() == nil {
+			ipc = &res.IP6
+		}
+		if *ipc == nil {
+			*ipc = &ipConfig{}
+		}
+		(*ipc).Routes = append((*ipc).Routes, r)
+	}
+	return nil
+}
+
+// hasIP returns whether the plugin gave the container any address; policy
+// plugins that only program firewall rules legitimately don't, nor do IPv6
+// networks relying on SLAAC
+func (res *cniResult) hasIP() bool {
+	return res.IP4.address() != "" || res.IP6.address() != ""
+}
+
+// address returns the address, or "" if there is none
+func (ipc *ipConfig) address() string {
+	if ipc == nil {
+		return ""
+	}
+	return ipc.IP
+}
+
+// withoutDefaultRoutes drops the default routes, for internal networks
+func withoutDefaultRoutes(routes []*staticRoute) []*staticRoute {
+	var kept []*staticRoute
+	for _, r := range routes {
+		if _, dst, err := net.ParseCIDR(r.Destination); err == nil {
+			if ones, _ := dst.Mask.Size(); ones == 0 {
+				continue
+			}
+		}
+		kept = append(kept, r)
+	}
+	return kept
+}
+
+// addresses returns the result's IPv4 and IPv6 addresses in CIDR notation
+func (res *cniResult) addresses() []string {
+	var addrs []string
+	for _, ipc := range []*ipConfig{res.IP4, res.IP6} {
+		if addr := ipc.address(); addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// containerIface returns the result's interface inside the container's
+// netns, preferring one whose sandbox matches netns, or nil if the result
+// doesn't list any
+func (res *cniResult) containerIface(netns string) *cniInterface {
+	var found *cniInterface
+	for _, intf := range res.Interfaces {
+		if intf.Sandbox == "" {
+			continue
+		}
+		if intf.Sandbox == netns {
+			return intf
+		}
+		if found == nil {
+			found = intf
+		}
+	}
+	return found
+}
+
+// containerInterface returns the name of the result's interface inside the
+// container's netns, or "" if the result doesn't list any
+func (res *cniResult) containerInterface(netns string) string {
+	if intf := res.containerIface(netns); intf != nil {
+		return intf.Name
+	}
+	return ""
+}
+
+// A CNI route without a gateway goes via the family's default gateway gw,
+// as the spec has it.  Only if there is none, or the route is the one to
+// the gateway itself (eg, the /32 route to the gateway that the ptp plugin
+// returns), is it on-link and installed by libnetwork as a connected route.
+func routeToStatic(r *cniRoute, gw string) (*staticRoute, error) {
+	_, dst, err := net.ParseCIDR(r.Dst)
+	if err != nil {
+		return nil, fmt.Errorf("invalid route destination %q: %v", r.Dst, err)
+	}
+
+	if r.GW == "" {
+		if gwIP := net.ParseIP(gw); gwIP != nil && !dst.Contains(gwIP) {
+			return &staticRoute{
+				Destination: r.Dst,
+				RouteType:   routeNextHop,
+				NextHop:     gw,
+			}, nil
+		}
+		return &staticRoute{
+			Destination: r.Dst,
+			RouteType:   routeConnected,
+		}, nil
+	}
+
+	if net.ParseIP(r.GW) == nil {
+		return nil, fmt.Errorf("invalid route gateway %q for %s", r.GW, r.Dst)
+	}
+	return &staticRoute{
+		Destination: r.Dst,
+		RouteType:   routeNextHop,
+		NextHop:     r.GW,
+	}, nil
+}
+
+func isDefaultRoute(r *cniRoute) bool {
+	_, dst, err := net.ParseCIDR(r.Dst)
+	if err != nil {
+		return false
+	}
+	ones, _ := dst.Mask.Size()
+	return ones == 0
+}
+
+// gateway returns the address family's default gateway: the next hop of its
+// default route or, if the plugin returned no default route, the gateway
+// from IPAM
+func (ipc *ipConfig) gateway() string {
+	if ipc == nil {
+		return ""
+	}
+	for _, r := range ipc.Routes {
+		if r.GW != "" && isDefaultRoute(r) {
+			return r.GW
+		}
+	}
+	return ipc.Gateway
+}
+
+// staticRoutes returns the result's routes other than the default routes,
+// which libnetwork sets up from the join response's gateways instead,
+// whether or not they name the gateway: a default route without one, as
+// host-local returns next to its gateway, is via that gateway too.
+// Plugins doing policy routing may return routes through several next
+// hops: each is a static route with its own NextHop, and only the first
+// default route of each family becomes the gateway.  Other default routes
+// can't be installed alongside it and are dropped, but routes covering the
+// default in parts, like 0.0.0.0/1 and 128.0.0.0/1, are static routes too.
+// A destination is only routed once, by the first route the plugin gave for
+// it, and the routes are ordered so libnetwork can install them in turn.
+func (res *cniResult) staticRoutes() ([]*staticRoute, error) {
+	routes := []*staticRoute{}
+	seen := make(map[string]*staticRoute)
+	for _, ipc := range []*ipConfig{res.IP4, res.IP6} {
+		if ipc == nil {
+			continue
+		}
+		gw := ipc.gateway()
+		for _, r := range ipc.Routes {
+			if isDefaultRoute(r) {
+				if r.GW != "" && r.GW != gw {
+					log.Printf("Ignoring default route %s via %s, already using gateway %s", r.Dst, r.GW, gw)
+				} else if gw == "" {
+					debugf("Ignoring default route %s without a gateway", r.Dst)
+				}
+				continue
+			}
+			sr, err := routeToStatic(r, gw)
+			if err != nil {
+				return nil, err
+			}
+			// Key on the network so 10.1.0.1/16 and 10.1.0.0/16 match
+			_, dst, _ := net.ParseCIDR(sr.Destination)
+			sr.Destination = dst.String()
+			if first, ok := seen[sr.Destination]; ok {
+				if *first != *sr {
+					debugf("Ignoring route %+v, already routing %s: %+v", sr, sr.Destination, first)
+				}
+				continue
+			}
+			seen[sr.Destination] = sr
+			routes = append(routes, sr)
+		}
+	}
+	sort.Sort(byInstallOrder(routes))
+	return routes, nil
+}
+
+// byInstallOrder puts connected routes before the next-hop routes that may
+// need them to reach their gateway, and then less specific routes before
+// more specific ones, so the most specific are installed last
+type byInstallOrder []*staticRoute
+
+func (r byInstallOrder) Len() int      { return len(r) }
+func (r byInstallOrder) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+
+func (r byInstallOrder) Less(i, j int) bool {
+	if r[i].RouteType != r[j].RouteType {
+		return r[i].RouteType == routeConnected
+	}
+	_, dstI, _ := net.ParseCIDR(r[i].Destination)
+	_, dstJ, _ := net.ParseCIDR(r[j].Destination)
+	if v4I, v4J := dstI.IP.To4() != nil, dstJ.IP.To4() != nil; v4I != v4J {
+		return v4I
+	}
+	onesI, _ := dstI.Mask.Size()
+	onesJ, _ := dstJ.Mask.Size()
+	if onesI != onesJ {
+		return onesI < onesJ
+	}
+	return r[i].Destination < r[j].Destination
+}
+
+// routesDelta returns the routes not already in existing, so re-joining an
+// endpoint doesn't hand libnetwork routes it has already installed
+func routesDelta(routes []*staticRoute, existing []*staticRoute) []*staticRoute {
+	installed := make(map[staticRoute]bool)
+	for _, r := range existing {
+		installed[*r] = true
+	}
+	delta := []*staticRoute{}
+	for _, r := range routes {
+		if !installed[*r] {
+			delta = append(delta, r)
+		}
+	}
+	return delta
+}
@@ -0,0 +1,583 @@
+package driver
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestParseResult(t *testing.T) {
+	tests := []struct {
+		name    string
+		output  string
+		ip4     *ipConfig
+		ip6     *ipConfig
+		wantErr bool
+	}{
+		{
+			name: "0.2.0",
+			output: `{"cniVersion": "0.2.0",
+				"ip4": {"ip": "10.0.0.2/24", "gateway": "10.0.0.1",
+					"routes": [{"dst": "0.0.0.0/0"}]},
+				"ip6": {"ip": "fd00::2/64"}}`,
+			ip4: &ipConfig{IP: "10.0.0.2/24", Gateway: "10.0.0.1", Routes: []*cniRoute{{Dst: "0.0.0.0/0"}}},
+			ip6: &ipConfig{IP: "fd00::2/64"},
+		},
+		{
+			name:   "unversioned",
+			output: `{"ip4": {"ip": "10.0.0.2/24"}}`,
+			ip4:    &ipConfig{IP: "10.0.0.2/24"},
+		},
+		{
+			name: "0.3.1",
+			output: `{"cniVersion": "0.3.1",
+				"interfaces": [{"name": "veth0"}, {"name": "eth0", "sandbox": "/var/run/netns/x"}],
+				"ips": [
+					{"version": "4", "interface": 0, "address": "10.0.1.1/24"},
+					{"version": "4", "interface": 1, "address": "10.0.0.2/24", "gateway": "10.0.0.1"},
+					{"version": "6", "interface": 1, "address": "fd00::2/64"}
+				],
+				"routes": [{"dst": "0.0.0.0/0", "gw": "10.0.0.1"}, {"dst": "::/0"}]}`,
+			ip4: &ipConfig{IP: "10.0.0.2/24", Gateway: "10.0.0.1", Routes: []*cniRoute{{Dst: "0.0.0.0/0", GW: "10.0.0.1"}}},
+			ip6: &ipConfig{IP: "fd00::2/64", Routes: []*cniRoute{{Dst: "::/0"}}},
+		},
+		{
+			name: "1.0.0 without ip versions",
+			output: `{"cniVersion": "1.0.0",
+				"ips": [{"address": "fd00::2/64"}, {"address": "10.0.0.2/24"}, {"address": "10.0.0.3/24"}]}`,
+			ip4: &ipConfig{IP: "10.0.0.2/24"},
+			ip6: &ipConfig{IP: "fd00::2/64"},
+		},
+		{
+			name:   "1.0.0 routes only",
+			output: `{"cniVersion": "1.0.0", "routes": [{"dst": "::/0"}]}`,
+			ip6:    &ipConfig{Routes: []*cniRoute{{Dst: "::/0"}}},
+		},
+		{
+			name:    "unknown interface",
+			output:  `{"cniVersion": "1.0.0", "ips": [{"interface": 1, "address": "10.0.0.2/24"}]}`,
+			wantErr: true,
+		},
+		{
+			name:    "invalid address",
+			output:  `{"cniVersion": "1.0.0", "ips": [{"address": "10.0.0.2"}]}`,
+			wantErr: true,
+		},
+		{
+			name:    "unsupported version",
+			output:  `{"cniVersion": "2.0.0", "ip4": {"ip": "10.0.0.2/24"}}`,
+			wantErr: true,
+		},
+		{
+			name:    "not JSON",
+			output:  `ok`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		res, err := parseResult([]byte(tt.output))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: parseResult() error = %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr {
+			continue
+		}
+		if !reflect.DeepEqual(res.IP4, tt.ip4) {
+			t.Errorf("%s: IP4 = %+v, want %+v", tt.name, res.IP4, tt.ip4)
+		}
+		if !reflect.DeepEqual(res.IP6, tt.ip6) {
+			t.Errorf("%s: IP6 = %+v, want %+v", tt.name, res.IP6, tt.ip6)
+		}
+	}
+}
+
+func TestStaticRoutesDefaultRoutes(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		gw4    string
+		gw6    string
+		routes []*staticRoute
+	}{
+		{
+			name: "host-local default route without gw",
+			output: `{"cniVersion": "0.4.0",
+				"interfaces": [{"name": "eth0", "sandbox": "/var/run/netns/x"}],
+				"ips": [{"version": "4", "interface": 0, "address": "10.0.0.2/24", "gateway": "10.0.0.1"}],
+				"routes": [{"dst": "0.0.0.0/0"}]}`,
+			gw4:    "10.0.0.1",
+			routes: []*staticRoute{},
+		},
+		{
+			name: "default route with gw",
+			output: `{"cniVersion": "0.4.0",
+				"ips": [{"version": "4", "address": "10.0.0.2/24", "gateway": "10.0.0.1"}],
+				"routes": [{"dst": "0.0.0.0/0", "gw": "10.0.0.254"}]}`,
+			gw4:    "10.0.0.254",
+			routes: []*staticRoute{},
+		},
+		{
+			name: "other route without gw goes via the IPAM gateway",
+			output: `{"cniVersion": "0.4.0",
+				"ips": [{"version": "4", "address": "10.0.0.2/24", "gateway": "10.0.0.1"}],
+				"routes": [{"dst": "0.0.0.0/0"}, {"dst": "192.168.0.0/16"}]}`,
+			gw4:    "10.0.0.1",
+			routes: []*staticRoute{{Destination: "192.168.0.0/16", RouteType: routeNextHop, NextHop: "10.0.0.1"}},
+		},
+		{
+			name: "default route without any gateway",
+			output: `{"cniVersion": "0.4.0",
+				"ips": [{"version": "4", "address": "10.0.0.2/24"}],
+				"routes": [{"dst": "0.0.0.0/0"}]}`,
+			routes: []*staticRoute{},
+		},
+	}
+
+	for _, tt := range tests {
+		res, err := parseResult([]byte(tt.output))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if gw := res.IP4.gateway(); gw != tt.gw4 {
+			t.Errorf("%s: IPv4 gateway = %q, want %q", tt.name, gw, tt.gw4)
+		}
+		if gw := res.IP6.gateway(); gw != tt.gw6 {
+			t.Errorf("%s: IPv6 gateway = %q, want %q", tt.name, gw, tt.gw6)
+		}
+		routes, err := res.staticRoutes()
+		if err != nil {
+			t.Errorf("%s: staticRoutes() error = %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(routes, tt.routes) {
+			t.Errorf("%s: staticRoutes() = %s, want %s", tt.name, describeRoutes(routes), describeRoutes(tt.routes))
+		}
+	}
+}
+
+func describeRoutes(routes []*staticRoute) string {
+	s := "["
+	for i, r := range routes {
+		if i > 0 {
+			s += " "
+		}
+		s += fmt.Sprintf("%+v", *r)
+	}
+	return s + "]"
+}
+
+func TestResultJoinResponseSLAAC(t *testing.T) {
+	withIPAM := &netConf{Name: "net", Plugins: []map[string]interface{}{
+		{"type": "bridge", "ipam": map[string]interface{}{"type": "host-local"}},
+	}}
+	withoutIPAM := &netConf{Name: "net", Plugins: []map[string]interface{}{
+		{"type": "macvlan"},
+	}}
+	tests := []struct {
+		name      string
+		nc        *netConf
+		requireIP bool
+		output    string
+		gw6       string
+		routes    []*staticRoute
+		wantErr   bool
+	}{
+		{
+			name:   "RA-only default route",
+			nc:     withoutIPAM,
+			output: `{"cniVersion": "1.0.0", "routes": [{"dst": "::/0"}]}`,
+			routes: []*staticRoute{},
+		},
+		{
+			name:      "RA-only with -require-ip but no IPAM",
+			nc:        withoutIPAM,
+			requireIP: true,
+			output:    `{"cniVersion": "1.0.0", "routes": [{"dst": "::/0"}]}`,
+			routes:    []*staticRoute{},
+		},
+		{
+			name:   "RA-only with other routes",
+			nc:     withoutIPAM,
+			output: `{"cniVersion": "1.0.0", "routes": [{"dst": "::/0"}, {"dst": "fd00:1::/64"}]}`,
+			routes: []*staticRoute{{Destination: "fd00:1::/64", RouteType: routeConnected}},
+		},
+		{
+			name:   "IPv6 address with gateway",
+			nc:     withIPAM,
+			output: `{"cniVersion": "1.0.0", "ips": [{"address": "fd00::2/64", "gateway": "fd00::1"}], "routes": [{"dst": "::/0"}]}`,
+			gw6:    "fd00::1",
+			routes: []*staticRoute{},
+		},
+		{
+			name:   "no result at all",
+			nc:     withIPAM,
+			output: `{"cniVersion": "1.0.0"}`,
+			routes: []*staticRoute{},
+		},
+		{
+			name:      "no address with -require-ip and IPAM",
+			nc:        withIPAM,
+			requireIP: true,
+			output:    `{"cniVersion": "1.0.0", "routes": [{"dst": "::/0"}]}`,
+			wantErr:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		d := &driver{requireIP: tt.requireIP}
+		result, err := parseResult([]byte(tt.output))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		res, err := d.resultJoinResponse(tt.nc, result, "ep")
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: resultJoinResponse() error = %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr {
+			continue
+		}
+		if res.Gateway != "" || res.GatewayIPv6 != tt.gw6 {
+			t.Errorf("%s: gateways %q, %q, want none and %q", tt.name, res.Gateway, res.GatewayIPv6, tt.gw6)
+		}
+		if !reflect.DeepEqual(res.StaticRoutes, tt.routes) {
+			t.Errorf("%s: routes %s, want %s", tt.name, describeRoutes(res.StaticRoutes), describeRoutes(tt.routes))
+		}
+	}
+}
+
+func TestRouteToStatic(t *testing.T) {
+	tests := []struct {
+		name    string
+		route   *cniRoute
+		gw      string
+		want    *staticRoute
+		wantErr bool
+	}{
+		{
+			name:  "next hop",
+			route: &cniRoute{Dst: "192.168.0.0/16", GW: "10.0.0.254"},
+			gw:    "10.0.0.1",
+			want:  &staticRoute{Destination: "192.168.0.0/16", RouteType: routeNextHop, NextHop: "10.0.0.254"},
+		},
+		{
+			name:  "on-link route to the gateway",
+			route: &cniRoute{Dst: "10.0.0.1/32"},
+			gw:    "10.0.0.1",
+			want:  &staticRoute{Destination: "10.0.0.1/32", RouteType: routeConnected},
+		},
+		{
+			name:  "on-link without a gateway",
+			route: &cniRoute{Dst: "192.168.0.0/16"},
+			want:  &staticRoute{Destination: "192.168.0.0/16", RouteType: routeConnected},
+		},
+		{
+			name:  "via the default gateway",
+			route: &cniRoute{Dst: "192.168.0.0/16"},
+			gw:    "10.0.0.1",
+			want:  &staticRoute{Destination: "192.168.0.0/16", RouteType: routeNextHop, NextHop: "10.0.0.1"},
+		},
+		{
+			name:  "IPv6 next hop",
+			route: &cniRoute{Dst: "fd00:1::/64", GW: "fd00::1"},
+			want:  &staticRoute{Destination: "fd00:1::/64", RouteType: routeNextHop, NextHop: "fd00::1"},
+		},
+		{
+			name:  "IPv6 on-link",
+			route: &cniRoute{Dst: "fd00:1::/64"},
+			want:  &staticRoute{Destination: "fd00:1::/64", RouteType: routeConnected},
+		},
+		{
+			name:    "invalid destination",
+			route:   &cniRoute{Dst: "192.168.0.0"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid gateway",
+			route:   &cniRoute{Dst: "192.168.0.0/16", GW: "gateway"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		got, err := routeToStatic(tt.route, tt.gw)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: routeToStatic() error = %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: routeToStatic() = %+v, want %+v", tt.name, *got, *tt.want)
+		}
+	}
+}
+
+func TestStaticRoutesMapping(t *testing.T) {
+	output := `{"cniVersion": "0.3.1",
+		"ips": [
+			{"version": "4", "address": "10.0.0.2/24", "gateway": "10.0.0.1"},
+			{"version": "6", "address": "fd00::2/64", "gateway": "fd00::1"}
+		],
+		"routes": [
+			{"dst": "192.168.0.0/16", "gw": "10.0.0.254"},
+			{"dst": "10.0.0.1/32"},
+			{"dst": "fd00:1::/64", "gw": "fd00::fe"},
+			{"dst": "fd00::1/128"}
+		]}`
+	want := []*staticRoute{
+		{Destination: "10.0.0.1/32", RouteType: routeConnected},
+		{Destination: "fd00::1/128", RouteType: routeConnected},
+		{Destination: "192.168.0.0/16", RouteType: routeNextHop, NextHop: "10.0.0.254"},
+		{Destination: "fd00:1::/64", RouteType: routeNextHop, NextHop: "fd00::fe"},
+	}
+
+	res, err := parseResult([]byte(output))
+	if err != nil {
+		t.Fatal(err)
+	}
+	routes, err := res.staticRoutes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(routes, want) {
+		t.Errorf("staticRoutes() = %s, want %s", describeRoutes(routes), describeRoutes(want))
+	}
+}
+
+func TestRoutesDelta(t *testing.T) {
+	connected := &staticRoute{Destination: "10.0.0.1/32", RouteType: routeConnected}
+	viaA := &staticRoute{Destination: "192.168.0.0/16", RouteType: routeNextHop, NextHop: "10.0.0.254"}
+	viaB := &staticRoute{Destination: "192.168.0.0/16", RouteType: routeNextHop, NextHop: "10.0.0.253"}
+	v6 := &staticRoute{Destination: "fd00:1::/64", RouteType: routeNextHop, NextHop: "fd00::fe"}
+
+	tests := []struct {
+		name     string
+		routes   []*staticRoute
+		existing []*staticRoute
+		want     []*staticRoute
+	}{
+		{
+			name:   "first join",
+			routes: []*staticRoute{connected, viaA, v6},
+			want:   []*staticRoute{connected, viaA, v6},
+		},
+		{
+			name:     "unchanged",
+			routes:   []*staticRoute{connected, viaA, v6},
+			existing: []*staticRoute{connected, viaA, v6},
+			want:     []*staticRoute{},
+		},
+		{
+			name:     "new routes keep their order",
+			routes:   []*staticRoute{connected, viaA, v6},
+			existing: []*staticRoute{viaA},
+			want:     []*staticRoute{connected, v6},
+		},
+		{
+			name:     "changed next hop",
+			routes:   []*staticRoute{connected, viaB},
+			existing: []*staticRoute{connected, viaA},
+			want:     []*staticRoute{viaB},
+		},
+		{
+			name:     "compared by value",
+			routes:   []*staticRoute{{Destination: "10.0.0.1/32", RouteType: routeConnected}},
+			existing: []*staticRoute{connected},
+			want:     []*staticRoute{},
+		},
+		{
+			name:     "removed routes",
+			routes:   []*staticRoute{connected},
+			existing: []*staticRoute{connected, viaA, v6},
+			want:     []*staticRoute{},
+		},
+	}
+
+	for _, tt := range tests {
+		if got := routesDelta(tt.routes, tt.existing); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: routesDelta() = %s, want %s", tt.name, describeRoutes(got), describeRoutes(tt.want))
+		}
+	}
+}
+
+func TestStaticRoutesPolicyRouting(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		gw4    string
+		gw6    string
+		routes []*staticRoute
+	}{
+		{
+			name: "two gatewayed subnets and a default route",
+			output: `{"cniVersion": "0.3.1",
+				"ips": [{"version": "4", "address": "10.0.0.2/24", "gateway": "10.0.0.1"}],
+				"routes": [
+					{"dst": "192.168.1.0/24", "gw": "10.0.0.253"},
+					{"dst": "0.0.0.0/0", "gw": "10.0.0.1"},
+					{"dst": "172.16.0.0/12", "gw": "10.0.0.254"}
+				]}`,
+			gw4: "10.0.0.1",
+			routes: []*staticRoute{
+				{Destination: "172.16.0.0/12", RouteType: routeNextHop, NextHop: "10.0.0.254"},
+				{Destination: "192.168.1.0/24", RouteType: routeNextHop, NextHop: "10.0.0.253"},
+			},
+		},
+		{
+			name: "first default route is the gateway",
+			output: `{"cniVersion": "0.3.1",
+				"ips": [{"version": "4", "address": "10.0.0.2/24", "gateway": "10.0.0.1"}],
+				"routes": [
+					{"dst": "0.0.0.0/0", "gw": "10.0.0.253"},
+					{"dst": "0.0.0.0/0", "gw": "10.0.0.254"}
+				]}`,
+			gw4:    "10.0.0.253",
+			routes: []*staticRoute{},
+		},
+		{
+			name: "split default routes are static",
+			output: `{"cniVersion": "0.3.1",
+				"ips": [{"version": "4", "address": "10.0.0.2/24", "gateway": "10.0.0.1"}],
+				"routes": [
+					{"dst": "128.0.0.0/1", "gw": "10.0.0.254"},
+					{"dst": "0.0.0.0/1", "gw": "10.0.0.254"},
+					{"dst": "0.0.0.0/0"}
+				]}`,
+			gw4: "10.0.0.1",
+			routes: []*staticRoute{
+				{Destination: "0.0.0.0/1", RouteType: routeNextHop, NextHop: "10.0.0.254"},
+				{Destination: "128.0.0.0/1", RouteType: routeNextHop, NextHop: "10.0.0.254"},
+			},
+		},
+		{
+			name: "per-family default routes",
+			output: `{"cniVersion": "0.3.1",
+				"ips": [
+					{"version": "4", "address": "10.0.0.2/24"},
+					{"version": "6", "address": "fd00::2/64"}
+				],
+				"routes": [
+					{"dst": "::/0", "gw": "fd00::1"},
+					{"dst": "0.0.0.0/0", "gw": "10.0.0.1"},
+					{"dst": "fd00:1::/64", "gw": "fd00::fe"}
+				]}`,
+			gw4:    "10.0.0.1",
+			gw6:    "fd00::1",
+			routes: []*staticRoute{{Destination: "fd00:1::/64", RouteType: routeNextHop, NextHop: "fd00::fe"}},
+		},
+	}
+
+	for _, tt := range tests {
+		res, err := parseResult([]byte(tt.output))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if gw := res.IP4.gateway(); gw != tt.gw4 {
+			t.Errorf("%s: IPv4 gateway = %q, want %q", tt.name, gw, tt.gw4)
+		}
+		if gw := res.IP6.gateway(); gw != tt.gw6 {
+			t.Errorf("%s: IPv6 gateway = %q, want %q", tt.name, gw, tt.gw6)
+		}
+		routes, err := res.staticRoutes()
+		if err != nil {
+			t.Errorf("%s: staticRoutes() error = %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(routes, tt.routes) {
+			t.Errorf("%s: staticRoutes() = %s, want %s", tt.name, describeRoutes(routes), describeRoutes(tt.routes))
+		}
+	}
+}
+
+func TestResultJoinResponseNoIP(t *testing.T) {
+	noIPs := []string{
+		`{"cniVersion": "0.2.0", "dns": {}}`,
+		`{"cniVersion": "0.3.1", "interfaces": [{"name": "eth0"}], "ips": []}`,
+		`{"cniVersion": "0.4.0", "interfaces": [{"name": "eth0"}]}`,
+		`{"cniVersion": "1.0.0", "interfaces": [{"name": "eth0"}], "ips": []}`,
+	}
+	tests := []struct {
+		name      string
+		plugins   []map[string]interface{}
+		requireIP bool
+		wantErr   bool
+	}{
+		{
+			name:    "policy-only plugin",
+			plugins: []map[string]interface{}{{"type": "firewall"}},
+		},
+		{
+			name:      "policy-only plugin with -require-ip",
+			plugins:   []map[string]interface{}{{"type": "firewall"}},
+			requireIP: true,
+		},
+		{
+			name:    "IPAM network",
+			plugins: []map[string]interface{}{{"type": "bridge", "ipam": map[string]interface{}{"type": "host-local"}}},
+		},
+		{
+			name:      "IPAM network with -require-ip",
+			plugins:   []map[string]interface{}{{"type": "bridge", "ipam": map[string]interface{}{"type": "host-local"}}, {"type": "firewall"}},
+			requireIP: true,
+			wantErr:   true,
+		},
+		{
+			name:      "empty ipam section with -require-ip",
+			plugins:   []map[string]interface{}{{"type": "bridge", "ipam": map[string]interface{}{}}},
+			requireIP: true,
+		},
+	}
+
+	for _, tt := range tests {
+		d := &driver{requireIP: tt.requireIP}
+		nc := &netConf{Name: "net", Plugins: tt.plugins}
+		for _, output := range noIPs {
+			result, err := parseResult([]byte(output))
+			if err != nil {
+				t.Errorf("%s: %v", tt.name, err)
+				continue
+			}
+			res, err := d.resultJoinResponse(nc, result, "ep")
+			if (err != nil) != tt.wantErr {
+				t.Errorf("%s: resultJoinResponse(%s) error = %v, want error %v", tt.name, output, err, tt.wantErr)
+				continue
+			}
+			if !tt.wantErr && (res.Gateway != "" || res.GatewayIPv6 != "" || len(res.StaticRoutes) != 0) {
+				t.Errorf("%s: resultJoinResponse(%s) = %+v, want no gateways or routes", tt.name, output, res)
+			}
+		}
+	}
+}
+
+func TestParseResultVersions(t *testing.T) {
+	for _, version := range resultVersions {
+		output := fmt.Sprintf(`{"cniVersion": %q, "ip4": {"ip": "10.0.0.2/24"}}`, version)
+		if version >= "0.3.0" {
+			output = fmt.Sprintf(`{"cniVersion": %q, "ips": [{"version": "4", "address": "10.0.0.2/24"}]}`, version)
+		}
+		res, err := parseResult([]byte(output))
+		if err != nil {
+			t.Errorf("parseResult() of a %q result error = %v", version, err)
+			continue
+		}
+		if res.IP4.address() != "10.0.0.2/24" {
+			t.Errorf("parseResult() of a %q result lost its address: %+v", version, res.IP4)
+		}
+	}
+
+	for _, version := range []string{"1.2.0", "2.0.0", "0.5.0", "v1.0.0", "1.0"} {
+		output := fmt.Sprintf(`{"cniVersion": %q, "ips": [{"address": "10.0.0.2/24"}]}`, version)
+		_, err := parseResult([]byte(output))
+		if err == nil {
+			t.Errorf("parseResult() of a %q result succeeded", version)
+			continue
+		}
+		if want := "unsupported result version " + version; err.Error() != want {
+			t.Errorf("parseResult() of a %q result error = %q, want %q", version, err, want)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package driver
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// Join failures that may go away on their own, like the container's netns
+// not being ready yet or the IPAM range being momentarily full, are
+// returned to Docker with a 503 and this prefix on their message, so that
+// whatever orchestrates Docker can tell them from failures that retrying
+// won't fix, which get a 500 and no prefix.  Plugin lock contention is
+// retried internally before being reported; see execPlugin.
+const retryablePrefix = "retryable: "
+
+// transientError marks an error as worth retrying later
+type transientError struct {
+	err error
+}
+
+func (e *transientError) Error() string {
+	return e.err.Error()
+}
+
+func transientf(format string, a ...interface{}) error {
+	return &transientError{err: fmt.Errorf(format, a...)}
+}
+
+// wrapf prefixes err with a message, keeping it transient if it was
+func wrapf(err error, format string, a ...interface{}) error {
+	wrapped := fmt.Errorf("%s: %v", fmt.Sprintf(format, a...), err)
+	if isTransient(err) {
+		return &transientError{err: wrapped}
+	}
+	return wrapped
+}
+
+// isTransient tells if the operation that failed with err may succeed if
+// retried later
+func isTransient(err error) bool {
+	switch e := err.(type) {
+	case *transientError:
+		return true
+	case *pluginError:
+		return e.timedOut || e.matches(lockContentionErrors) || e.matches(allocationFullErrors)
+	}
+	return false
+}
+
+// statusError is a failure that isn't ours, like a bad request, reported
+// with a status of its own
+type statusError struct {
+	status int
+	err    error
+}
+
+func (e *statusError) Error() string {
+	return e.err.Error()
+}
+
+func statusErrorf(status int, format string, a ...interface{}) error {
+	return &statusError{status: status, err: fmt.Errorf(format, a...)}
+}
+
+// sendJoinError reports a failed Join, tagging it if it is transient; a
+// network Docker doesn't have is a 404, and a statusError has its own
+func sendJoinError(w http.ResponseWriter, err error) {
+	switch e := err.(type) {
+	case *networkNotFoundError:
+		sendError(w, err.Error(), http.StatusNotFound)
+		return
+	case *statusError:
+		sendError(w, err.Error(), e.status)
+		return
+	}
+	if isTransient(err) {
+		sendError(w, retryablePrefix+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	sendError(w, err.Error(), http.StatusInternalServerError)
+}
@@ -0,0 +1,65 @@
+package driver
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSendJoinError(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		status    int
+		retryable bool
+	}{
+		{
+			name:   "permanent",
+			err:    fmt.Errorf("Network net returned invalid routes"),
+			status: http.StatusInternalServerError,
+		},
+		{
+			name:      "transient",
+			err:       transientf("Failed to find container with sandbox %s", "/var/run/docker/netns/abc"),
+			status:    http.StatusServiceUnavailable,
+			retryable: true,
+		},
+		{
+			name:      "wrapped transient",
+			err:       wrapf(transientf("master interface eth1 not found"), "Network %s", "net"),
+			status:    http.StatusServiceUnavailable,
+			retryable: true,
+		},
+		{
+			name:   "wrapped permanent",
+			err:    wrapf(fmt.Errorf("invalid dns option"), "Network %s", "net"),
+			status: http.StatusInternalServerError,
+		},
+		{
+			name:   "network deleted",
+			err:    &networkNotFoundError{id: "n1"},
+			status: http.StatusNotFound,
+		},
+		{
+			name:   "bad request",
+			err:    statusErrorf(http.StatusBadRequest, "invalid %s option", cniArgsKey),
+			status: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		sendJoinError(w, tt.err)
+		if w.Code != tt.status {
+			t.Errorf("%s: status = %d, want %d", tt.name, w.Code, tt.status)
+		}
+		if got := strings.HasPrefix(w.Body.String(), retryablePrefix); got != tt.retryable {
+			t.Errorf("%s: body %q has retryable prefix %v, want %v", tt.name, w.Body.String(), got, tt.retryable)
+		}
+		if !strings.Contains(w.Body.String(), tt.err.Error()) {
+			t.Errorf("%s: body %q doesn't have the error %q", tt.name, w.Body.String(), tt.err)
+		}
+	}
+}
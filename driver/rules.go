@@ -0,0 +1,71 @@
+package driver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+)
+
+// confRule picks a different CNI network config at Join when all of its
+// predicates match.  The conf rules file is a JSON array of these,
+// evaluated in order after the network's own config has been resolved.
+type confRule struct {
+	// only applies to networks whose config is this one, if set
+	Network string `json:"network,omitempty"`
+	// network option and container label values to match; an empty
+	// value matches any value as long as the key is set
+	Options map[string]string `json:"options,omitempty"`
+	Labels  map[string]string `json:"labels,omitempty"`
+	// name of the CNI network config to use instead
+	Conf string `json:"conf"`
+}
+
+func loadConfRules(path string) ([]*confRule, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rules []*confRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("failed to parse conf rules %s: %v", path, err)
+	}
+	for i, rule := range rules {
+		if rule == nil || rule.Conf == "" {
+			return nil, fmt.Errorf("conf rule %d has no conf", i)
+		}
+	}
+	return rules, nil
+}
+
+func matchValues(want map[string]string, have map[string]string) bool {
+	for k, v := range want {
+		value, ok := have[k]
+		if !ok || (v != "" && value != v) {
+			return false
+		}
+	}
+	return true
+}
+
+func (rule *confRule) matches(confName string, nw *network, labels map[string]string) bool {
+	if rule.Network != "" && rule.Network != confName {
+		return false
+	}
+	return matchValues(rule.Options, nw.Options) && matchValues(rule.Labels, labels)
+}
+
+// selectConf returns the config chosen by the first matching rule, or
+// confName if none match
+func (driver *driver) selectConf(confName string, nw *network, labels map[string]string) string {
+	for i, rule := range driver.confRules {
+		if rule.matches(confName, nw, labels) {
+			log.Printf("Conf rule %d selects network config %s instead of %s", i, rule.Conf, confName)
+			return rule.Conf
+		}
+	}
+	return confName
+}
@@ -0,0 +1,76 @@
+package driver
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+const (
+	localScope  = "local"
+	globalScope = "global"
+)
+
+func validateScope(scope string) error {
+	if scope != localScope && scope != globalScope {
+		return fmt.Errorf("invalid scope %q, must be %s or %s", scope, localScope, globalScope)
+	}
+	return nil
+}
+
+// parsePluginScopes parses "plugin=scope" strings
+func parsePluginScopes(specs []string) (map[string]string, error) {
+	scopes := make(map[string]string)
+	for _, spec := range specs {
+		parts := strings.SplitN(spec, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid plugin scope %q, expected plugin=scope", spec)
+		}
+		if err := validateScope(parts[1]); err != nil {
+			return nil, err
+		}
+		scopes[parts[0]] = parts[1]
+	}
+	return scopes, nil
+}
+
+// capabilityScope picks the scope to report to Docker.  Each configured
+// network's scope comes from the type of the first plugin in its chain.
+// The protocol only lets a driver report one scope for all its networks,
+// though, so if they disagree we fall back to the default scope.
+func (driver *driver) capabilityScope() string {
+	confs, err := loadNetConfs(driver.netconfpath)
+	if err != nil {
+		log.Printf("Using default scope %s: %v", driver.scope, err)
+		return driver.scope
+	}
+
+	scope := ""
+	for _, nc := range confs {
+		s, ok := driver.pluginScopes[nc.pluginType(0)]
+		if !ok {
+			s = driver.scope
+		}
+		if scope != "" && s != scope {
+			log.Printf("Networks have both %s and %s scope; using default scope %s", scope, s, driver.scope)
+			return driver.scope
+		}
+		scope = s
+	}
+	if scope == "" {
+		scope = driver.scope
+	}
+	log.Printf("Reporting %s scope", scope)
+	return scope
+}
+
+type capabilitiesResponse struct {
+	Scope string
+}
+
+func (driver *driver) getCapabilities(w http.ResponseWriter, r *http.Request) {
+	objectResponse(w, &capabilitiesResponse{
+		Scope: driver.capabilityScope(),
+	})
+}
@@ -0,0 +1,43 @@
+package driver
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// Methods that run CNI plugins.  These may legitimately take as long as a
+// plugin timeout (an ADD waiting on DHCP, say) for each plugin in the chain
+// and each retry, so they are bounded by -add-timeout, -del-timeout and
+// -check-timeout rather than by the write timeout.
+var pluginExecMethods = map[string]bool{
+	MethodReceiver + ".CreateEndpoint":              true,
+	MethodReceiver + ".DeleteEndpoint":              true,
+	MethodReceiver + ".Join":                        true,
+	MethodReceiver + ".Leave":                       true,
+	MethodReceiver + ".ProgramExternalConnectivity": true,
+	MethodReceiver + ".RevokeExternalConnectivity":  true,
+	IpamMethodReceiver + ".RequestAddress":          true,
+	IpamMethodReceiver + ".ReleaseAddress":          true,
+}
+
+// newServer returns a server for handler with our read and idle timeouts.
+// The write timeout isn't set on the server, since it would cut off
+// handlers running plugins; see withWriteTimeout.
+func (driver *driver) newServer(handler http.Handler) *http.Server {
+	return &http.Server{
+		Handler:     handler,
+		ReadTimeout: driver.readTimeout,
+		IdleTimeout: driver.idleTimeout,
+	}
+}
+
+// withWriteTimeout bounds how long h may take to respond to method, unless
+// the method runs plugins.  A handler that times out keeps running, but
+// Docker gets an error instead of its response.
+func (driver *driver) withWriteTimeout(method string, h http.HandlerFunc) http.Handler {
+	if driver.writeTimeout <= 0 || pluginExecMethods[method] {
+		return h
+	}
+	msg := fmt.Sprintf(`{"Err":"%s timed out after %v"}`, method, driver.writeTimeout)
+	return http.TimeoutHandler(h, driver.writeTimeout, msg)
+}
@@ -0,0 +1,85 @@
+package driver
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	docker "github.com/dcbw/go-dockerclient"
+)
+
+// How Join treats a container started with --network container:<id>, as
+// the app containers of a pod share their sandbox's netns.  The sandbox's
+// own Join already ran the plugins in that netns, so by default the
+// container's Join reuses the sandbox's interface rather than running ADD
+// again; "add" runs the plugins for it anyway, as for any container.
+const (
+	sharedNetnsReuse = "reuse"
+	sharedNetnsAdd   = "add"
+)
+
+const containerNetworkModePrefix = "container:"
+
+func validateSharedNetnsMode(mode string) error {
+	switch mode {
+	case sharedNetnsReuse, sharedNetnsAdd:
+		return nil
+	}
+	return fmt.Errorf("invalid shared netns mode %q, must be %s or %s", mode, sharedNetnsReuse, sharedNetnsAdd)
+}
+
+// netnsOwner returns the ID or name of the container whose netns the
+// container shares, or "" if it has its own
+func netnsOwner(container *docker.Container) string {
+	if container.HostConfig == nil || !strings.HasPrefix(container.HostConfig.NetworkMode, containerNetworkModePrefix) {
+		return ""
+	}
+	return strings.TrimPrefix(container.HostConfig.NetworkMode, containerNetworkModePrefix)
+}
+
+// ownerEndpoint returns the endpoint through which the container named by
+// ref, by ID, short ID or name, joined the network
+func (driver *driver) ownerEndpoint(ref string, networkID string) *endpoint {
+	for _, ep := range driver.endpoints.list() {
+		if ep.NetworkID != networkID {
+			continue
+		}
+		id := ep.Runtime.ContainerID
+		if strings.HasPrefix(id, ref) {
+			return ep
+		}
+		if c := driver.watcher.GetContainer(id); c != nil && containerName(c) == ref {
+			return ep
+		}
+	}
+	return nil
+}
+
+// sharedJoinResponse answers the Join of a container sharing the netns of
+// the container that joined through owner with owner's interface.  Its
+// routes are already installed in the netns, so none are returned.
+func (driver *driver) sharedJoinResponse(owner *endpoint, netInfo *network) (*joinResponse, error) {
+	result, err := parseResult(owner.Result)
+	if err != nil {
+		return nil, err
+	}
+	srcName := result.containerInterface(owner.Runtime.Netns)
+	if srcName == "" {
+		srcName = owner.Runtime.IfName
+	}
+	res := &joinResponse{
+		InterfaceNames:        []*iface{{SrcName: srcName, DstPrefix: driver.networkDstPrefix(netInfo)}},
+		Gateway:               result.IP4.gateway(),
+		GatewayIPv6:           result.IP6.gateway(),
+		StaticRoutes:          []*staticRoute{},
+		DisableGatewayService: netInfo.Internal,
+	}
+	if _, err := os.Stat(driver.resolvConfPath(owner.ID)); err == nil {
+		res.ResolvConfPath = driver.resolvConfPath(owner.ID)
+	}
+	if _, err := os.Stat(driver.hostsPath(owner.ID)); err == nil {
+		res.HostsPath = driver.hostsPath(owner.ID)
+	}
+	applyNetworkGateways(res, owner.Conf.Name, netInfo)
+	return res, nil
+}
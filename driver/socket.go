@@ -0,0 +1,83 @@
+package driver
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+)
+
+// socketPerms are the ownership and mode given to the plugin socket after
+// it is bound, so that a dockerd not running as our user can connect
+type socketPerms struct {
+	// -1 to leave the group alone
+	gid int
+	// 0 to leave the mode alone
+	mode os.FileMode
+}
+
+func parseSocketPerms(group string, mode string) (*socketPerms, error) {
+	perms := &socketPerms{gid: -1}
+	if group != "" {
+		grp, err := user.LookupGroup(group)
+		if err != nil {
+			return nil, fmt.Errorf("socket group %s: %v", group, err)
+		}
+		if perms.gid, err = strconv.Atoi(grp.Gid); err != nil {
+			return nil, fmt.Errorf("socket group %s has invalid gid %s", group, grp.Gid)
+		}
+	}
+	if mode != "" {
+		m, err := strconv.ParseUint(mode, 8, 32)
+		if err != nil || m > 0777 {
+			return nil, fmt.Errorf("invalid socket mode %q, expected octal permissions", mode)
+		}
+		perms.mode = os.FileMode(m)
+	}
+	return perms, nil
+}
+
+func (perms *socketPerms) apply(path string) error {
+	if perms.gid >= 0 {
+		if err := os.Chown(path, -1, perms.gid); err != nil {
+			return fmt.Errorf("failed to set socket group: %v", err)
+		}
+	}
+	if perms.mode != 0 {
+		if err := os.Chmod(path, perms.mode); err != nil {
+			return fmt.Errorf("failed to set socket mode: %v", err)
+		}
+	}
+	return nil
+}
+
+// prepareSocket makes the socket's directory and removes a socket left
+// behind by an earlier run that wasn't shut down cleanly; as a managed
+// plugin, Docker restarts us with the old socket still in place.  A socket
+// something still answers on is left alone, so binding it fails.
+func prepareSocket(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create socket directory: %v", err)
+	}
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return nil
+	}
+	log.Printf("Removing stale socket %s", path)
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove stale socket: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package driver
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+)
+
+// -o cni.sysctl.<key>=<value> sets a sysctl of the endpoint's interface in
+// the container's netns, through a tuning plugin appended to the chain.
+// Keys name the interface IFNAME, eg net.ipv6.conf.IFNAME.accept_ra, which
+// Join replaces with the interface's name.
+const sysctlOptionPrefix = "cni.sysctl."
+
+const (
+	tuningPlugin = "tuning"
+	// stands for the endpoint's interface in tuning plugins' sysctl keys
+	sysctlIfName = "IFNAME"
+)
+
+// The sysctls options may set: only those of the endpoint's own interface,
+// so that a network can't change anything affecting the rest of the
+// container's netns, let alone the host's
+var sysctlAllowed = []string{
+	"net.ipv4.conf." + sysctlIfName + ".",
+	"net.ipv6.conf." + sysctlIfName + ".",
+	"net.ipv4.neigh." + sysctlIfName + ".",
+	"net.ipv6.neigh." + sysctlIfName + ".",
+}
+
+func validSysctlName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// networkSysctls parses the sysctl options in a network's options
+func networkSysctls(options map[string]string) (map[string]string, error) {
+	sysctls := make(map[string]string)
+	for k, v := range options {
+		if !strings.HasPrefix(k, sysctlOptionPrefix) {
+			continue
+		}
+		key := strings.TrimPrefix(k, sysctlOptionPrefix)
+		allowed := false
+		for _, prefix := range sysctlAllowed {
+			if strings.HasPrefix(key, prefix) && validSysctlName(strings.TrimPrefix(key, prefix)) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return nil, fmt.Errorf("network option %s is not an interface sysctl; allowed are %s<name>", k, strings.Join(sysctlAllowed, "<name>, "))
+		}
+		if v == "" || strings.ContainsAny(v, "\n\x00") {
+			return nil, fmt.Errorf("invalid network option %s value %q", k, v)
+		}
+		sysctls[key] = v
+	}
+	return sysctls, nil
+}
+
+// appendTuning appends a tuning plugin setting the network's sysctls, if it
+// has any
+func (driver *driver) appendTuning(nc *netConf, sysctls map[string]string) error {
+	if len(sysctls) == 0 {
+		return nil
+	}
+	path := nc.PluginPath
+	if path == "" {
+		path = driver.plugpath
+	}
+	if _, err := findPlugin(tuningPlugin, path); err != nil {
+		return fmt.Errorf("sysctl options: %v", err)
+	}
+	sysctl := make(map[string]interface{})
+	var keys []string
+	for k, v := range sysctls {
+		sysctl[k] = v
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	log.Printf("Network %s sets sysctls %s, appending %s", nc.Name, strings.Join(keys, ", "), tuningPlugin)
+	nc.Plugins = append(nc.Plugins, map[string]interface{}{
+		"type":   tuningPlugin,
+		"sysctl": sysctl,
+	})
+	nc.Binaries = append(nc.Binaries, tuningPlugin)
+	return nil
+}
+
+// expandSysctlIfName replaces IFNAME in tuning plugins' sysctl keys with the
+// name of the endpoint's interface
+func (nc *netConf) expandSysctlIfName(ifname string) {
+	for i, plugin := range nc.Plugins {
+		sysctl, ok := plugin["sysctl"].(map[string]interface{})
+		if !ok || nc.pluginType(i) != tuningPlugin {
+			continue
+		}
+		expanded := make(map[string]interface{})
+		for k, v := range sysctl {
+			parts := strings.Split(k, ".")
+			for j, part := range parts {
+				if part == sysctlIfName {
+					parts[j] = ifname
+				}
+			}
+			expanded[strings.Join(parts, ".")] = v
+		}
+		plugin["sysctl"] = expanded
+	}
+}
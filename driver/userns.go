@@ -0,0 +1,71 @@
+package driver
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	docker "github.com/dcbw/go-dockerclient"
+)
+
+// How to treat containers in a user namespace other than ours, as with
+// dockerd --userns-remap.  Their netns is owned by their user namespace,
+// but we run plugins as root in the initial one, which may still configure
+// it; plugins that also need to act in the container's user namespace
+// don't work, so such containers may be refused instead.
+const (
+	usernsAllow = "allow"
+	usernsDeny  = "deny"
+)
+
+func validateUsernsMode(mode string) error {
+	switch mode {
+	case usernsAllow, usernsDeny:
+		return nil
+	}
+	return fmt.Errorf("invalid userns mode %q, must be %s or %s", mode, usernsAllow, usernsDeny)
+}
+
+// usernsRemapped tells if a container runs in a user namespace other than
+// ours.  Containers started with --userns=host never do; otherwise we
+// compare the user namespace of its init process with our own, since
+// whether the daemon remaps isn't in the container's inspect data.
+func usernsRemapped(container *docker.Container) (bool, error) {
+	if container.HostConfig != nil && container.HostConfig.UsernsMode == "host" {
+		return false, nil
+	}
+	if container.State.Pid <= 0 {
+		return false, fmt.Errorf("container %s not running", container.ID)
+	}
+	theirs, err := os.Readlink(fmt.Sprintf("/proc/%d/ns/user", container.State.Pid))
+	if err != nil {
+		return false, fmt.Errorf("failed to read container %s user namespace: %v", container.ID, err)
+	}
+	ours, err := os.Readlink("/proc/self/ns/user")
+	if err != nil {
+		return false, fmt.Errorf("failed to read our user namespace: %v", err)
+	}
+	return theirs != ours, nil
+}
+
+// checkUserns applies the userns mode to a joining container.  Failing to
+// tell whether it is remapped only fails the join under -userns deny; with
+// allow, the join goes ahead either way.
+func (driver *driver) checkUserns(container *docker.Container) error {
+	remapped, err := usernsRemapped(container)
+	if err != nil {
+		if driver.usernsMode == usernsDeny {
+			return err
+		}
+		log.Printf("Failed to check container %s user namespace: %v", container.ID, err)
+		return nil
+	}
+	if !remapped {
+		return nil
+	}
+	if driver.usernsMode == usernsDeny {
+		return fmt.Errorf("container %s runs in a remapped user namespace, which is refused by -userns %s", container.ID, usernsDeny)
+	}
+	log.Printf("Container %s runs in a remapped user namespace; configuring its netns from the host's", container.ID)
+	return nil
+}
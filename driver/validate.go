@@ -0,0 +1,46 @@
+package driver
+
+import (
+	"fmt"
+	"strings"
+)
+
+// validateOption, when true, makes CreateNetwork check the network's CNI
+// config, so that mistakes in it fail "docker network create" rather than
+// every Join
+const validateOption = "cni.validate"
+
+// validateNetwork checks that a new network's CNI config can be found and
+// parsed, that its plugins exist, that its raw options apply to it, and
+// that its plugins support its cniVersion.
+// Docker hasn't told us the network's name yet, so the config must be named
+// by the network's options or the network map.
+func (driver *driver) validateNetwork(nw *network) error {
+	confName := nw.Options[confNameOption]
+	if entry, ok := driver.networkMap[nw.ID]; confName == "" && ok {
+		confName = entry.Conf
+	}
+	if confName == "" {
+		return fmt.Errorf("%s requires the network's CNI config to be named by the %s option", validateOption, confNameOption)
+	}
+	nc, err := driver.resolveNetConf(confName, nw)
+	if err != nil {
+		return err
+	}
+	if err := nc.applyRawFields(nw.RawFields); err != nil {
+		return err
+	}
+	if nc.CNIVersion == "" {
+		return nil
+	}
+	for _, plugin := range nc.Binaries {
+		versions, err := driver.supportedVersions(plugin, nc.PluginPath)
+		if err != nil {
+			return fmt.Errorf("Network %s: %v", nc.Name, err)
+		}
+		if !containsString(versions, nc.CNIVersion) {
+			return fmt.Errorf("Network %s: plugin %s does not support cniVersion %s (supports %s)", nc.Name, plugin, nc.CNIVersion, strings.Join(versions, ", "))
+		}
+	}
+	return nil
+}
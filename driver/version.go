@@ -0,0 +1,209 @@
+package driver
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the spec version we claim when asking a plugin which versions it supports
+const probeVersion = "0.4.0"
+
+// Plugins from before the VERSION command fail it, and only speak 0.1.0
+var legacyVersions = []string{"0.1.0"}
+
+type versionInfo struct {
+	CNIVersion        string   `json:"cniVersion"`
+	SupportedVersions []string `json:"supportedVersions"`
+}
+
+// pluginVersions caches each plugin binary's supported spec versions until
+// the binary changes
+type pluginVersions struct {
+	sync.Mutex
+	byPath map[string]*probedVersions
+}
+
+type probedVersions struct {
+	modTime  time.Time
+	versions []string
+}
+
+func newPluginVersions() *pluginVersions {
+	return &pluginVersions{byPath: make(map[string]*probedVersions)}
+}
+
+// supportedVersions returns the spec versions the plugin supports, running
+// it with CNI_COMMAND=VERSION unless we already have since it last changed.
+// The plugin is searched for in path, or the driver's plugin path if empty.
+func (driver *driver) supportedVersions(plugin string, path string) ([]string, error) {
+	rt := &cniRuntime{PluginPath: path}
+	fullname, err := findPlugin(plugin, driver.pluginPath(rt))
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(fullname)
+	if err != nil {
+		return nil, err
+	}
+
+	pv := driver.versions
+	pv.Lock()
+	probed, ok := pv.byPath[fullname]
+	pv.Unlock()
+	if ok && probed.modTime.Equal(fi.ModTime()) {
+		return probed.versions, nil
+	}
+
+	config := []byte(fmt.Sprintf(`{"cniVersion":%q}`, probeVersion))
+	versions := legacyVersions
+	output, err := driver.execPlugin(plugin, "VERSION", rt, config)
+	if err != nil {
+		log.Printf("Plugin %s failed VERSION, assuming it only supports %v: %v", plugin, legacyVersions, err)
+	} else {
+		var info versionInfo
+		if err := json.Unmarshal(output, &info); err != nil || len(info.SupportedVersions) == 0 {
+			return nil, fmt.Errorf("plugin %s returned invalid VERSION output: %s", plugin, output)
+		}
+		versions = info.SupportedVersions
+	}
+
+	pv.Lock()
+	pv.byPath[fullname] = &probedVersions{modTime: fi.ModTime(), versions: versions}
+	pv.Unlock()
+	return versions, nil
+}
+
+// negotiateVersion gives a config without a cniVersion the latest version
+// that every plugin in its chain supports and whose results we can parse,
+// since plugins from 0.3.0 on refuse a config without one.  A config that
+// sets one keeps it; validation checks that its plugins support it.  If
+// there is no such version, the config must set one, so it is an error.
+func (driver *driver) negotiateVersion(nc *netConf) error {
+	if nc.CNIVersion != "" {
+		return nil
+	}
+	candidates := resultVersions
+	for i := range nc.Plugins {
+		plugin := nc.pluginBinary(i)
+		versions, err := driver.supportedVersions(plugin, nc.PluginPath)
+		if err != nil {
+			return err
+		}
+		var common []string
+		for _, v := range candidates {
+			if v != "" && containsString(versions, v) {
+				common = append(common, v)
+			}
+		}
+		candidates = common
+	}
+	if len(candidates) == 0 {
+		return fmt.Errorf("no cniVersion is set and its plugins support none in common")
+	}
+	// resultVersions is in ascending order
+	nc.CNIVersion = candidates[len(candidates)-1]
+	debugf("Network %s has no cniVersion; using %s", nc.Name, nc.CNIVersion)
+	return nil
+}
+
+// logVersions asks the plugins of every network config for their versions
+// at startup, so the answers are cached before the first Join and configs
+// requiring versions their plugins lack show up in the log.  It must finish
+// before we serve requests.
+func (driver *driver) logVersions() {
+	for _, line := range driver.versionsStatus() {
+		log.Printf("CNI %s", line)
+	}
+}
+
+// versionsStatus describes the spec versions supported by each plugin the
+// network configs use, flagging those that don't support a config's
+// cniVersion
+func (driver *driver) versionsStatus() []string {
+	confs, err := loadNetConfs(driver.netconfpath)
+	if err != nil {
+		return []string{fmt.Sprintf("failed to load network configs: %v", err)}
+	}
+
+	// the binaries the configs run and the path they are found in, as
+	// negotiateVersion and Join run them
+	type pluginKey struct {
+		binary string
+		path   string
+	}
+	// plugin :: names of the networks requiring each version
+	required := make(map[pluginKey]map[string][]string)
+	for _, nc := range confs {
+		for i := range nc.Plugins {
+			key := pluginKey{binary: nc.pluginBinary(i), path: nc.PluginPath}
+			if required[key] == nil {
+				required[key] = make(map[string][]string)
+			}
+			if nc.CNIVersion != "" {
+				required[key][nc.CNIVersion] = append(required[key][nc.CNIVersion], nc.Name)
+			}
+		}
+	}
+
+	var lines []string
+	for key, byVersion := range required {
+		plugin := key.binary
+		if key.path != "" {
+			plugin = fmt.Sprintf("%s (path %s)", key.binary, key.path)
+		}
+		versions, err := driver.supportedVersions(key.binary, key.path)
+		if err != nil {
+			lines = append(lines, fmt.Sprintf("plugin %s: %v", plugin, err))
+			continue
+		}
+		line := fmt.Sprintf("plugin %s: supports %s", plugin, strings.Join(versions, ", "))
+		var unsupported []string
+		for version, networks := range byVersion {
+			if !containsString(versions, version) {
+				sort.Strings(networks)
+				unsupported = append(unsupported, fmt.Sprintf("; UNSUPPORTED %s required by %s", version, strings.Join(networks, ", ")))
+			}
+		}
+		sort.Strings(unsupported)
+		line += strings.Join(unsupported, "")
+		lines = append(lines, line)
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// versionAtLeast returns whether spec version v is min or later
+func versionAtLeast(v string, min string) bool {
+	vParts := strings.Split(v, ".")
+	minParts := strings.Split(min, ".")
+	for i := range minParts {
+		var a, b int
+		if i < len(vParts) {
+			var err error
+			if a, err = strconv.Atoi(vParts[i]); err != nil {
+				return false
+			}
+		}
+		b, _ = strconv.Atoi(minParts[i])
+		if a != b {
+			return a > b
+		}
+	}
+	return true
+}
@@ -3,15 +3,29 @@ package driver
 import (
 	"log"
 	"fmt"
+	"sync"
+	"time"
 
 	docker "github.com/dcbw/go-dockerclient"
 )
 
 type watcher struct {
 	dockerer
+	sync.Mutex
 	networks map[string]*docker.Network  // id :: network info
 	containers map[string]*docker.Container
+	// closed and replaced each time a started container is added
+	containersChanged chan struct{}
 	events   chan *docker.APIEvents
+	// the client events is registered with, which reloading may have
+	// replaced since
+	listening *docker.Client
+	// restricts the events Docker sends us
+	eventFilters map[string][]string
+	// container events waiting for a worker
+	queue *eventQueue
+	// the networks to watch; others are ignored
+	managed *managedNetworks
 }
 
 type Watcher interface {
@@ -19,72 +33,262 @@ type Watcher interface {
 	UnwatchNetwork(id string)
 	GetNetworkById(id string) *docker.Network
 	GetContainerBySandboxKey(sandbox string) *docker.Container
+	WaitContainerBySandboxKey(sandbox string, timeout time.Duration) *docker.Container
+	GetContainer(id string) *docker.Container
 	GetContainerNetns(id string) (string, error)
+	WaitContainerNetns(id string, timeout time.Duration) (string, error)
+	Resync() (*ResyncSummary, error)
+	Reconnect() error
 }
 
-func NewWatcher(client *docker.Client) (Watcher, error) {
+// Docker's event types; we only act on container and network events
+var eventTypes = map[string]bool{
+	"container": true,
+	"network":   true,
+	"image":     true,
+	"volume":    true,
+	"daemon":    true,
+	"plugin":    true,
+	"service":   true,
+	"node":      true,
+	"secret":    true,
+	"config":    true,
+}
+
+func validateEventTypes(types []string) error {
+	for _, t := range types {
+		if !eventTypes[t] {
+			return fmt.Errorf("unknown Docker event type %q", t)
+		}
+	}
+	return nil
+}
+
+// NewWatcher tracks managed networks and containers from Docker's events,
+// of the given types only, or of all types if there are none, with up to
+// workers container events handled at once
+func NewWatcher(client *dockerClient, apiTimeout time.Duration, types []string, workers int, managed *managedNetworks) (Watcher, error) {
+	if err := validateEventTypes(types); err != nil {
+		return nil, err
+	}
+
 	w := &watcher{
 		dockerer: dockerer{
 			client: client,
+			timeout: apiTimeout,
 		},
 		networks: make(map[string]*docker.Network),
 		containers: make(map[string]*docker.Container),
+		containersChanged: make(chan struct{}),
 		events:   make(chan *docker.APIEvents),
+		queue:    newEventQueue(),
+		managed:  managed,
+	}
+	if len(types) > 0 {
+		w.eventFilters = map[string][]string{"type": types}
 	}
-	err := client.AddEventListener(w.events)
+	err := w.listen(w.events)
 	if err != nil {
 		return nil, err
 	}
 
-	networks, err := client.ListNetworks()
+	networks, err := w.ListNetworks()
 	if err != nil {
+		w.listening.RemoveEventListener(w.events)
 		return nil, err
 	}
 	for _, nw := range networks {
 		w.WatchNetwork(&nw)
 	}
 
-	go func() {
-		for event := range w.events {
-			switch event.Status {
-			case "start":
-				w.ContainerStart(event.ID)
-			case "die":
-				w.ContainerDied(event.ID)
-			case "create":
-				w.ContainerStart(event.ID)
-			default:
-				log.Printf("Event %+v", event);
-			}
-		}
-	}()
+	w.queue.run(workers, w.handleEvent)
+	go w.watchEvents(w.events)
 
 	return w, nil
 }
 
+// Events that change what we know of a container, which are handled by the
+// workers; any one of them may be coalesced into a later one, since all of
+// them inspect the container.  Others, like exec_start, are only logged.
+var queuedEvents = map[string]bool{
+	"create":     true,
+	"start":      true,
+	"die":        true,
+	"rename":     true,
+	"connect":    true,
+	"disconnect": true,
+}
+
+// watchEvents queues container events for the workers by the container
+// they are about
+func (w *watcher) watchEvents(events chan *docker.APIEvents) {
+	for event := range events {
+		id := event.ID
+		if event.Type == "network" {
+			id = event.Actor.Attributes["container"]
+		}
+		if id == "" || !queuedEvents[event.Status] && !queuedEvents[event.Action] {
+			w.handleEvent(event)
+			continue
+		}
+		w.queue.push(id, event)
+	}
+}
+
+func (w *watcher) handleEvent(event *docker.APIEvents) {
+	if event.Type == "network" {
+		w.networkEvent(event)
+		return
+	}
+	switch event.Status {
+	case "start":
+		w.ContainerStart(event.ID)
+	case "die":
+		w.ContainerDied(event.ID)
+	case "rename":
+		w.ContainerRenamed(event.ID)
+	case "create":
+		w.ContainerCreated(event.ID)
+	default:
+		log.Printf("Event %s", describeEvent(event));
+	}
+}
+
+func (w *watcher) listen(events chan *docker.APIEvents) error {
+	client := w.client.get()
+	err := client.AddEventListenerWithOptions(docker.EventsOptions{
+		Filters: w.eventFilters,
+	}, events)
+	if err == nil {
+		w.Lock()
+		w.listening = client
+		w.Unlock()
+	}
+	return err
+}
+
+// Reconnect replaces our event listener, which may have silently died
+// with the Docker connection or been left on a client that reloading
+// replaced, and resyncs to pick up anything we missed while it was down
+func (w *watcher) Reconnect() error {
+	w.Lock()
+	old := w.events
+	oldClient := w.listening
+	w.events = make(chan *docker.APIEvents)
+	events := w.events
+	w.Unlock()
+
+	if err := oldClient.RemoveEventListener(old); err != nil {
+		log.Printf("Removing event listener: %v", err)
+	}
+	if err := w.listen(events); err != nil {
+		return fmt.Errorf("failed to listen for Docker events: %v", err)
+	}
+	go w.watchEvents(events)
+
+	_, err := w.Resync()
+	return err
+}
+
+// Network events report "docker network connect/disconnect" of containers,
+// including running ones attached or detached outside of container start
+func (w *watcher) networkEvent(event *docker.APIEvents) {
+	switch event.Action {
+	case "connect", "disconnect":
+		id := event.Actor.Attributes["container"]
+		log.Printf("Container %s %sed network %s", id, event.Action, event.Actor.ID)
+		if id == "" {
+			return
+		}
+		// Refresh the container's network settings; a running container
+		// we didn't know about may have just been connected to one of ours
+		if event.Action == "connect" || w.GetContainer(id) != nil {
+			w.ContainerStart(id)
+		}
+	default:
+		log.Printf("Network event %s", describeEvent(event))
+	}
+}
+
 func (w *watcher) WatchNetwork(nw *docker.Network) {
+	if !w.managed.matches(nw) {
+		debugf("Not watching network %s (%s): not in the managed networks allowlist", nw.ID, nw.Name)
+		return
+	}
 	log.Printf("Watch network %s (%s)", nw.ID, nw.Name)
+	w.Lock()
+	defer w.Unlock()
 	w.networks[nw.ID] = nw
 }
 
 func (w *watcher) GetNetworkById(id string) *docker.Network {
+	w.Lock()
+	defer w.Unlock()
 	return w.networks[id]
 }
 
 func (w *watcher) UnwatchNetwork(id string) {
 	log.Printf("Unwatch network %s", id)
+	w.Lock()
+	defer w.Unlock()
 	delete(w.networks, id)
 }
 
+// ContainerCreated tracks a container before it starts, since Docker joins
+// it to its networks while starting it, before the "start" event.  It has
+// no PID yet, but its sandbox key is enough to find its netns.
+func (w *watcher) ContainerCreated(id string) {
+	log.Printf("Container created %s", id)
+	container, err := w.InspectContainer(id)
+	if err != nil {
+		log.Printf("error inspecting container: %s", err)
+		return
+	}
+	w.track(container)
+}
+
 func (w *watcher) ContainerStart(id string) {
 	log.Printf("Container started %s", id)
 	container, err := w.InspectContainer(id)
-	log.Printf("container: %+v", container.NetworkSettings)
 	if err != nil {
 		log.Printf("error inspecting container: %s", err)
 		return
 	}
-	w.containers[id] = container
+	log.Printf("Container %s (%s): %+v", id, describeContainerLabels(container), container.NetworkSettings)
+	w.track(container)
+}
+
+// ContainerRenamed refreshes a container so we log its new name
+func (w *watcher) ContainerRenamed(id string) {
+	container, err := w.InspectContainer(id)
+	if err != nil {
+		log.Printf("error inspecting container: %s", err)
+		return
+	}
+	log.Printf("Container %s renamed (%s)", id, describeContainerLabels(container))
+	w.track(container)
+}
+
+// isCreated returns whether a container was created but never started
+func isCreated(container *docker.Container) bool {
+	return !container.State.Running && container.State.StartedAt.IsZero()
+}
+
+// track records a container we just inspected.  The event we inspected it
+// for may stand in for others coalesced into it, like a "start" or a
+// "die", so it is tracked if it is running or not yet started, and
+// forgotten if it has exited.
+func (w *watcher) track(container *docker.Container) {
+	w.Lock()
+	defer w.Unlock()
+	if container.State.Pid <= 0 && !isCreated(container) {
+		log.Printf("Container %s has exited; not tracking", container.ID)
+		delete(w.containers, container.ID)
+		return
+	}
+	w.containers[container.ID] = container
+	close(w.containersChanged)
+	w.containersChanged = make(chan struct{})
 }
 
 func (w *watcher) ContainerDied(id string) {
@@ -94,10 +298,12 @@ func (w *watcher) ContainerDied(id string) {
 		log.Printf("error inspecting container: %s", err)
 		return
 	}
+	w.Lock()
+	defer w.Unlock()
 	delete(w.containers, id)
 }
 
-func (w *watcher) GetContainerBySandboxKey(sandbox string) *docker.Container {
+func (w *watcher) getContainerBySandboxKey(sandbox string) *docker.Container {
 	for _, container := range w.containers {
 		if container.NetworkSettings.SandboxKey == sandbox {
 			return container
@@ -106,7 +312,43 @@ func (w *watcher) GetContainerBySandboxKey(sandbox string) *docker.Container {
 	return nil
 }
 
+func (w *watcher) GetContainerBySandboxKey(sandbox string) *docker.Container {
+	w.Lock()
+	defer w.Unlock()
+	return w.getContainerBySandboxKey(sandbox)
+}
+
+// WaitContainerBySandboxKey is like GetContainerBySandboxKey but, since a
+// Join may race with the container's "create" event, waits up to timeout
+// for the container to show up.  It may not have started yet.
+func (w *watcher) WaitContainerBySandboxKey(sandbox string, timeout time.Duration) *docker.Container {
+	deadline := time.After(timeout)
+	for {
+		w.Lock()
+		container := w.getContainerBySandboxKey(sandbox)
+		changed := w.containersChanged
+		w.Unlock()
+		if container != nil {
+			return container
+		}
+
+		select {
+		case <-changed:
+		case <-deadline:
+			return nil
+		}
+	}
+}
+
+func (w *watcher) GetContainer(id string) *docker.Container {
+	w.Lock()
+	defer w.Unlock()
+	return w.containers[id]
+}
+
 func (w *watcher) GetContainerNetns(id string) (string, error) {
+	w.Lock()
+	defer w.Unlock()
 	container, ok := w.containers[id]
 	if !ok {
 		return "", fmt.Errorf("Container %s not found", id)
@@ -115,5 +357,102 @@ func (w *watcher) GetContainerNetns(id string) (string, error) {
 	if pid <= 0 {
 		return "", fmt.Errorf("Container %s not running", id)
 	}
-	return fmt.Sprintf("/proc/%s/ns/net", pid), nil
+	return fmt.Sprintf("/proc/%d/ns/net", pid), nil
+}
+
+// WaitContainerNetns is like GetContainerNetns but waits up to timeout for
+// a created container to start and have a PID
+func (w *watcher) WaitContainerNetns(id string, timeout time.Duration) (string, error) {
+	deadline := time.After(timeout)
+	for {
+		w.Lock()
+		changed := w.containersChanged
+		w.Unlock()
+		netns, err := w.GetContainerNetns(id)
+		if err == nil {
+			return netns, nil
+		}
+
+		select {
+		case <-changed:
+		case <-deadline:
+			return "", err
+		}
+	}
+}
+
+// ResyncSummary lists what a Resync changed
+type ResyncSummary struct {
+	NetworksAdded     []string
+	NetworksRemoved   []string
+	ContainersAdded   []string
+	ContainersUpdated []string
+	ContainersRemoved []string
+}
+
+// Resync re-reads all networks and running or created containers from
+// Docker and replaces our view with them, in case we missed events
+func (w *watcher) Resync() (*ResyncSummary, error) {
+	networks, err := w.ListNetworks()
+	if err != nil {
+		return nil, err
+	}
+	list, err := w.ListContainers(liveContainersOptions)
+	if err != nil {
+		return nil, err
+	}
+	containers := make(map[string]*docker.Container)
+	for _, c := range list {
+		container, err := w.InspectContainer(c.ID)
+		if err != nil {
+			log.Printf("error inspecting container %s: %s", c.ID, err)
+			continue
+		}
+		if container.State.Pid > 0 || isCreated(container) {
+			containers[c.ID] = container
+		}
+	}
+
+	w.Lock()
+	defer w.Unlock()
+
+	summary := &ResyncSummary{}
+	fresh := make(map[string]bool)
+	for i := range networks {
+		nw := &networks[i]
+		if !w.managed.matches(nw) {
+			continue
+		}
+		fresh[nw.ID] = true
+		if _, ok := w.networks[nw.ID]; !ok {
+			summary.NetworksAdded = append(summary.NetworksAdded, nw.ID)
+		}
+		w.networks[nw.ID] = nw
+	}
+	for id := range w.networks {
+		if !fresh[id] {
+			summary.NetworksRemoved = append(summary.NetworksRemoved, id)
+			delete(w.networks, id)
+		}
+	}
+
+	for id, container := range containers {
+		if old, ok := w.containers[id]; !ok {
+			summary.ContainersAdded = append(summary.ContainersAdded, id)
+		} else if old.State.Pid != container.State.Pid {
+			summary.ContainersUpdated = append(summary.ContainersUpdated, id)
+		}
+		w.containers[id] = container
+	}
+	for id := range w.containers {
+		if _, ok := containers[id]; !ok {
+			summary.ContainersRemoved = append(summary.ContainersRemoved, id)
+			delete(w.containers, id)
+		}
+	}
+	close(w.containersChanged)
+	w.containersChanged = make(chan struct{})
+
+	log.Printf("Resync: %+v", summary)
+	return summary, nil
 }
@@ -0,0 +1,72 @@
+package driver
+
+import (
+	"testing"
+	"time"
+
+	docker "github.com/dcbw/go-dockerclient"
+)
+
+func testContainer(id string, pid int, started bool) *docker.Container {
+	container := &docker.Container{
+		ID:              id,
+		State:           docker.State{Pid: pid, Running: pid > 0},
+		NetworkSettings: &docker.NetworkSettings{SandboxKey: "/var/run/docker/netns/" + id},
+	}
+	if started {
+		container.State.StartedAt = time.Now()
+	}
+	return container
+}
+
+func TestWatcherTrack(t *testing.T) {
+	tests := []struct {
+		name      string
+		container *docker.Container
+		tracked   bool
+	}{
+		{name: "created", container: testContainer("c1", 0, false), tracked: true},
+		{name: "running", container: testContainer("c1", 42, true), tracked: true},
+		{name: "exited", container: testContainer("c1", 0, true), tracked: false},
+	}
+
+	for _, tt := range tests {
+		w := &watcher{
+			containers:        map[string]*docker.Container{"c1": testContainer("c1", 42, true)},
+			containersChanged: make(chan struct{}),
+		}
+		w.track(tt.container)
+		if got := w.GetContainer("c1") != nil; got != tt.tracked {
+			t.Errorf("%s: tracked = %v, want %v", tt.name, got, tt.tracked)
+		}
+	}
+}
+
+func TestWatcherCreatedContainer(t *testing.T) {
+	w := &watcher{
+		containers:        map[string]*docker.Container{},
+		containersChanged: make(chan struct{}),
+	}
+	w.track(testContainer("c1", 0, false))
+
+	// A Join finds a created container by its sandbox key without waiting
+	// for it to start
+	if c := w.WaitContainerBySandboxKey("/var/run/docker/netns/c1", 0); c == nil || c.ID != "c1" {
+		t.Fatalf("WaitContainerBySandboxKey() = %v, want c1", c)
+	}
+	if _, err := w.WaitContainerNetns("c1", 0); err == nil {
+		t.Errorf("WaitContainerNetns() of a created container succeeded")
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		w.track(testContainer("c1", 42, true))
+	}()
+	netns, err := w.WaitContainerNetns("c1", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if netns != "/proc/42/ns/net" {
+		t.Errorf("WaitContainerNetns() = %s, want /proc/42/ns/net", netns)
+	}
+}
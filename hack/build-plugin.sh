@@ -0,0 +1,30 @@
+#!/bin/bash
+
+# Builds the Docker managed plugin from plugin/config.json and a rootfs
+# holding a static build of cni-docker-plugin, and creates it with
+# "docker plugin create" under the given name (default cni-docker-plugin)
+
+set -e
+
+OSDN_ROOT=$(
+  unset CDPATH
+  osdn_root=$(dirname "${BASH_SOURCE}")/..
+  cd "${osdn_root}"
+  pwd
+)
+
+PLUGIN_NAME="${1:-cni-docker-plugin}"
+PLUGIN_DIR="${OSDN_ROOT}/_output/plugin"
+
+CGO_ENABLED=0 "${OSDN_ROOT}/hack/build.sh"
+
+rm -rf "${PLUGIN_DIR}"
+mkdir -p "${PLUGIN_DIR}/rootfs"
+for dir in etc/cni/net.d opt/cni/bin run/docker/plugins var/run/docker/netns var/run/cni-docker-plugin; do
+  mkdir -p "${PLUGIN_DIR}/rootfs/${dir}"
+done
+cp "${OSDN_ROOT}/_output/local/go/bin/cni-docker-plugin" "${PLUGIN_DIR}/rootfs/"
+cp "${OSDN_ROOT}/plugin/config.json" "${PLUGIN_DIR}/"
+
+docker plugin rm -f "${PLUGIN_NAME}" >/dev/null 2>&1 || true
+docker plugin create "${PLUGIN_NAME}" "${PLUGIN_DIR}"
@@ -34,7 +34,13 @@ setup_env() {
   echo $go_pkg_dir
 }
 
+build_ldflags() {
+  local git_commit=$(git -C "${OSDN_ROOT}" rev-parse --short HEAD 2>/dev/null || echo unknown)
+  local build_date=$(date -u +%Y-%m-%dT%H:%M:%SZ)
+  echo "-X main.GitCommit=${git_commit} -X main.BuildDate=${build_date}"
+}
+
 setup_env
 go get -d -tags netgo
-go install ${OSDN_GO_PACKAGE}
+go install -ldflags "$(build_ldflags)" ${OSDN_GO_PACKAGE}
 
@@ -2,34 +2,218 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"log"
+	"os"
+	"os/signal"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
 	"cni-docker-plugin/driver"
 )
 
-const (
-	Version = "0.0"
+// Build metadata; GitCommit and BuildDate are set with -ldflags -X by
+// hack/build.sh
+var (
+	Version   = "0.0"
+	GitCommit = "unknown"
+	BuildDate = "unknown"
 )
 
+// stringList collects the values of a repeatable flag
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// Where Docker expects a managed (v2) plugin's socket, named by the
+// interface socket in plugin/config.json
+const managedSocket = "/run/docker/plugins/cni.sock"
+
+// managedEnvPrefix prefixes the environment variables from which a managed
+// plugin reads its options, since "docker plugin set" can only change the
+// environment, not the entrypoint's flags
+const managedEnvPrefix = "CNI_DOCKER_"
+
+// flagsFromEnv sets each flag not given on the command line from
+// CNI_DOCKER_<FLAG>, with the flag name upper-cased and dashes made
+// underscores, eg CNI_DOCKER_ADD_TIMEOUT for -add-timeout.  Repeatable
+// flags take a comma-separated list.
+func flagsFromEnv() error {
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		if err != nil || set[f.Name] {
+			return
+		}
+		key := managedEnvPrefix + strings.ToUpper(strings.Replace(f.Name, "-", "_", -1))
+		value, ok := os.LookupEnv(key)
+		if !ok || value == "" {
+			return
+		}
+		values := []string{value}
+		if _, ok := f.Value.(*stringList); ok {
+			values = strings.Split(value, ",")
+		}
+		for _, v := range values {
+			if e := flag.Set(f.Name, v); e != nil {
+				err = fmt.Errorf("invalid %s %q: %v", key, v, e)
+				return
+			}
+		}
+	})
+	return err
+}
+
 func main() {
 	var (
 		socket	string
-		debug	bool
-		plugpath string
-		netconfpath string
+		version bool
+		managed bool
+		eventTypes string
+		dumpConfig string
+		dumpOpts   stringList
+		dumpLabels stringList
 		d	driver.Driver
 	)
+	opts := &driver.Options{
+		Version: Version,
+	}
 
-	flag.BoolVar(&debug, "debug", false, "output debugging info to stderr")
+	flag.BoolVar(&opts.Debug, "debug", false, "output debugging info to stderr")
+	flag.BoolVar(&version, "version", false, "print version information and exit")
+	flag.StringVar(&dumpConfig, "dump-config", "", "print the config each plugin would be given on joining the named network, and exit")
+	flag.Var(&dumpOpts, "dump-opt", "network driver option for -dump-config as key=value (repeatable)")
+	flag.Var(&dumpLabels, "dump-label", "container label for -dump-config as key=value (repeatable)")
+	flag.BoolVar(&managed, "managed", false, "run as a Docker managed plugin: listen on "+managedSocket+" unless -socket is given, and read unset options from "+managedEnvPrefix+"* environment variables")
 	flag.StringVar(&socket, "socket", "/usr/share/docker/plugins/cni.sock", "socket on which to listen")
-	flag.StringVar(&plugpath, "plugpath", "/usr/libexec/cni-plugins", "path to CNI executables")
-	flag.StringVar(&netconfpath, "netconfpath", "/etc/cni/net.d", "path to CNI network configuration files")
+	flag.StringVar(&opts.SocketGroup, "socket-group", "", "group to own the socket (unchanged if empty)")
+	flag.StringVar(&opts.SocketMode, "socket-mode", "", "octal permissions of the socket (unchanged if empty)")
+	flag.DurationVar(&opts.ReadTimeout, "read-timeout", 30*time.Second, "timeout for reading a request (0 to disable)")
+	flag.DurationVar(&opts.WriteTimeout, "write-timeout", 30*time.Second, "timeout for handling a request, except those that run plugins, which -add-timeout, -del-timeout and -check-timeout bound instead (0 to disable)")
+	flag.DurationVar(&opts.IdleTimeout, "idle-timeout", 2*time.Minute, "timeout for an idle connection (0 to disable)")
+	flag.StringVar(&opts.PlugPath, "plugpath", "/usr/libexec/cni-plugins", "colon-separated list of paths to CNI executables")
+	flag.StringVar(&opts.NetConfPath, "netconfpath", "/etc/cni/net.d", "path to CNI network configuration files")
+	flag.StringVar(&opts.ResolvConfDir, "resolv-conf-dir", "/var/run/cni-docker-plugin/resolv", "directory in which endpoints' resolv.conf files are generated")
+	flag.StringVar(&opts.HostsDir, "hosts-dir", "/var/run/cni-docker-plugin/hosts", "directory in which endpoints' hosts files are generated, for networks with the cni.hosts option")
+	flag.StringVar(&opts.NetworkMap, "network-map", "", "JSON file mapping Docker network IDs or names to CNI network configs")
+	flag.StringVar(&opts.ConfRules, "conf-rules", "", "JSON file of rules choosing CNI network configs at Join by network option and container label")
+	flag.BoolVar(&opts.NoWatch, "no-watch", false, "don't track Docker events or networks; resolve networks from their options and -network-map, not their names, and inspect containers on each Join")
+	flag.Var((*stringList)(&opts.ManagedNetworks), "managed-networks", "only watch and join networks with this name, or label:KEY[=VALUE]; joins of others are refused (repeatable; all networks if unset)")
+	flag.StringVar(&eventTypes, "event-types", "container,network", "comma-separated types of Docker event to listen for (all if empty)")
+	flag.IntVar(&opts.EventWorkers, "event-workers", 4, "number of containers whose Docker events are handled at once")
+	flag.Var((*stringList)(&opts.LogLabelAllow), "log-label-allow", "container label that may be logged, or name or image, as a shell pattern (repeatable; name and image if unset)")
+	flag.Var((*stringList)(&opts.LogLabelDeny), "log-label-deny", "container label never to log, even if allowed, as a shell pattern (repeatable)")
+	flag.IntVar(&opts.ErrorHistory, "error-history", 50, "number of recent failed requests and plugin executions to show at /debug/errors with -debug (0 to keep none)")
+	flag.StringVar(&opts.CNICacheDir, "cni-cache-dir", "/var/lib/cni", "directory in which attachments' results are cached in libcni's format, with IPAM pools and preallocated addresses, and restored from at startup (disabled if empty)")
+	flag.StringVar(&opts.AuditLog, "audit-log", "", "file to which every plugin execution is recorded (disabled if empty)")
+	flag.StringVar(&opts.ExecHook, "exec-hook", "", "command to run in the background on network and endpoint lifecycle events, with their details in CNI_DOCKER_* environment variables (disabled if empty)")
+	flag.StringVar(&opts.AdminSocket, "admin-socket", "", "socket on which to serve operator endpoints (disabled if empty)")
+	flag.StringVar(&opts.IPAMPlugin, "ipam-plugin", "", "CNI IPAM plugin with which to also act as a Docker IPAM driver (disabled if empty)")
+	flag.StringVar(&opts.Scope, "scope", "local", "network scope reported to Docker, local or global")
+	flag.Var((*stringList)(&opts.FallbackPlugins), "fallback-plugin", "plugin to append to chains without the capability, when a join needs it, as capability=plugin, eg portMappings=portmap (repeatable)")
+	flag.Var((*stringList)(&opts.PluginScopes), "plugin-scope", "scope of networks whose first plugin is the given type as plugin=scope (repeatable)")
+	flag.StringVar(&opts.IfPrefix, "ifname-prefix", "eth", "prefix of container interface names; a container's Nth network gets <prefix><N-1>")
+	flag.StringVar(&opts.DstPrefix, "dst-prefix", "ethwe", "prefix libnetwork renames container interfaces to, unless a network's cni.dstprefix option or network map entry overrides it")
+	flag.StringVar(&opts.DockerEnvFile, "docker-env-file", "", "file of DOCKER_HOST, DOCKER_TLS_VERIFY and DOCKER_CERT_PATH settings, as KEY=VALUE lines, read at startup and on SIGHUP (our environment's are used if empty)")
+	flag.DurationVar(&opts.WaitForDocker, "wait-for-docker", 0, "how long to keep trying to reach Docker at startup (0 to not wait)")
+	flag.DurationVar(&opts.DockerAPITimeout, "docker-api-timeout", 10*time.Second, "timeout for Docker API calls (0 to disable)")
+	flag.DurationVar(&opts.HealthInterval, "health-interval", 10*time.Second, "roughly how often to ping Docker to check the connection (0 to disable)")
+	flag.DurationVar(&opts.CheckInterval, "check-interval", 0, "roughly how often to run CNI CHECK for every joined endpoint (0 to disable)")
+	flag.IntVar(&opts.BreakerThreshold, "breaker-threshold", 5, "consecutive plugin ADD failures before refusing further ADDs (0 to disable)")
+	flag.DurationVar(&opts.BreakerWindow, "breaker-window", time.Minute, "window in which plugin ADD failures are counted")
+	flag.DurationVar(&opts.BreakerCooldown, "breaker-cooldown", 30*time.Second, "how long to refuse ADDs for a failing plugin before trying it again")
+	flag.DurationVar(&opts.AddTimeout, "add-timeout", 2*time.Minute, "timeout for a plugin ADD, which may wait on DHCP (0 to disable)")
+	flag.DurationVar(&opts.DelTimeout, "del-timeout", 30*time.Second, "timeout for a plugin DEL (0 to disable)")
+	flag.DurationVar(&opts.CheckTimeout, "check-timeout", 10*time.Second, "timeout for a plugin CHECK (0 to disable)")
+	flag.StringVar(&opts.NetnsResolver, "netns-resolver", "auto", "how to find containers' netns: proc (the sandbox's, else the container process's), sandbox (only the sandbox's, for runtimes like runsc or kata), or auto to pick by the container's runtime")
+	flag.StringVar(&opts.UsernsMode, "userns", "allow", "how to treat containers in a remapped user namespace: allow, or deny to fail their joins")
+	flag.StringVar(&opts.SharedNetnsMode, "shared-netns", "reuse", "how to join containers run with --network container:<id>, like pod containers sharing their sandbox's netns: reuse the interface the other container joined with, or add to run the plugins for them too")
+	flag.BoolVar(&opts.CheckMaster, "check-master", false, "check that plugins' master host interfaces exist before running them")
+	flag.BoolVar(&opts.PreallocIP, "prealloc-ip", false, "allocate endpoint addresses Docker's IPAM didn't assign at CreateEndpoint, with the network config's IPAM plugin")
+	flag.StringVar(&opts.PluginWrapper, "plugin-wrapper", "", "command through which to run plugins, given the plugin path as its last argument; it must pass on the environment, stdin, stdout, stderr and exit status")
+	flag.StringVar(&opts.PluginChecksums, "plugin-checksums", "", "JSON file mapping plugin names to the sha256 of their binaries; other plugins, or ones that don't match, aren't run (disabled if empty)")
+	flag.StringVar(&opts.PluginCgroup, "plugin-cgroup", "", "path of an existing cgroup v2, eg /sys/fs/cgroup/cni-plugins, in which to run plugins; we must be allowed to move processes into it (disabled if empty)")
+	flag.Int64Var(&opts.PluginOutputLimit, "plugin-output-limit", 1<<20, "bytes a plugin may write to stdout or stderr before it is killed (0 to disable)")
+	flag.IntVar(&opts.PluginRetries, "plugin-retries", 3, "times to retry a plugin that failed on IPAM lock contention")
+	flag.BoolVar(&opts.AsyncDel, "async-del", false, "return from Leave before CNI DEL has run")
+	flag.IntVar(&opts.AsyncDelWorkers, "async-del-workers", 4, "number of background CNI DELs to run at once with -async-del")
+	flag.IntVar(&opts.AsyncDelQueue, "async-del-queue", 256, "maximum number of queued CNI DELs with -async-del")
+	flag.IntVar(&opts.AsyncDelRetries, "async-del-retries", 3, "times to retry a failed background CNI DEL with -async-del")
+	flag.Var((*stringList)(&opts.PluginArgs), "plugin-args", "static CNI_ARGS for a plugin as plugin=KEY=VALUE (repeatable)")
+	flag.IntVar(&opts.DefaultMTU, "default-mtu", 0, "MTU for interfaces of networks whose config and options don't set one (0 to leave to the plugins)")
+	flag.BoolVar(&opts.RequireIP, "require-ip", false, "fail joins to networks with IPAM when the plugins return no address")
+	flag.StringVar(&opts.ContainerNameArg, "container-name-arg", "", "CNI_ARGS key under which to pass plugins the container name, eg CONTAINER_NAME (disabled if empty)")
+	flag.BoolVar(&opts.NetworkArgs, "network-args", false, "pass plugins the Docker network's ID and name in their config's args, under com.docker.network")
+	flag.BoolVar(&opts.K8sArgs, "k8s-args", false, "pass K8S_POD_* CNI_ARGS from Kubernetes pod container labels")
 	flag.Parse()
+	if managed {
+		if err := flagsFromEnv(); err != nil {
+			log.Fatalf("Failed to read options from the environment: %s", err)
+		}
+		socketSet := false
+		flag.Visit(func(f *flag.Flag) {
+			socketSet = socketSet || f.Name == "socket"
+		})
+		if !socketSet {
+			socket = managedSocket
+		}
+	}
+	if eventTypes != "" {
+		opts.EventTypes = strings.Split(eventTypes, ",")
+	}
+
+	if version {
+		fmt.Printf("cni-docker-plugin %s\n", Version)
+		fmt.Printf("git commit: %s\n", GitCommit)
+		fmt.Printf("build date: %s\n", BuildDate)
+		fmt.Printf("go version: %s\n", runtime.Version())
+		os.Exit(0)
+	}
 
-	d, err := driver.New(Version, plugpath, netconfpath)
+	if dumpConfig != "" {
+		if err := driver.DumpConfig(opts, dumpConfig, dumpOpts, dumpLabels, os.Stdout); err != nil {
+			log.Fatalf("Failed to dump network %s config: %s", dumpConfig, err)
+		}
+		os.Exit(0)
+	}
+
+	d, err := driver.New(opts)
 	if err != nil {
 		log.Fatalf("Failed to create driver: %s", err)
 	}
 
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		log.Printf("Received %s, shutting down", sig)
+		d.Shutdown()
+		os.Exit(0)
+	}()
+
+	// SIGHUP repoints us at the Docker daemon, eg after its socket moved
+	hups := make(chan os.Signal, 1)
+	signal.Notify(hups, syscall.SIGHUP)
+	go func() {
+		for range hups {
+			log.Printf("Received SIGHUP, reloading the Docker client")
+			if err := d.ReloadDocker(); err != nil {
+				log.Printf("Failed to reload the Docker client: %s", err)
+			}
+		}
+	}()
+
 	if err := d.Listen(socket); err != nil {
 		log.Fatal(err)
 	}